@@ -0,0 +1,53 @@
+package ridgenative
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// accessLogEntry is a line of the access logs.
+type accessLogEntry struct {
+	Time         time.Time `json:"time"`
+	RequestID    string    `json:"request_id,omitempty"`
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	Status       int       `json:"status"`
+	RequestBytes int64     `json:"request_bytes"`
+	Bytes        int64     `json:"bytes"`
+	DurationMS   float64   `json:"duration_ms"`
+}
+
+// writeAccessLog writes an access log line for the request in JSON Lines format.
+// requestBytes is the length of the body of the event after decoding base64.
+// r.ContentLength is not used, because it is unknown after decompressing the body.
+// It does nothing if the access log is disabled.
+func (f *lambdaFunction) writeAccessLog(r *http.Request, requestBytes int64, status int, bytes int64, start time.Time) {
+	if f.accessLog == nil {
+		return
+	}
+
+	now := time.Now()
+	requestID, _ := RequestID(r.Context())
+	data, err := json.Marshal(accessLogEntry{
+		Time:         now,
+		RequestID:    requestID,
+		Method:       r.Method,
+		Path:         r.URL.Path,
+		Status:       status,
+		RequestBytes: requestBytes,
+		Bytes:        bytes,
+		DurationMS:   float64(now.Sub(start)) / float64(time.Millisecond),
+	})
+	if err != nil {
+		f.logger.Printf("ridgenative: failed to marshal the access log: %v", err)
+		return
+	}
+	data = append(data, '\n')
+
+	f.accessLogMu.Lock()
+	defer f.accessLogMu.Unlock()
+	if _, err := f.accessLog.Write(data); err != nil {
+		f.logger.Printf("ridgenative: failed to write the access log: %v", err)
+	}
+}
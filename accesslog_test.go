@@ -0,0 +1,149 @@
+package ridgenative
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// chanWriter sends each written line to the channel.
+type chanWriter chan []byte
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	w <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func TestWithAccessLog(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if _, err := io.WriteString(w, `{"hello":"world"}`); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("buffered", func(t *testing.T) {
+		var buf bytes.Buffer
+		l := newOptions([]Option{WithAccessLog(&buf)}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.WithValue(context.Background(), lambdaContextKey, &InvokeContext{AwsRequestID: "request-id"})
+		if _, err := l.lambdaHandler(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+
+		var entry accessLogEntry
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+			t.Errorf("want a trailing newline, got %q", buf.String())
+		}
+		if entry.RequestID != "request-id" {
+			t.Errorf("unexpected request id: want %q, got %q", "request-id", entry.RequestID)
+		}
+		if entry.Method != http.MethodGet {
+			t.Errorf("unexpected method: want %q, got %q", http.MethodGet, entry.Method)
+		}
+		if entry.Path != "/my/path" {
+			t.Errorf("unexpected path: want %q, got %q", "/my/path", entry.Path)
+		}
+		if entry.Status != http.StatusCreated {
+			t.Errorf("unexpected status: want %d, got %d", http.StatusCreated, entry.Status)
+		}
+		if entry.Bytes != int64(len(`{"hello":"world"}`)) {
+			t.Errorf("unexpected bytes: want %d, got %d", len(`{"hello":"world"}`), entry.Bytes)
+		}
+		if entry.RequestBytes != 0 {
+			t.Errorf("unexpected request bytes: want %d, got %d", 0, entry.RequestBytes)
+		}
+		if entry.Time.IsZero() {
+			t.Error("want time, got zero")
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		logs := make(chanWriter, 1)
+		l := newOptions([]Option{WithAccessLog(logs)}).newLambdaFunction(h)
+		r, w := io.Pipe()
+		_, err := l.lambdaHandlerStreaming(context.Background(), &request{
+			RequestContext: ProxyRequestContext{
+				HTTP: &ProxyRequestContextHTTP{
+					Method: http.MethodPost,
+					Path:   "/streaming",
+				},
+			},
+			Body:            "aGVsbG8=",
+			IsBase64Encoded: true,
+		}, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			t.Fatal(err)
+		}
+
+		var entry accessLogEntry
+		if err := json.Unmarshal(<-logs, &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.RequestID != "" {
+			t.Errorf("unexpected request id: %q", entry.RequestID)
+		}
+		if entry.Method != http.MethodPost {
+			t.Errorf("unexpected method: want %q, got %q", http.MethodPost, entry.Method)
+		}
+		if entry.Path != "/streaming" {
+			t.Errorf("unexpected path: want %q, got %q", "/streaming", entry.Path)
+		}
+		if entry.Status != http.StatusCreated {
+			t.Errorf("unexpected status: want %d, got %d", http.StatusCreated, entry.Status)
+		}
+		if entry.Bytes != int64(len(`{"hello":"world"}`)) {
+			t.Errorf("unexpected bytes: want %d, got %d", len(`{"hello":"world"}`), entry.Bytes)
+		}
+		if entry.RequestBytes != int64(len("hello")) {
+			t.Errorf("unexpected request bytes: want %d, got %d", len("hello"), entry.RequestBytes)
+		}
+	})
+	t.Run("decompressed request", func(t *testing.T) {
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		if _, err := io.WriteString(zw, "hello"); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		l := newOptions([]Option{WithAccessLog(&buf), WithRequestDecompression()}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-v2-post-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Body = base64.StdEncoding.EncodeToString(compressed.Bytes())
+		req.IsBase64Encoded = true
+		req.Headers["content-encoding"] = "gzip"
+		if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+
+		var entry accessLogEntry
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		// the length of the compressed body, as the observer records.
+		if entry.RequestBytes != int64(compressed.Len()) {
+			t.Errorf("unexpected request bytes: want %d, got %d", compressed.Len(), entry.RequestBytes)
+		}
+	})
+}
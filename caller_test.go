@@ -0,0 +1,40 @@
+package ridgenative_test
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/shogo82148/ridgenative"
+)
+
+func writeHeaderTwice(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+func TestRelevantCaller(t *testing.T) {
+	r, err := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := ridgenative.NewV2Event(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf strings.Builder
+	logger := log.New(&buf, "", 0)
+	if _, err := ridgenative.Invoke(context.Background(), http.HandlerFunc(writeHeaderTwice), payload, ridgenative.WithLogger(logger)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the log points at the user code that calls WriteHeader twice.
+	got := buf.String()
+	want := "ridgenative: superfluous response.WriteHeader call from github.com/shogo82148/ridgenative_test.writeHeaderTwice (caller_test.go:15)\n"
+	if got != want {
+		t.Errorf("unexpected log: want %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,14 @@
+package ridgenative
+
+import "net/http"
+
+// Chain wraps h with the middlewares mw.
+// The first middleware is the outermost one, so it handles the request first.
+// The request passed to h carries the context values set by ridgenative,
+// such as RequestContext and LambdaContext, unless the middlewares replace the context.
+func Chain(h http.Handler, mw ...func(http.Handler) http.Handler) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
@@ -0,0 +1,50 @@
+package ridgenative
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+	middleware := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+		if _, ok := RequestContext(r.Context()); !ok {
+			t.Error("request context not found")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	l := newLambdaFunction(Chain(h, middleware("first"), middleware("second")))
+	req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := l.lambdaHandler(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("unexpected status code: want %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	if want := []string{"first", "second", "handler"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("unexpected order: want %v, got %v", want, order)
+	}
+}
+
+func TestChain_NoMiddleware(t *testing.T) {
+	h := http.NotFoundHandler()
+	if got := Chain(h); reflect.ValueOf(got).Pointer() != reflect.ValueOf(h).Pointer() {
+		t.Error("want the handler itself")
+	}
+}
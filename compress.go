@@ -0,0 +1,152 @@
+package ridgenative
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// minCompressSize is the minimum size of the response body to compress.
+// Compressing small bodies is not worth it, the compressed one may be larger than the original.
+const minCompressSize = 1024
+
+// compress compresses the response body if the client accepts it.
+func (rw *responseWriter) compress() {
+	if rw.header.Get("Content-Encoding") != "" {
+		// the body is already encoded.
+		return
+	}
+	if rw.w.Len() < minCompressSize {
+		return
+	}
+	if rw.isBinaryType(rw.header.Get("Content-Type")) {
+		// binary formats, such as images and videos, are typically compressed already.
+		return
+	}
+
+	// the response varies depending on the Accept-Encoding header.
+	rw.header.Add("Vary", "Accept-Encoding")
+
+	offers := make([]string, 0, len(rw.encoders)+1)
+	for _, enc := range rw.encoders {
+		offers = append(offers, enc.coding)
+	}
+	offers = append(offers, "gzip")
+	coding := negotiateContentEncoding(rw.acceptEncoding, offers)
+	if coding == "" {
+		return
+	}
+
+	if rw.isHead {
+		// the body of HEAD responses is discarded, so there is nothing to compress.
+		// only the headers are same as the GET response.
+		rw.w.Reset()
+	} else {
+		buf := getBuffer()
+		zw := rw.newEncoder(coding, buf)
+		if _, err := zw.Write(rw.w.Bytes()); err != nil {
+			// writing to bytes.Buffer never fails.
+			panic(err)
+		}
+		if err := zw.Close(); err != nil {
+			panic(err)
+		}
+		putBuffer(rw.w)
+		rw.w = buf
+	}
+	rw.header.Set("Content-Encoding", coding)
+	rw.header.Del("Content-Length")
+}
+
+// responseEncoder is an encoder of a content coding for the response compression.
+type responseEncoder struct {
+	coding    string
+	newWriter func(w io.Writer) io.WriteCloser
+}
+
+// newEncoder returns a writer that compresses the data with coding into w.
+func (rw *responseWriter) newEncoder(coding string, w io.Writer) io.WriteCloser {
+	for _, enc := range rw.encoders {
+		if enc.coding == coding {
+			return enc.newWriter(w)
+		}
+	}
+	return gzip.NewWriter(w)
+}
+
+// negotiateContentEncoding returns the best content coding in offers for the Accept-Encoding header.
+// If no offers are acceptable, it returns an empty string.
+// If some offers have the same quality, the first one wins.
+func negotiateContentEncoding(acceptEncoding string, offers []string) string {
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q := acceptEncodingQuality(acceptEncoding, offer)
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// acceptEncodingQuality returns the quality value of coding in the Accept-Encoding header.
+func acceptEncodingQuality(acceptEncoding, coding string) float64 {
+	wildcard := 0.0
+	for _, spec := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(spec, ";")
+		name = strings.TrimSpace(name)
+		v := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(param, "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(key), "q") {
+				continue
+			}
+			f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				f = 0
+			}
+			v = f
+		}
+		if strings.EqualFold(name, coding) {
+			return v
+		}
+		if name == "*" {
+			wildcard = v
+		}
+	}
+	return wildcard
+}
+
+// decompressBody wraps the request body in the decompressor for its Content-Encoding header,
+// and removes the header because the handler receives the decoded body.
+// gzip and deflate are supported, the other codings such as br are passed through as they are.
+// The length of the decompressed body is unknown, so the returned content length is -1.
+func (f *lambdaFunction) decompressBody(headers http.Header, body io.ReadCloser, contentLength int64) (io.ReadCloser, int64, error) {
+	if !f.requestDecompression || body == http.NoBody {
+		return body, contentLength, nil
+	}
+
+	var zr io.ReadCloser
+	var err error
+	switch strings.ToLower(strings.TrimSpace(headers.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		zr, err = gzip.NewReader(body)
+	case "deflate":
+		// "deflate" in HTTP means the zlib format. (RFC 9110 Section 8.4.1.2)
+		zr, err = zlib.NewReader(body)
+	default:
+		return body, contentLength, nil
+	}
+	if err != nil {
+		return nil, 0, &requestError{statusCode: http.StatusBadRequest, err: fmt.Errorf("ridgenative: failed to decompress the body: %w", err)}
+	}
+	headers.Del("Content-Encoding")
+	if f.maxRequestBodySize > 0 {
+		// protect the handler from decompression bombs.
+		zr = http.MaxBytesReader(nil, zr, f.maxRequestBodySize)
+	}
+	return zr, -1, nil
+}
@@ -0,0 +1,539 @@
+package ridgenative
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateContentEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		offers         []string
+		want           string
+	}{
+		{"", []string{"gzip"}, ""},
+		{"gzip", []string{"gzip"}, "gzip"},
+		{"deflate, gzip", []string{"gzip"}, "gzip"},
+		{"GZIP", []string{"gzip"}, "gzip"},
+		{"gzip;q=0", []string{"gzip"}, ""},
+		{"gzip; q=0.5", []string{"gzip"}, "gzip"},
+		{"*", []string{"gzip"}, "gzip"},
+		{"*;q=0", []string{"gzip"}, ""},
+		{"gzip;q=0, *", []string{"gzip"}, ""},
+		{"identity", []string{"gzip"}, ""},
+	}
+	for _, tt := range tests {
+		got := negotiateContentEncoding(tt.acceptEncoding, tt.offers)
+		if got != tt.want {
+			t.Errorf("negotiateContentEncoding(%q, %v) = %q, want %q", tt.acceptEncoding, tt.offers, got, tt.want)
+		}
+	}
+}
+
+func TestWithResponseCompression(t *testing.T) {
+	body := strings.Repeat(`{"hello":"world"}`, 100)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := io.WriteString(w, body); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("gzip", func(t *testing.T) {
+		l := newOptions([]Option{WithResponseCompression()}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Headers["accept-encoding"] = "gzip, deflate"
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.IsBase64Encoded {
+			t.Error("unexpected IsBase64Encoded: want true, got false")
+		}
+		if resp.Headers["Content-Encoding"] != "gzip" {
+			t.Errorf("unexpected Content-Encoding: want %q, got %q", "gzip", resp.Headers["Content-Encoding"])
+		}
+		if resp.Headers["Vary"] != "Accept-Encoding" {
+			t.Errorf("unexpected Vary: want %q, got %q", "Accept-Encoding", resp.Headers["Vary"])
+		}
+
+		data, err := base64.StdEncoding.DecodeString(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressed, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decompressed) != body {
+			t.Errorf("unexpected body: want %q, got %q", body, string(decompressed))
+		}
+	})
+
+	t.Run("not accepted", func(t *testing.T) {
+		l := newOptions([]Option{WithResponseCompression()}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.IsBase64Encoded {
+			t.Error("unexpected IsBase64Encoded: want false, got true")
+		}
+		if v, ok := resp.Headers["Content-Encoding"]; ok {
+			t.Errorf("unexpected Content-Encoding: %q", v)
+		}
+		if resp.Body != body {
+			t.Errorf("unexpected body: want %q, got %q", body, resp.Body)
+		}
+	})
+
+	t.Run("small body", func(t *testing.T) {
+		l := newOptions([]Option{WithResponseCompression()}).newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if _, err := io.WriteString(w, `{"hello":"world"}`); err != nil {
+				t.Error(err)
+			}
+		}))
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Headers["accept-encoding"] = "gzip"
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, ok := resp.Headers["Content-Encoding"]; ok {
+			t.Errorf("unexpected Content-Encoding: %q", v)
+		}
+		if resp.Body != `{"hello":"world"}` {
+			t.Errorf("unexpected body: want %q, got %q", `{"hello":"world"}`, resp.Body)
+		}
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		data := bytes.Repeat([]byte{0x00, 0xff}, 1024)
+		l := newOptions([]Option{WithResponseCompression()}).newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			if _, err := w.Write(data); err != nil {
+				t.Error(err)
+			}
+		}))
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Headers["accept-encoding"] = "gzip"
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, ok := resp.Headers["Content-Encoding"]; ok {
+			t.Errorf("unexpected Content-Encoding: %q", v)
+		}
+		if resp.Body != base64.StdEncoding.EncodeToString(data) {
+			t.Errorf("unexpected body: %q", resp.Body)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		l := newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Headers["accept-encoding"] = "gzip"
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, ok := resp.Headers["Content-Encoding"]; ok {
+			t.Errorf("unexpected Content-Encoding: %q", v)
+		}
+		if resp.Body != body {
+			t.Errorf("unexpected body: want %q, got %q", body, resp.Body)
+		}
+	})
+}
+
+func TestWithResponseCompression_Head(t *testing.T) {
+	body := strings.Repeat(`{"hello":"world"}`, 100)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := io.WriteString(w, body); err != nil {
+			t.Error(err)
+		}
+	})
+	l := newOptions([]Option{WithResponseCompression()}).newLambdaFunction(h)
+
+	serve := func(method string) *response {
+		t.Helper()
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RequestContext.HTTP.Method = method
+		req.Headers["accept-encoding"] = "gzip"
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	get := serve(http.MethodGet)
+	head := serve(http.MethodHead)
+
+	if head.Body != "" {
+		t.Errorf("unexpected body: want empty, got %q", head.Body)
+	}
+	for _, name := range []string{"Content-Encoding", "Vary", "Content-Type", "Content-Length"} {
+		if head.Headers[name] != get.Headers[name] {
+			t.Errorf("unexpected %s: want %q, got %q", name, get.Headers[name], head.Headers[name])
+		}
+	}
+	if head.Headers["Content-Encoding"] != "gzip" {
+		t.Errorf("unexpected Content-Encoding: want %q, got %q", "gzip", head.Headers["Content-Encoding"])
+	}
+	if _, ok := head.Headers["Content-Length"]; ok {
+		t.Errorf("unexpected Content-Length: %q", head.Headers["Content-Length"])
+	}
+}
+
+func TestWithResponseEncoder(t *testing.T) {
+	body := strings.Repeat(`{"hello":"world"}`, 100)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := io.WriteString(w, body); err != nil {
+			t.Error(err)
+		}
+	})
+	l := newOptions([]Option{
+		WithResponseCompression(),
+		WithResponseEncoder("deflate", func(w io.Writer) io.WriteCloser {
+			return zlib.NewWriter(w)
+		}),
+	}).newLambdaFunction(h)
+
+	tests := []struct {
+		acceptEncoding  string
+		contentEncoding string
+	}{
+		{"gzip, deflate", "deflate"},
+		{"deflate;q=0.5, gzip", "gzip"},
+		{"gzip", "gzip"},
+		{"identity", ""},
+	}
+	for _, tt := range tests {
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Headers["accept-encoding"] = tt.acceptEncoding
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Headers["Content-Encoding"]; got != tt.contentEncoding {
+			t.Errorf("%s: unexpected Content-Encoding: want %q, got %q", tt.acceptEncoding, tt.contentEncoding, got)
+			continue
+		}
+
+		var data []byte
+		if resp.IsBase64Encoded {
+			data, err = base64.StdEncoding.DecodeString(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			data = []byte(resp.Body)
+		}
+		var zr io.Reader
+		switch tt.contentEncoding {
+		case "deflate":
+			zr, err = zlib.NewReader(bytes.NewReader(data))
+		case "gzip":
+			zr, err = gzip.NewReader(bytes.NewReader(data))
+		default:
+			zr = bytes.NewReader(data)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressed, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decompressed) != body {
+			t.Errorf("%s: unexpected body: want %q, got %q", tt.acceptEncoding, body, string(decompressed))
+		}
+	}
+}
+
+func TestWithResponseEncoder_Brotli(t *testing.T) {
+	body := strings.Repeat(`{"hello":"world"}`, 100)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := io.WriteString(w, body); err != nil {
+			t.Error(err)
+		}
+	})
+	// the raw DEFLATE format stands in for Brotli,
+	// because the standard library has no Brotli encoder.
+	l := newOptions([]Option{
+		WithResponseCompression(),
+		WithResponseEncoder("BR", func(w io.Writer) io.WriteCloser {
+			zw, err := flate.NewWriter(w, flate.DefaultCompression)
+			if err != nil {
+				panic(err)
+			}
+			return zw
+		}),
+	}).newLambdaFunction(h)
+
+	tests := []struct {
+		acceptEncoding  string
+		contentEncoding string
+	}{
+		{"gzip, deflate, br", "br"},
+		{"br", "br"},
+		{"Br;q=1.0", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"gzip", "gzip"},
+		{"deflate", ""},
+		{"identity", ""},
+	}
+	for _, tt := range tests {
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Headers["accept-encoding"] = tt.acceptEncoding
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Headers["Content-Encoding"]; got != tt.contentEncoding {
+			t.Errorf("%s: unexpected Content-Encoding: want %q, got %q", tt.acceptEncoding, tt.contentEncoding, got)
+			continue
+		}
+		if got := resp.Headers["Vary"]; got != "Accept-Encoding" {
+			t.Errorf("%s: unexpected Vary: want %q, got %q", tt.acceptEncoding, "Accept-Encoding", got)
+		}
+
+		var data []byte
+		if resp.IsBase64Encoded {
+			data, err = base64.StdEncoding.DecodeString(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			data = []byte(resp.Body)
+		}
+		var zr io.Reader
+		switch tt.contentEncoding {
+		case "br":
+			zr = flate.NewReader(bytes.NewReader(data))
+		case "gzip":
+			zr, err = gzip.NewReader(bytes.NewReader(data))
+		default:
+			zr = bytes.NewReader(data)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressed, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decompressed) != body {
+			t.Errorf("%s: unexpected body: want %q, got %q", tt.acceptEncoding, body, string(decompressed))
+		}
+	}
+}
+
+func TestWithRequestDecompression(t *testing.T) {
+	const body = `{"hello":"world"}`
+	compress := func(t *testing.T, encoding string) string {
+		t.Helper()
+		var buf bytes.Buffer
+		var zw io.WriteCloser
+		switch encoding {
+		case "gzip":
+			zw = gzip.NewWriter(&buf)
+		case "deflate":
+			zw = zlib.NewWriter(&buf)
+		default:
+			t.Fatalf("unknown encoding: %s", encoding)
+		}
+		if _, err := io.WriteString(zw, body); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%s %q %q %d %s", r.Method, r.Header.Get("Content-Encoding"), r.Header.Get("Content-Length"), r.ContentLength, data)
+	})
+	setBody := func(req *request, encoding, body string) {
+		req.Body = body
+		req.IsBase64Encoded = true
+		req.Headers["content-encoding"] = encoding
+		if req.MultiValueHeaders != nil {
+			req.MultiValueHeaders["content-encoding"] = []string{encoding}
+		}
+	}
+
+	t.Run("gzip", func(t *testing.T) {
+		l := newOptions([]Option{WithRequestDecompression()}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-v2-post-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		setBody(req, "gzip", compress(t, "gzip"))
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `POST "" "" -1 ` + body
+		if resp.Body != want {
+			t.Errorf("unexpected body: want %q, got %q", want, resp.Body)
+		}
+	})
+
+	t.Run("deflate", func(t *testing.T) {
+		l := newOptions([]Option{WithRequestDecompression()}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-post-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		setBody(req, "deflate", compress(t, "deflate"))
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `POST "" "" -1 ` + body
+		if resp.Body != want {
+			t.Errorf("unexpected body: want %q, got %q", want, resp.Body)
+		}
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		l := newOptions([]Option{WithRequestDecompression()}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/websocket-connect-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		setBody(req, "gzip", compress(t, "gzip"))
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `POST "" "" -1 ` + body
+		if resp.Body != want {
+			t.Errorf("unexpected body: want %q, got %q", want, resp.Body)
+		}
+	})
+
+	t.Run("unsupported encoding", func(t *testing.T) {
+		l := newOptions([]Option{WithRequestDecompression()}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-v2-post-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		setBody(req, "br", base64.StdEncoding.EncodeToString([]byte(body)))
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `POST "br" "17" 17 ` + body
+		if resp.Body != want {
+			t.Errorf("unexpected body: want %q, got %q", want, resp.Body)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		l := newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-v2-post-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed := compress(t, "gzip")
+		setBody(req, "gzip", compressed)
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(resp.Body, `POST "gzip"`) {
+			t.Errorf("unexpected body: want the compressed body, got %q", resp.Body)
+		}
+	})
+
+	t.Run("invalid body", func(t *testing.T) {
+		l := newOptions([]Option{WithRequestDecompression(), WithBadRequestResponse()}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-v2-post-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		setBody(req, "gzip", base64.StdEncoding.EncodeToString([]byte(body)))
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		l := newOptions([]Option{WithRequestDecompression(), WithMaxRequestBodySize(1024)}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-v2-post-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the compressed body is within the limit, but the decompressed one exceeds it.
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := io.WriteString(zw, strings.Repeat("a", 1<<20)); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		setBody(req, "gzip", base64.StdEncoding.EncodeToString(buf.Bytes()))
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,144 @@
+package ridgenative
+
+import "context"
+
+// contextKey is a value for use with context.WithValue.
+// It's used as a pointer so it fits in an interface{} without allocation.
+type contextKey struct {
+	name string
+}
+
+func (k *contextKey) String() string {
+	return "ridgenative context value " + k.name
+}
+
+// requestContextKey is a context key for the requestContext field of the event.
+// The associated value will be of type *ProxyRequestContext.
+var requestContextKey = &contextKey{"request-context"}
+
+// lambdaContextKey is a context key for the metadata of the invoke.
+// The associated value will be of type *InvokeContext.
+var lambdaContextKey = &contextKey{"lambda-context"}
+
+// stageVariablesContextKey is a context key for the stageVariables field of the event.
+// The associated value will be of type map[string]string.
+var stageVariablesContextKey = &contextKey{"stage-variables"}
+
+// pathParametersContextKey is a context key for the pathParameters field of the event.
+// The associated value will be of type map[string]string.
+var pathParametersContextKey = &contextKey{"path-parameters"}
+
+// authorizerContextKey is a context key for the context of custom Lambda authorizers.
+// The associated value will be of type map[string]interface{}.
+var authorizerContextKey = &contextKey{"authorizer"}
+
+// CognitoIdentity is the cognito identity used by the calling application.
+// It is compatible with lambdacontext.CognitoIdentity of aws-lambda-go.
+type CognitoIdentity struct {
+	CognitoIdentityID     string
+	CognitoIdentityPoolID string
+}
+
+// ClientApplication is metadata about the calling application.
+// It is compatible with lambdacontext.ClientApplication of aws-lambda-go.
+type ClientApplication struct {
+	InstallationID string `json:"installation_id"`
+	AppTitle       string `json:"app_title"`
+	AppVersionCode string `json:"app_version_code"`
+	AppPackageName string `json:"app_package_name"`
+}
+
+// ClientContext is information about the client application passed by the calling application.
+// It is compatible with lambdacontext.ClientContext of aws-lambda-go.
+type ClientContext struct {
+	Client ClientApplication
+	Env    map[string]string `json:"env"`
+	Custom map[string]string `json:"custom"`
+}
+
+// InvokeContext is the set of metadata that is passed for every invoke.
+// It is compatible with lambdacontext.LambdaContext of aws-lambda-go.
+type InvokeContext struct {
+	AwsRequestID       string
+	InvokedFunctionArn string
+	Identity           CognitoIdentity
+	ClientContext      ClientContext
+}
+
+// RequestContext returns the requestContext field of the event that the request came from.
+// For API Gateway v2 events and Lambda Function URLs, the HTTP field is also populated.
+func RequestContext(ctx context.Context) (*ProxyRequestContext, bool) {
+	rc, ok := ctx.Value(requestContextKey).(*ProxyRequestContext)
+	return rc, ok
+}
+
+// RequestID returns the AWS request id of the invoke that is being handled.
+// It is the value of the Lambda-Runtime-Aws-Request-Id header of the runtime API.
+func RequestID(ctx context.Context) (string, bool) {
+	lc, ok := LambdaContext(ctx)
+	if !ok {
+		return "", false
+	}
+	return lc.AwsRequestID, true
+}
+
+// InvokedFunctionARN returns the ARN of the function, version, or alias that is specified in the invoke.
+// It is the value of the Lambda-Runtime-Invoked-Function-Arn header of the runtime API.
+func InvokedFunctionARN(ctx context.Context) (string, bool) {
+	lc, ok := LambdaContext(ctx)
+	if !ok {
+		return "", false
+	}
+	return lc.InvokedFunctionArn, true
+}
+
+// LambdaContext returns the metadata of the invoke that is being handled.
+// It works like lambdacontext.FromContext of aws-lambda-go.
+func LambdaContext(ctx context.Context) (*InvokeContext, bool) {
+	lc, ok := ctx.Value(lambdaContextKey).(*InvokeContext)
+	return lc, ok
+}
+
+// StageVariables returns the stage variables of API Gateway REST APIs.
+// It returns nil for the other events, such as API Gateway v2 events and ALB events.
+func StageVariables(ctx context.Context) map[string]string {
+	v, _ := ctx.Value(stageVariablesContextKey).(map[string]string)
+	return v
+}
+
+// PathParameters returns the path parameters of API Gateway REST APIs, such as {proxy+}.
+// It returns nil for the other events, such as API Gateway v2 events and ALB events.
+func PathParameters(ctx context.Context) map[string]string {
+	v, _ := ctx.Value(pathParametersContextKey).(map[string]string)
+	return v
+}
+
+// AuthorizerContext returns the context of the custom Lambda authorizer, such as the tenant id.
+// For API Gateway REST APIs, it is requestContext.authorizer, which also includes principalId.
+// For API Gateway HTTP APIs, it is requestContext.authorizer.lambda.
+// It returns nil if the request is not authorized by a Lambda authorizer,
+// such as the requests authorized by Amazon Cognito user pool authorizers.
+func AuthorizerContext(ctx context.Context) map[string]interface{} {
+	v, _ := ctx.Value(authorizerContextKey).(map[string]interface{})
+	return v
+}
+
+// JWTAuthorizer returns the result of the JWT authorizer of API Gateway HTTP APIs.
+// It returns false if the request is not authorized by a JWT authorizer.
+func JWTAuthorizer(ctx context.Context) (*ProxyRequestContextJWT, bool) {
+	rc, ok := RequestContext(ctx)
+	if !ok || rc.JWT == nil {
+		return nil, false
+	}
+	return rc.JWT, true
+}
+
+// JWTClaims returns the claims of the JWT authorizer of API Gateway HTTP APIs.
+// It returns false if the request is not authorized by a JWT authorizer.
+func JWTClaims(ctx context.Context) (map[string]string, bool) {
+	jwt, ok := JWTAuthorizer(ctx)
+	if !ok {
+		return nil, false
+	}
+	return jwt.Claims, true
+}
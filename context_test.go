@@ -0,0 +1,392 @@
+package ridgenative
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRequestContext(t *testing.T) {
+	t.Run("api gateway v1", func(t *testing.T) {
+		var called bool
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			rc, ok := RequestContext(r.Context())
+			if !ok {
+				t.Fatal("request context not found")
+			}
+			if rc.RequestID != "b42dfa11-fcf1-11e8-b9d0-b9272ebf40e8" {
+				t.Errorf("unexpected request id: want %q, got %q", "b42dfa11-fcf1-11e8-b9d0-b9272ebf40e8", rc.RequestID)
+			}
+			claims, ok := rc.Authorizer["claims"].(map[string]interface{})
+			if !ok {
+				t.Fatalf("unexpected claims: %#v", rc.Authorizer["claims"])
+			}
+			if claims["sub"] != "user-sub" {
+				t.Errorf("unexpected sub: want %q, got %q", "user-sub", claims["sub"])
+			}
+		}))
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RequestContext.Authorizer = map[string]interface{}{
+			"claims": map[string]interface{}{
+				"sub": "user-sub",
+			},
+		}
+		if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if !called {
+			t.Error("the handler is not called")
+		}
+	})
+
+	t.Run("api gateway v2", func(t *testing.T) {
+		var called bool
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			rc, ok := RequestContext(r.Context())
+			if !ok {
+				t.Fatal("request context not found")
+			}
+			if rc.HTTP == nil {
+				t.Fatal("want HTTP field, got nil")
+			}
+			if rc.HTTP.Method != http.MethodGet {
+				t.Errorf("unexpected method: want %q, got %q", http.MethodGet, rc.HTTP.Method)
+			}
+			if rc.HTTP.SourceIP != "192.0.2.1" {
+				t.Errorf("unexpected source ip: want %q, got %q", "192.0.2.1", rc.HTTP.SourceIP)
+			}
+		}))
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if !called {
+			t.Error("the handler is not called")
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		if _, ok := RequestContext(context.Background()); ok {
+			t.Error("want not found, but found")
+		}
+	})
+}
+
+func TestStageVariables(t *testing.T) {
+	t.Run("api gateway v1", func(t *testing.T) {
+		var called bool
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			v := StageVariables(r.Context())
+			if v["backend"] != "https://backend.example.com" {
+				t.Errorf("unexpected stage variable: want %q, got %q", "https://backend.example.com", v["backend"])
+			}
+		}))
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.StageVariables = map[string]string{
+			"backend": "https://backend.example.com",
+		}
+		if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if !called {
+			t.Error("the handler is not called")
+		}
+	})
+
+	t.Run("api gateway v2", func(t *testing.T) {
+		var called bool
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			if v := StageVariables(r.Context()); v != nil {
+				t.Errorf("want nil, got %v", v)
+			}
+		}))
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if !called {
+			t.Error("the handler is not called")
+		}
+	})
+}
+
+func TestPathParameters(t *testing.T) {
+	t.Run("api gateway v1", func(t *testing.T) {
+		var called bool
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			v := PathParameters(r.Context())
+			if v["proxy"] != "foo%20/bar" {
+				t.Errorf("unexpected path parameter: want %q, got %q", "foo%20/bar", v["proxy"])
+			}
+		}))
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if !called {
+			t.Error("the handler is not called")
+		}
+	})
+
+	t.Run("alb", func(t *testing.T) {
+		var called bool
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			if v := PathParameters(r.Context()); v != nil {
+				t.Errorf("want nil, got %v", v)
+			}
+		}))
+		req, err := loadRequest("testdata/alb-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if !called {
+			t.Error("the handler is not called")
+		}
+	})
+}
+
+func TestAuthorizerContext(t *testing.T) {
+	t.Run("api gateway v1", func(t *testing.T) {
+		var called bool
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			v := AuthorizerContext(r.Context())
+			if v["tenantId"] != "tenant-1" {
+				t.Errorf("unexpected tenant id: want %q, got %v", "tenant-1", v["tenantId"])
+			}
+			if v["principalId"] != "user-1" {
+				t.Errorf("unexpected principal id: want %q, got %v", "user-1", v["principalId"])
+			}
+			if _, ok := JWTAuthorizer(r.Context()); ok {
+				t.Error("want no JWT authorizer, but found")
+			}
+		}))
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(`{"principalId":"user-1","tenantId":"tenant-1","integrationLatency":0}`), &req.RequestContext.Authorizer); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if !called {
+			t.Error("the handler is not called")
+		}
+	})
+
+	t.Run("api gateway v1 cognito", func(t *testing.T) {
+		var called bool
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			if v := AuthorizerContext(r.Context()); v != nil {
+				t.Errorf("want nil, got %v", v)
+			}
+		}))
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(`{"claims":{"sub":"user-1","cognito:username":"user-1"}}`), &req.RequestContext.Authorizer); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if !called {
+			t.Error("the handler is not called")
+		}
+	})
+
+	t.Run("api gateway v1 cognito with scopes", func(t *testing.T) {
+		var called bool
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			if v := AuthorizerContext(r.Context()); v != nil {
+				t.Errorf("want nil, got %v", v)
+			}
+		}))
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(`{"claims":{"sub":"user-1"},"scopes":["email","openid"]}`), &req.RequestContext.Authorizer); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if !called {
+			t.Error("the handler is not called")
+		}
+	})
+
+	t.Run("api gateway v2 lambda", func(t *testing.T) {
+		var called bool
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			v := AuthorizerContext(r.Context())
+			if v["tenantId"] != "tenant-1" {
+				t.Errorf("unexpected tenant id: want %q, got %v", "tenant-1", v["tenantId"])
+			}
+			if _, ok := JWTAuthorizer(r.Context()); ok {
+				t.Error("want no JWT authorizer, but found")
+			}
+		}))
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(`{"lambda":{"tenantId":"tenant-1"}}`), &req.RequestContext.Authorizer); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if !called {
+			t.Error("the handler is not called")
+		}
+	})
+
+	t.Run("api gateway v2 jwt", func(t *testing.T) {
+		var called bool
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			if v := AuthorizerContext(r.Context()); v != nil {
+				t.Errorf("want nil, got %v", v)
+			}
+			jwt, ok := JWTAuthorizer(r.Context())
+			if !ok {
+				t.Fatal("JWT authorizer not found")
+			}
+			want := &ProxyRequestContextJWT{
+				Claims: map[string]string{"sub": "user-1", "iat": "1516239022"},
+				Scopes: []string{"read", "write"},
+			}
+			if !reflect.DeepEqual(jwt, want) {
+				t.Errorf("unexpected JWT authorizer: want %#v, got %#v", want, jwt)
+			}
+		}))
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := `{"jwt":{"claims":{"sub":"user-1","iat":1516239022},"scopes":["read","write"]}}`
+		if err := json.Unmarshal([]byte(data), &req.RequestContext.Authorizer); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if !called {
+			t.Error("the handler is not called")
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		if v := AuthorizerContext(context.Background()); v != nil {
+			t.Errorf("want nil, got %v", v)
+		}
+		if _, ok := JWTAuthorizer(context.Background()); ok {
+			t.Error("want not found, but found")
+		}
+	})
+}
+
+func TestJWTClaims(t *testing.T) {
+	t.Run("api gateway v2", func(t *testing.T) {
+		var called bool
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			claims, ok := JWTClaims(r.Context())
+			if !ok {
+				t.Fatal("JWT claims not found")
+			}
+			if claims["sub"] != "user-1" {
+				t.Errorf("unexpected sub: want %q, got %q", "user-1", claims["sub"])
+			}
+			rc, ok := RequestContext(r.Context())
+			if !ok {
+				t.Fatal("request context not found")
+			}
+			if rc.JWT == nil || !reflect.DeepEqual(rc.JWT.Scopes, []string{"read"}) {
+				t.Errorf("unexpected JWT: %#v", rc.JWT)
+			}
+		}))
+		req, err := loadRequest("testdata/apigateway-v2-jwt-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if !called {
+			t.Error("the handler is not called")
+		}
+	})
+
+	t.Run("api gateway v1", func(t *testing.T) {
+		var called bool
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			if _, ok := JWTClaims(r.Context()); ok {
+				t.Error("want not found, but found")
+			}
+		}))
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if !called {
+			t.Error("the handler is not called")
+		}
+	})
+}
+
+func TestRequestID(t *testing.T) {
+	if _, ok := RequestID(context.Background()); ok {
+		t.Error("want not found, but found")
+	}
+}
+
+func TestInvokedFunctionARN(t *testing.T) {
+	if _, ok := InvokedFunctionARN(context.Background()); ok {
+		t.Error("want not found, but found")
+	}
+}
+
+func TestLambdaContext(t *testing.T) {
+	if _, ok := LambdaContext(context.Background()); ok {
+		t.Error("want not found, but found")
+	}
+}
@@ -0,0 +1,165 @@
+package ridgenative
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// NewV1Event converts r into an event of API Gateway REST APIs, the payload format version 1.0.
+// It reads the body of r, and encodes it in base64 if it is binary.
+// It is useful for testing the handler with Invoke.
+func NewV1Event(r *http.Request) ([]byte, error) {
+	body, isBase64, err := encodeEventBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string]string, len(r.Header)+1)
+	multiValueHeaders := make(map[string][]string, len(r.Header)+1)
+	for key, values := range eventHeaders(r) {
+		if len(values) == 0 {
+			continue
+		}
+		headers[key] = values[len(values)-1]
+		multiValueHeaders[key] = values
+	}
+
+	var query map[string]string
+	var multiValueQuery map[string][]string
+	if values := r.URL.Query(); len(values) > 0 {
+		query = make(map[string]string, len(values))
+		multiValueQuery = make(map[string][]string, len(values))
+		for key, value := range values {
+			query[key] = value[len(value)-1]
+			multiValueQuery[key] = value
+		}
+	}
+
+	req := &request{
+		HTTPMethod:                      r.Method,
+		Path:                            r.URL.EscapedPath(),
+		QueryStringParameters:           query,
+		MultiValueQueryStringParameters: multiValueQuery,
+		Headers:                         headers,
+		MultiValueHeaders:               multiValueHeaders,
+		IsBase64Encoded:                 isBase64,
+		Body:                            body,
+		RequestContext: ProxyRequestContext{
+			HTTPMethod: r.Method,
+			DomainName: r.Host,
+			Identity: ProxyRequestIdentity{
+				SourceIP:  eventSourceIP(r),
+				UserAgent: r.UserAgent(),
+			},
+		},
+	}
+	return json.Marshal(req)
+}
+
+// NewV2Event converts r into an event of API Gateway HTTP APIs and Lambda Function URLs, the payload format version 2.0.
+// It reads the body of r, and encodes it in base64 if it is binary.
+// The Cookie headers are split into the cookies field.
+// It is useful for testing the handler with Invoke.
+func NewV2Event(r *http.Request) ([]byte, error) {
+	body, isBase64, err := encodeEventBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var cookies []string
+	headers := make(map[string]string, len(r.Header)+1)
+	for key, values := range eventHeaders(r) {
+		if key == "Cookie" {
+			for _, value := range values {
+				for _, cookie := range strings.Split(value, ";") {
+					if cookie = strings.TrimSpace(cookie); cookie != "" {
+						cookies = append(cookies, cookie)
+					}
+				}
+			}
+			continue
+		}
+		headers[strings.ToLower(key)] = strings.Join(values, ",")
+	}
+
+	var query map[string]string
+	if values := r.URL.Query(); len(values) > 0 {
+		query = make(map[string]string, len(values))
+		for key, value := range values {
+			query[key] = strings.Join(value, ",")
+		}
+	}
+
+	proto := r.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	req := &request{
+		Version:               "2.0",
+		RawPath:               r.URL.EscapedPath(),
+		RawQueryString:        r.URL.RawQuery,
+		Cookies:               cookies,
+		QueryStringParameters: query,
+		Headers:               headers,
+		IsBase64Encoded:       isBase64,
+		Body:                  body,
+		RequestContext: ProxyRequestContext{
+			DomainName: r.Host,
+			HTTP: &ProxyRequestContextHTTP{
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Protocol:  proto,
+				SourceIP:  eventSourceIP(r),
+				UserAgent: r.UserAgent(),
+			},
+		},
+	}
+	return json.Marshal(req)
+}
+
+// eventHeaders returns the headers of r including Host and X-Forwarded-Proto.
+func eventHeaders(r *http.Request) http.Header {
+	headers := r.Header.Clone()
+	if headers == nil {
+		headers = make(http.Header, 2)
+	}
+	if r.Host != "" && headers.Get("Host") == "" {
+		headers.Set("Host", r.Host)
+	}
+	if r.URL.Scheme != "" && headers.Get("X-Forwarded-Proto") == "" {
+		headers.Set("X-Forwarded-Proto", r.URL.Scheme)
+	}
+	return headers
+}
+
+// encodeEventBody reads the body of r, and encodes it in base64 if it is binary.
+func encodeEventBody(r *http.Request) (body string, isBase64 bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return "", false, nil
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", false, err
+	}
+	if err := r.Body.Close(); err != nil {
+		return "", false, err
+	}
+	if isBinaryContentType(r.Header.Get("Content-Type")) || !utf8.Valid(data) {
+		return base64.StdEncoding.EncodeToString(data), true, nil
+	}
+	return string(data), false, nil
+}
+
+// eventSourceIP returns the IP address of the client of r.
+func eventSourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,143 @@
+package ridgenative
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNewEvent(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cookie, err := r.Cookie("session")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, strings.Join([]string{
+			r.Method,
+			r.Host,
+			r.URL.RequestURI(),
+			r.FormValue("name"),
+			r.FormValue("q"),
+			cookie.Value,
+		}, " "))
+	})
+
+	newEvents := []struct {
+		name     string
+		newEvent func(r *http.Request) ([]byte, error)
+	}{
+		{"v1", NewV1Event},
+		{"v2", NewV2Event},
+	}
+
+	for _, ne := range newEvents {
+		ne := ne
+		t.Run(ne.name+" form", func(t *testing.T) {
+			form := url.Values{"name": {"gopher"}}
+			r, err := http.NewRequest(http.MethodPost, "https://example.com/foo?q=bar", strings.NewReader(form.Encode()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+			r.AddCookie(&http.Cookie{Name: "other", Value: "xyz"})
+			payload, err := ne.newEvent(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := Invoke(context.Background(), h, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resp response
+			if err := json.Unmarshal(data, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Body != "POST example.com /foo?q=bar gopher bar abc" {
+				t.Errorf("unexpected body: want %q, got %q", "POST example.com /foo?q=bar gopher bar abc", resp.Body)
+			}
+		})
+
+		t.Run(ne.name+" multipart", func(t *testing.T) {
+			var buf bytes.Buffer
+			mw := multipart.NewWriter(&buf)
+			if err := mw.WriteField("name", "gopher"); err != nil {
+				t.Fatal(err)
+			}
+			fw, err := mw.CreateFormFile("file", "binary.dat")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fw.Write([]byte{0x00, 0xff, 0xfe}); err != nil {
+				t.Fatal(err)
+			}
+			if err := mw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			r, err := http.NewRequest(http.MethodPost, "https://example.com/upload?q=bar", &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("Content-Type", mw.FormDataContentType())
+			r.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+			payload, err := ne.newEvent(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var event request
+			if err := json.Unmarshal(payload, &event); err != nil {
+				t.Fatal(err)
+			}
+			if !event.IsBase64Encoded {
+				t.Error("want base64 encoded body, but not")
+			}
+
+			data, err := Invoke(context.Background(), h, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resp response
+			if err := json.Unmarshal(data, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Body != "POST example.com /upload?q=bar gopher bar abc" {
+				t.Errorf("unexpected body: want %q, got %q", "POST example.com /upload?q=bar gopher bar abc", resp.Body)
+			}
+		})
+	}
+
+	t.Run("v2 cookies", func(t *testing.T) {
+		r, err := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Cookie", "a=1; b=2")
+		payload, err := NewV2Event(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var event request
+		if err := json.Unmarshal(payload, &event); err != nil {
+			t.Fatal(err)
+		}
+		if len(event.Cookies) != 2 || event.Cookies[0] != "a=1" || event.Cookies[1] != "b=2" {
+			t.Errorf("unexpected cookies: want %v, got %v", []string{"a=1", "b=2"}, event.Cookies)
+		}
+		if _, ok := event.Headers["cookie"]; ok {
+			t.Error("the cookie header must be moved into the cookies field")
+		}
+	})
+}
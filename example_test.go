@@ -1,8 +1,10 @@
 package ridgenative_test
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"time"
 
@@ -32,3 +34,56 @@ func ExampleListenAndServe() {
 	// Output:
 	// Hello World
 }
+
+func ExampleInvoke() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, "Hello World")
+	})
+
+	event := `{"version":"2.0","rawPath":"/hello","requestContext":{"http":{"method":"GET","path":"/hello"}}}`
+	resp, err := ridgenative.Invoke(context.Background(), mux, []byte(event))
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(resp))
+
+	// Output:
+	// {"statusCode":200,"headers":{"Content-Type":"text/plain"},"body":"Hello World\n"}
+}
+
+func ExampleChain() {
+	logging := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Println("request:", r.Method, r.URL.Path)
+			next.ServeHTTP(w, r)
+		})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, "Hello World")
+	})
+
+	event := `{"version":"2.0","rawPath":"/hello","requestContext":{"http":{"method":"GET","path":"/hello"}}}`
+	resp, err := ridgenative.Invoke(context.Background(), ridgenative.Chain(mux, logging), []byte(event))
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(resp))
+
+	// Output:
+	// request: GET /hello
+	// {"statusCode":200,"headers":{"Content-Type":"text/plain"},"body":"Hello World\n"}
+}
+
+func ExampleStartFunc() {
+	err := ridgenative.StartFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, "Hello World")
+	}, ridgenative.WithInvokeMode(ridgenative.InvokeModeBuffered))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
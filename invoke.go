@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"os"
 )
 
 type invoke struct {
@@ -13,6 +14,27 @@ type invoke struct {
 	headers http.Header
 }
 
+// Invoke invokes the handler with the payload of an event, and returns the payload of the response.
+// The event is handled in the same way as the events from the runtime API,
+// so it is useful for testing the handler without the runtime API.
+// Both API Gateway v1 (and ALB) events and API Gateway v2 (and Lambda Function URLs) events are accepted.
+// The handler is typically nil, in which case the DefaultServeMux is used.
+func Invoke(ctx context.Context, mux http.Handler, payload []byte, opts ...Option) ([]byte, error) {
+	f := newOptions(opts).newLambdaFunction(mux)
+	return callBytesHandlerFunc(ctx, payload, f.lambdaHandler)
+}
+
+// ServeEventFile reads an event from the JSON file, invokes the handler with it, and returns the payload of the response.
+// It is useful for debugging the handler with the events captured in production.
+// See Invoke for details.
+func ServeEventFile(mux http.Handler, path string, opts ...Option) ([]byte, error) {
+	payload, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Invoke(context.Background(), mux, payload, opts...)
+}
+
 func callBytesHandlerFunc(ctx context.Context, payload []byte, h handlerFunc) (response []byte, err error) {
 	defer func() {
 		if v := recover(); v != nil {
@@ -24,10 +46,13 @@ func callBytesHandlerFunc(ctx context.Context, payload []byte, h handlerFunc) (r
 	if err := json.Unmarshal(payload, &req); err != nil {
 		return nil, err
 	}
+	stats := invokeStatsFromContext(ctx)
+	stats.setRequestBytes(eventBodyLen(req))
 	resp, err := h(ctx, req)
 	if err != nil {
 		return nil, err
 	}
+	stats.setResponse(resp.StatusCode, responseBodyLen(resp))
 	return json.Marshal(resp)
 }
 
@@ -42,6 +67,7 @@ func callHandlerFuncSteaming(ctx context.Context, payload []byte, h handlerFuncS
 	if err := json.Unmarshal(payload, &req); err != nil {
 		return nil, "", err
 	}
+	invokeStatsFromContext(ctx).setRequestBytes(eventBodyLen(req))
 
 	r, w := io.Pipe()
 	contentType, err = h(ctx, req, w)
@@ -0,0 +1,174 @@
+package ridgenative
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestInvoke(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		http.SetCookie(w, &http.Cookie{Name: "foo", Value: "bar"})
+		if _, err := io.WriteString(w, r.Method+" "+r.URL.Path); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("api gateway v1", func(t *testing.T) {
+		payload, err := os.ReadFile("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := Invoke(context.Background(), h, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp response
+		if err := json.Unmarshal(data, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if resp.Body != "GET /foo /bar" {
+			t.Errorf("unexpected body: want %q, got %q", "GET /foo /bar", resp.Body)
+		}
+		if got, want := resp.MultiValueHeaders["Set-Cookie"], []string{"foo=bar"}; len(got) != 1 || got[0] != want[0] {
+			t.Errorf("unexpected Set-Cookie: want %v, got %v", want, got)
+		}
+		if len(resp.Cookies) != 0 {
+			t.Errorf("unexpected cookies: %v", resp.Cookies)
+		}
+	})
+
+	t.Run("api gateway v2", func(t *testing.T) {
+		payload, err := os.ReadFile("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := Invoke(context.Background(), h, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp response
+		if err := json.Unmarshal(data, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if resp.Body != "GET /my/path" {
+			t.Errorf("unexpected body: want %q, got %q", "GET /my/path", resp.Body)
+		}
+		if got, want := resp.Cookies, []string{"foo=bar"}; len(got) != 1 || got[0] != want[0] {
+			t.Errorf("unexpected cookies: want %v, got %v", want, got)
+		}
+		if len(resp.MultiValueHeaders) != 0 {
+			t.Errorf("unexpected multi value headers: %v", resp.MultiValueHeaders)
+		}
+	})
+
+	t.Run("invalid payload", func(t *testing.T) {
+		_, err := Invoke(context.Background(), h, []byte(`{`))
+		if err == nil {
+			t.Error("want error, got nil")
+		}
+	})
+}
+
+func TestServeEventFile(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if _, err := io.WriteString(w, r.Method+" "+r.URL.Path+" "+string(body)); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("found", func(t *testing.T) {
+		data, err := ServeEventFile(h, "testdata/apigateway-v2-post-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp response
+		if err := json.Unmarshal(data, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if want := `POST /my/path {"hello":"world"}`; resp.Body != want {
+			t.Errorf("unexpected body: want %q, got %q", want, resp.Body)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		if _, err := ServeEventFile(h, "testdata/not-found.json"); !os.IsNotExist(err) {
+			t.Errorf("want not exist error, got %v", err)
+		}
+	})
+}
+
+func TestInvoke_ResponseKeys(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, "hello")
+	})
+	tests := []struct {
+		path   string
+		want   []string
+		unwant []string
+	}{
+		{
+			path:   "testdata/apigateway-get-request.json",
+			want:   []string{"statusCode", "headers", "multiValueHeaders", "body"},
+			unwant: []string{"statusDescription", "cookies"},
+		},
+		{
+			path:   "testdata/alb-get-request.json",
+			want:   []string{"statusCode", "statusDescription", "multiValueHeaders", "body"},
+			unwant: []string{"headers", "cookies"},
+		},
+		{
+			path:   "testdata/alb-single-value-headers-request.json",
+			want:   []string{"statusCode", "statusDescription", "headers", "body"},
+			unwant: []string{"multiValueHeaders", "cookies"},
+		},
+		{
+			path:   "testdata/apigateway-v2-get-request.json",
+			want:   []string{"statusCode", "headers", "body"},
+			unwant: []string{"statusDescription", "multiValueHeaders"},
+		},
+	}
+	for _, tt := range tests {
+		payload, err := os.ReadFile(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := Invoke(context.Background(), h, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp map[string]json.RawMessage
+		if err := json.Unmarshal(data, &resp); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range tt.want {
+			if _, ok := resp[key]; !ok {
+				t.Errorf("%s: want %q in the response, got %s", tt.path, key, data)
+			}
+		}
+		for _, key := range tt.unwant {
+			if _, ok := resp[key]; ok {
+				t.Errorf("%s: unexpected %q in the response: %s", tt.path, key, data)
+			}
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package ridgenative
+
+import "net/http"
+
+// notFoundMux is a *http.ServeMux that serves the requests it doesn't match with notFound.
+type notFoundMux struct {
+	mux      *http.ServeMux
+	notFound http.Handler
+}
+
+func (m *notFoundMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, pattern := m.mux.Handler(r); pattern == "" {
+		// no pattern matches the request, the mux would respond with 404 Not Found.
+		m.notFound.ServeHTTP(w, r)
+		return
+	}
+	m.mux.ServeHTTP(w, r)
+}
+
+// handler returns the handler that serves the requests configured by the options.
+// If mux is nil, http.DefaultServeMux is used.
+func (o *options) handler(mux http.Handler) http.Handler {
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	if o.notFoundHandler != nil {
+		if sm, ok := mux.(*http.ServeMux); ok {
+			mux = &notFoundMux{mux: sm, notFound: o.notFoundHandler}
+		}
+	}
+	return mux
+}
@@ -0,0 +1,59 @@
+package ridgenative
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithNotFoundHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		// the 404 responses of the application are kept.
+		http.Error(w, "the resource is missing", http.StatusNotFound)
+	})
+	notFound := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = io.WriteString(w, "custom not found")
+	})
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/hello", http.StatusOK, "hello"},
+		{"/missing", http.StatusNotFound, "the resource is missing\n"},
+		{"/unknown", http.StatusNotFound, "custom not found"},
+	}
+
+	o := newOptions([]Option{WithNotFoundHandler(notFound)})
+	h := o.handler(mux)
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: unexpected status code: want %d, got %d", tt.path, tt.status, rec.Code)
+		}
+		if got := rec.Body.String(); got != tt.body {
+			t.Errorf("%s: unexpected body: want %q, got %q", tt.path, tt.body, got)
+		}
+	}
+}
+
+func TestWithNotFoundHandler_NotServeMux(t *testing.T) {
+	h := http.NotFoundHandler()
+	o := newOptions([]Option{WithNotFoundHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the not found handler must not be called")
+	}))})
+
+	rec := httptest.NewRecorder()
+	o.handler(h).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unexpected status code: want %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
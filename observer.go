@@ -0,0 +1,133 @@
+package ridgenative
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Observer observes the invokes of the function.
+// It is useful for bridging to metrics backends, such as Prometheus and StatsD.
+// The callbacks are called from the runtime loop, so they should return quickly.
+//
+// For each invoke, InvokeStarted is called first,
+// and then either InvokeFinished or InvokeError is called.
+type Observer interface {
+	// InvokeStarted is called when the function receives an invoke.
+	InvokeStarted()
+
+	// InvokeFinished is called when the response is sent to the runtime API.
+	// d is the duration from receiving the invoke, and statusCode is the HTTP status code of the response.
+	// requestBytes and responseBytes are the lengths of the request and response bodies.
+	// Both are measured without base64 encoding of the events and the responses.
+	// In the streaming mode, it is called after the whole body is sent.
+	InvokeFinished(d time.Duration, statusCode int, requestBytes, responseBytes int64)
+
+	// InvokeError is called when the invoke fails, for example, the handler panics.
+	InvokeError(err error)
+}
+
+// NopObserver is an Observer that does nothing.
+// Embed it in observers that implement only some of the callbacks.
+type NopObserver struct{}
+
+// InvokeStarted implements Observer.
+func (NopObserver) InvokeStarted() {}
+
+// InvokeFinished implements Observer.
+func (NopObserver) InvokeFinished(d time.Duration, statusCode int, requestBytes, responseBytes int64) {
+}
+
+// InvokeError implements Observer.
+func (NopObserver) InvokeError(err error) {}
+
+// invokeStatsContextKey is a context key for the statistics of the invoke.
+// The associated value will be of type *invokeStats.
+var invokeStatsContextKey = &contextKey{"invoke-stats"}
+
+// invokeStats is the statistics of an invoke reported to the Observer.
+// The handler records them, and the runtime API client reads them after the invoke.
+// All methods are safe to call on a nil *invokeStats, in which case they do nothing.
+type invokeStats struct {
+	mu            sync.Mutex
+	done          bool
+	statusCode    int
+	requestBytes  int64
+	responseBytes int64
+	err           error
+}
+
+// invokeStatsFromContext returns the statistics of the invoke associated with ctx, or nil.
+func invokeStatsFromContext(ctx context.Context) *invokeStats {
+	s, _ := ctx.Value(invokeStatsContextKey).(*invokeStats)
+	return s
+}
+
+// setRequestBytes records the length of the request body.
+func (s *invokeStats) setRequestBytes(n int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	s.requestBytes = n
+}
+
+// setResponse records the status code and the length of the body of the response.
+func (s *invokeStats) setResponse(code int, n int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	s.statusCode = code
+	s.responseBytes = n
+}
+
+// setError records the error occurred after the response is started, such as panics in the streaming mode.
+func (s *invokeStats) setError(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	s.err = err
+}
+
+// finish stops recording, and returns the recorded statistics.
+// The handler running in the background after the timeout doesn't change them anymore.
+func (s *invokeStats) finish() (statusCode int, requestBytes, responseBytes int64, err error) {
+	if s == nil {
+		return 0, 0, 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done = true
+	return s.statusCode, s.requestBytes, s.responseBytes, s.err
+}
+
+// eventBodyLen returns the length of the body of the event after decoding base64.
+func eventBodyLen(req *request) int64 {
+	if req.IsBase64Encoded {
+		return int64(base64DecodedLen(strings.TrimSpace(req.Body)))
+	}
+	return int64(len(req.Body))
+}
+
+// responseBodyLen returns the length of the body of the response before encoding base64.
+func responseBodyLen(resp *response) int64 {
+	if resp.IsBase64Encoded {
+		return int64(base64DecodedLen(resp.Body))
+	}
+	return int64(len(resp.Body))
+}
@@ -0,0 +1,177 @@
+package ridgenative
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *testObserver) record(event string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, event)
+}
+
+func (o *testObserver) InvokeStarted() {
+	o.record("started")
+}
+
+func (o *testObserver) InvokeFinished(d time.Duration, statusCode int, requestBytes, responseBytes int64) {
+	if d <= 0 {
+		o.record(fmt.Sprintf("invalid duration: %s", d))
+	}
+	o.record(fmt.Sprintf("finished: %d", statusCode))
+}
+
+func (o *testObserver) InvokeError(err error) {
+	var invokeErr *invokeResponseError
+	if errors.As(err, &invokeErr) {
+		o.record(fmt.Sprintf("error: %v", invokeErr.Message))
+		return
+	}
+	o.record(fmt.Sprintf("error: %v", err))
+}
+
+func TestWithObserver(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/created":
+			w.WriteHeader(http.StatusCreated)
+			_, _ = io.WriteString(w, "created")
+		case "/empty":
+			// 200 OK is sent implicitly.
+		case "/panic":
+			panic("something went wrong")
+		}
+	})
+	want := []string{
+		"started", "finished: 201",
+		"started", "finished: 200",
+		"started", "error: something went wrong",
+	}
+
+	t.Run("buffered", func(t *testing.T) {
+		newTestRuntimeAPI(
+			t,
+			`{"httpMethod":"GET","path":"/created"}`,
+			`{"httpMethod":"GET","path":"/empty"}`,
+			`{"httpMethod":"GET","path":"/panic"}`,
+		)
+		o := &testObserver{}
+		err := Start(h, InvokeModeBuffered, WithLogger(log.New(io.Discard, "", 0)), WithObserver(o))
+		if err == nil {
+			t.Fatal("want error, got nil")
+		}
+		if !reflect.DeepEqual(o.events, want) {
+			t.Errorf("unexpected events: want %v, got %v", want, o.events)
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		newTestRuntimeAPI(
+			t,
+			`{"version":"2.0","rawPath":"/created","requestContext":{"http":{"method":"GET","path":"/created"}}}`,
+			`{"version":"2.0","rawPath":"/empty","requestContext":{"http":{"method":"GET","path":"/empty"}}}`,
+			`{"version":"2.0","rawPath":"/panic","requestContext":{"http":{"method":"GET","path":"/panic"}}}`,
+		)
+		o := &testObserver{}
+		err := Start(h, InvokeModeResponseStream, WithLogger(log.New(io.Discard, "", 0)), WithObserver(o))
+		if err == nil {
+			t.Fatal("want error, got nil")
+		}
+		if !reflect.DeepEqual(o.events, want) {
+			t.Errorf("unexpected events: want %v, got %v", want, o.events)
+		}
+	})
+}
+
+func TestWithObserver_Timeout(t *testing.T) {
+	newTestRuntimeAPI(t, `{"httpMethod":"GET","path":"/"}`)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+	o := &testObserver{}
+	err := Start(h, InvokeModeBuffered, WithLogger(log.New(io.Discard, "", 0)), WithObserver(o), WithTimeoutResponse())
+	if err == nil {
+		t.Fatal("want error, got nil")
+	}
+	want := []string{"started", "finished: 504"}
+	if !reflect.DeepEqual(o.events, want) {
+		t.Errorf("unexpected events: want %v, got %v", want, o.events)
+	}
+}
+
+type sizeObserver struct {
+	NopObserver
+	requestBytes  int64
+	responseBytes int64
+}
+
+func (o *sizeObserver) InvokeFinished(d time.Duration, statusCode int, requestBytes, responseBytes int64) {
+	o.requestBytes = requestBytes
+	o.responseBytes = responseBytes
+}
+
+func TestWithObserver_Bytes(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(body)
+		_, _ = w.Write(body)
+	})
+
+	tests := []struct {
+		name  string
+		mode  InvokeMode
+		event string
+	}{
+		{
+			name:  "buffered",
+			mode:  InvokeModeBuffered,
+			event: `{"httpMethod":"POST","path":"/","body":"aGVsbG8gd29ybGQ=","isBase64Encoded":true}`,
+		},
+		{
+			name:  "buffered text",
+			mode:  InvokeModeBuffered,
+			event: `{"httpMethod":"POST","path":"/","body":"hello world"}`,
+		},
+		{
+			name:  "streaming",
+			mode:  InvokeModeResponseStream,
+			event: `{"version":"2.0","rawPath":"/","body":"aGVsbG8gd29ybGQ","isBase64Encoded":true,"requestContext":{"http":{"method":"POST","path":"/"}}}`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			newTestRuntimeAPI(t, tt.event)
+			o := &sizeObserver{}
+			err := Start(h, tt.mode, WithLogger(log.New(io.Discard, "", 0)), WithObserver(o))
+			if err == nil {
+				t.Fatal("want error, got nil")
+			}
+			if o.requestBytes != int64(len("hello world")) {
+				t.Errorf("unexpected request bytes: want %d, got %d", len("hello world"), o.requestBytes)
+			}
+			if o.responseBytes != int64(len("hello worldhello world")) {
+				t.Errorf("unexpected response bytes: want %d, got %d", len("hello worldhello world"), o.responseBytes)
+			}
+		})
+	}
+}
@@ -0,0 +1,504 @@
+package ridgenative
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Logger is the interface for logging the diagnostics of ridgenative.
+// *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Option configures the behavior of Start and ListenAndServe.
+type Option func(*options)
+
+type options struct {
+	mode        InvokeMode
+	logger      Logger
+	baseContext context.Context
+
+	// notFoundHandler serves the requests that the mux doesn't match.
+	notFoundHandler http.Handler
+
+	isBinaryType             func(contentType string) bool
+	compression              bool
+	responseEncoders         []responseEncoder
+	trustedProxyCount        int
+	recoverHandler           func(w http.ResponseWriter, r *http.Request, v any)
+	accessLog                io.Writer
+	badRequestResponse       bool
+	maxRequestBodySize       int64
+	healthCheckPath          string
+	disableMultiValueHeaders bool
+	detectJSON               bool
+	pathPrefix               string
+	stageStrip               bool
+	rawPath                  bool
+	base64Encoding           *base64.Encoding
+	alwaysBase64             bool
+	requestDecompression     bool
+	suppressSuperfluousLog   bool
+	streamingSniffLen        int
+	streamingContentLength   bool
+
+	maxPayloadSize  int64
+	httpClient      *http.Client
+	timeoutResponse bool
+	deadlineMargin  time.Duration
+	nextTimeout     time.Duration
+	userAgent       string
+	observer        Observer
+
+	initHooks     []func(ctx context.Context) error
+	shutdownHooks []func(ctx context.Context) error
+}
+
+// newLambdaFunction returns a new lambdaFunction configured by the options.
+func (o *options) newLambdaFunction(mux http.Handler) *lambdaFunction {
+	f := newLambdaFunction(o.handler(mux))
+	f.logger = o.logger
+	if o.isBinaryType != nil {
+		f.isBinaryType = o.isBinaryType
+	}
+	f.compression = o.compression
+	f.responseEncoders = o.responseEncoders
+	f.trustedProxyCount = o.trustedProxyCount
+	f.recoverHandler = o.recoverHandler
+	f.accessLog = o.accessLog
+	f.badRequestResponse = o.badRequestResponse
+	f.maxRequestBodySize = o.maxRequestBodySize
+	f.healthCheckPath = o.healthCheckPath
+	f.disableMultiValueHeaders = o.disableMultiValueHeaders
+	f.detectJSON = o.detectJSON
+	f.pathPrefix = o.pathPrefix
+	f.stageStrip = o.stageStrip
+	f.rawPath = o.rawPath
+	f.base64Encoding = o.base64Encoding
+	f.alwaysBase64 = o.alwaysBase64
+	f.requestDecompression = o.requestDecompression
+	f.suppressSuperfluousLog = o.suppressSuperfluousLog
+	f.streamingSniffLen = o.streamingSniffLen
+	f.streamingContentLength = o.streamingContentLength
+	return f
+}
+
+// newRuntimeAPIClient returns a new runtimeAPIClient configured by the options.
+func (o *options) newRuntimeAPIClient(address string) *runtimeAPIClient {
+	c := newRuntimeAPIClient(address)
+	c.logger = o.logger
+	c.maxPayloadSize = o.maxPayloadSize
+	c.timeoutResponse = o.timeoutResponse
+	c.deadlineMargin = o.deadlineMargin
+	c.nextTimeout = o.nextTimeout
+	if o.httpClient != nil {
+		c.httpClient = o.httpClient
+	}
+	if o.userAgent != "" {
+		c.userAgent = o.userAgent
+	}
+	if o.observer != nil {
+		c.observer = o.observer
+	}
+	return c
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		logger:            log.Default(),
+		baseContext:       context.Background(),
+		streamingSniffLen: sniffLen,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithInvokeMode specifies the invoke mode of ListenAndServe, StartFunc, and Start.
+// It takes precedence over the RIDGENATIVE_INVOKE_MODE and AWS_LAMBDA_FUNCTION_RESPONSE_STREAMING environment values.
+// Start uses it only if its mode argument is empty, and fails if they conflict.
+func WithInvokeMode(mode InvokeMode) Option {
+	return func(o *options) {
+		o.mode = mode
+	}
+}
+
+// WithLogger specifies the logger for the diagnostics of ridgenative.
+// The default is the standard logger of the log package.
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithBaseContext specifies the base context for every invoke.
+// The context of each request is derived from it.
+// The default is context.Background().
+func WithBaseContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.baseContext = ctx
+	}
+}
+
+// WithInitHook registers a hook that runs once before waiting for the first invoke.
+//
+// It is useful for the expensive setup, such as warming up the connections to databases,
+// during the init phase of the execution environment.
+// The hooks run in the order they are registered, under the base context given by WithBaseContext,
+// which has no deadline of the invokes.
+// If a hook returns an error, the error is reported to the runtime API as an init error,
+// and Start and ListenAndServe return the error without handling any invokes.
+func WithInitHook(hook func(ctx context.Context) error) Option {
+	return func(o *options) {
+		o.initHooks = append(o.initHooks, hook)
+	}
+}
+
+// WithShutdownHook registers a hook that runs when the function is shutting down.
+//
+// If any hook is registered, Start and ListenAndServe listen for SIGTERM
+// that AWS Lambda sends on the shutdown phase of the execution environment.
+// Cancellation of the base context given by WithBaseContext also initiates shutting down.
+// On shutting down, the in-flight invoke completes and its response is sent to the runtime API first,
+// and then the hooks run in the order they are registered.
+// The hooks also run when the runtime loop exits with an error.
+func WithShutdownHook(hook func(ctx context.Context) error) Option {
+	return func(o *options) {
+		o.shutdownHooks = append(o.shutdownHooks, hook)
+	}
+}
+
+// WithBinaryTypeFunc specifies the function that reports whether the response with the content type is binary.
+// The binary responses are encoded in base64.
+// By default, text/*, application/json, application/javascript, application/xml, application/yaml,
+// and their variants, such as application/*+json, are treated as text, and others are treated as binary.
+//
+// The responses with the Content-Encoding header are always binary regardless of the function,
+// and the responses with the "X-Lambda-Http-Content-Encoding: text" header are always text.
+// In the buffered mode, the bodies with the "X-Lambda-Http-Content-Encoding: base64" header
+// are treated as already encoded in base64, and they are sent without encoding again.
+func WithBinaryTypeFunc(isBinary func(contentType string) bool) Option {
+	return func(o *options) {
+		o.isBinaryType = isBinary
+	}
+}
+
+// WithResponseCompression enables compression of the response bodies in the buffered mode.
+// The response body is compressed with gzip, or the codings registered by WithResponseEncoder, if the client accepts it,
+// and the response is text, and the body is large enough to benefit from compression.
+// The compressed responses are encoded in base64.
+func WithResponseCompression() Option {
+	return func(o *options) {
+		o.compression = true
+	}
+}
+
+// WithResponseEncoder registers the encoder of the content coding for WithResponseCompression.
+// The registered codings are preferred over gzip in the order of registration
+// if the client accepts them with the same quality, and gzip is still available as a fallback.
+// For example, Brotli is available with github.com/andybalholm/brotli:
+//
+//	ridgenative.WithResponseEncoder("br", func(w io.Writer) io.WriteCloser {
+//		return brotli.NewWriter(w)
+//	})
+func WithResponseEncoder(coding string, newWriter func(w io.Writer) io.WriteCloser) Option {
+	return func(o *options) {
+		o.responseEncoders = append(o.responseEncoders, responseEncoder{
+			coding:    strings.ToLower(coding),
+			newWriter: newWriter,
+		})
+	}
+}
+
+// WithTrustedProxyCount makes RemoteAddr of the requests derived from the X-Forwarded-For header.
+// n is the number of the proxies in front of the function, such as ALB and CloudFront,
+// and the n-th rightmost entry of the header is used as the client IP address.
+// By default, RemoteAddr is the source IP address of the event.
+func WithTrustedProxyCount(n int) Option {
+	return func(o *options) {
+		o.trustedProxyCount = n
+	}
+}
+
+// WithRecoverHandler specifies the handler for the panics in the handler in the buffered mode.
+// When the handler panics, the response written so far is discarded,
+// and h is called with the recovered value to write the response instead.
+// The response is returned to the client as a normal response, and the invoke doesn't fail.
+// http.ErrAbortHandler is not recovered.
+//
+// By default, the panics are reported to the runtime API as the function errors,
+// and the process exits.
+func WithRecoverHandler(h func(w http.ResponseWriter, r *http.Request, v any)) Option {
+	return func(o *options) {
+		o.recoverHandler = h
+	}
+}
+
+// WithAccessLog enables the access logs in JSON Lines format.
+// Each line has the time, the AWS request id, the method, the path, the status code,
+// the length of the request body after decoding base64, the number of bytes written by the handler,
+// and the duration in milliseconds of the request.
+// The access logs are written to w in both the buffered and the streaming modes.
+func WithAccessLog(w io.Writer) Option {
+	return func(o *options) {
+		o.accessLog = w
+	}
+}
+
+// WithBadRequestResponse makes ridgenative respond with 400 Bad Request to malformed events,
+// such as the events with invalid percent-encoding in the path or invalid base64-encoded body.
+// By default, the invoke fails with the error, and the client receives 502 Bad Gateway.
+func WithBadRequestResponse() Option {
+	return func(o *options) {
+		o.badRequestResponse = true
+	}
+}
+
+// WithMaxRequestBodySize limits the size of the request bodies.
+// The size is measured after decoding base64.
+// The requests with the larger bodies are responded with 413 Request Entity Too Large
+// without calling the handler.
+// The default is unlimited.
+func WithMaxRequestBodySize(n int64) Option {
+	return func(o *options) {
+		o.maxRequestBodySize = n
+	}
+}
+
+// WithMaxInvokePayloadSize limits the size of the invoke payloads received from the runtime API.
+// The invokes with the larger payloads fail without calling the handler,
+// and the function continues to handle the next invoke.
+// The default is unlimited.
+func WithMaxInvokePayloadSize(n int64) Option {
+	return func(o *options) {
+		o.maxPayloadSize = n
+	}
+}
+
+// WithRuntimeAPIHTTPClient specifies the HTTP client for connecting to the runtime API.
+// The default client keeps a single connection alive, and doesn't use proxies.
+// The client must not time out, because waiting for the next invoke may take a long time.
+func WithRuntimeAPIHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = client
+	}
+}
+
+// WithTimeoutResponse makes ridgenative respond with 504 Gateway Timeout
+// when the handler doesn't return before the deadline of the invoke in the buffered mode.
+// The handler keeps running in the background until it returns,
+// so it should respect the cancellation of the request context.
+// Note that ridgenative starts handling the next invoke without waiting for the timed-out handler,
+// so the handlers may run concurrently.
+// By default, ridgenative waits for the handler to return.
+func WithTimeoutResponse() Option {
+	return func(o *options) {
+		o.timeoutResponse = true
+	}
+}
+
+// WithDeadlineMargin makes the deadline of the request contexts earlier than the deadline of the invoke by d.
+// The deadline of the invoke is the time when Lambda kills the function,
+// so the margin gives the handler time to flush the logs and the metrics after the cancellation.
+// It also affects WithTimeoutResponse.
+// If the remaining time of the invoke is shorter than d, the margin is ignored.
+// The default is zero.
+func WithDeadlineMargin(d time.Duration) Option {
+	return func(o *options) {
+		o.deadlineMargin = d
+	}
+}
+
+// WithHealthCheck makes ridgenative respond to the health check requests from ALB with 200 OK
+// without calling the handler.
+// The health check requests are GET or HEAD requests of API Gateway v1 or ALB events
+// to path or from the ELB-HealthChecker user agent.
+// By default, the health check requests are passed to the handler.
+func WithHealthCheck(path string) Option {
+	return func(o *options) {
+		o.healthCheckPath = path
+	}
+}
+
+// WithMultiValueHeaders specifies whether the responses for API Gateway REST APIs have multiValueHeaders.
+// If disabled, the responses have only headers, and multiple values of a header are joined with ", ",
+// except Set-Cookie, which has only the first value.
+// The default is enabled.
+//
+// The responses for ALB always follow the configuration of the target group,
+// and the other events don't support multiValueHeaders.
+func WithMultiValueHeaders(enabled bool) Option {
+	return func(o *options) {
+		o.disableMultiValueHeaders = !enabled
+	}
+}
+
+// WithPathPrefixStrip strips prefix from the paths of the requests before serving them.
+// It is useful when the function is mounted under a stage, such as "/prod".
+// The paths without prefix are served as they are.
+// The prefix matches only whole path segments, so "/prod" is stripped from "/prod/foo", but not from "/products".
+func WithPathPrefixStrip(prefix string) Option {
+	return func(o *options) {
+		prefix = strings.Trim(prefix, "/")
+		if prefix != "" {
+			prefix = "/" + prefix
+		}
+		o.pathPrefix = prefix
+	}
+}
+
+// WithStageStrip strips the stage of API Gateway REST APIs from the paths of the requests before serving them.
+// API Gateway usually strips the stage, but it may remain, for example, with a custom domain name.
+// The stage is the stage field of requestContext, such as "prod".
+// It doesn't affect the other events.
+// Use WithPathPrefixStrip for the base path mappings of custom domain names.
+func WithStageStrip() Option {
+	return func(o *options) {
+		o.stageStrip = true
+	}
+}
+
+// WithRawPath makes the paths of API Gateway HTTP APIs and Lambda Function URLs requests derived from rawPath
+// instead of requestContext.http.path.
+// They usually agree, but they may differ, for example, rawPath includes the base path mapping
+// of a custom domain name, but requestContext.http.path doesn't.
+// Use it if the router matches URL.Path against the paths as the client sent them.
+// RequestURI is always derived from rawPath.
+// It doesn't affect the other events.
+func WithRawPath() Option {
+	return func(o *options) {
+		o.rawPath = true
+	}
+}
+
+// WithNotFoundHandler specifies the handler for the requests that the mux doesn't match.
+// It replaces the plain text 404 page of http.ServeMux.
+//
+// It works only if the handler given to Start or ListenAndServe is a *http.ServeMux or nil.
+// Other handlers, such as the ones wrapped by Chain, are responsible for their own 404 responses,
+// because ridgenative can't distinguish the missed routes from the 404 responses of the application.
+// With the method-based patterns of Go 1.22 or later, the requests with unmatched methods
+// are served by h instead of 405 Method Not Allowed.
+func WithNotFoundHandler(h http.Handler) Option {
+	return func(o *options) {
+		o.notFoundHandler = h
+	}
+}
+
+// WithUserAgent specifies the User-Agent header of the requests to the runtime API.
+// The default is "ridgenative/<version> <go version>", such as "ridgenative/v1.0.0 go1.19".
+func WithUserAgent(ua string) Option {
+	return func(o *options) {
+		o.userAgent = ua
+	}
+}
+
+// WithJSONContentTypeDetection makes the content type detection recognize JSON in the buffered mode.
+// If the handler doesn't set the Content-Type header, and the body is a valid JSON object or array,
+// the content type is application/json.
+// By default, the content type is detected by http.DetectContentType,
+// and JSON bodies are detected as text/plain; charset=utf-8.
+func WithJSONContentTypeDetection() Option {
+	return func(o *options) {
+		o.detectJSON = true
+	}
+}
+
+// WithResponseBase64Encoding specifies the base64 encoding of the binary response bodies in the buffered mode.
+// The default is base64.StdEncoding, which API Gateway, ALB, and Lambda function URLs expect.
+// Use it only for the downstreams that expect other encodings, such as base64.URLEncoding.
+func WithResponseBase64Encoding(enc *base64.Encoding) Option {
+	return func(o *options) {
+		o.base64Encoding = enc
+	}
+}
+
+// WithObserver specifies the observer of the invokes.
+// It is useful for collecting the metrics, such as the number of invokes, durations, and errors.
+// The default observer does nothing.
+func WithObserver(observer Observer) Option {
+	return func(o *options) {
+		o.observer = observer
+	}
+}
+
+// WithAlwaysBase64 makes all the response bodies binary in the buffered mode.
+// The bodies are always encoded in base64 regardless of their content types and WithBinaryTypeFunc,
+// and the content types are not detected from the bodies, so the handler should set the Content-Type header.
+// It is useful for the functions that return only binary responses.
+func WithAlwaysBase64() Option {
+	return func(o *options) {
+		o.alwaysBase64 = true
+	}
+}
+
+// WithRequestDecompression enables decompression of the request bodies.
+// If the Content-Encoding header of the request is gzip or deflate,
+// the handler receives the decompressed body without the Content-Encoding and Content-Length headers,
+// and the ContentLength of the request is -1.
+// The other codings, such as br, are passed through to the handler as they are.
+// The decompressed bodies are limited by WithMaxRequestBodySize.
+func WithRequestDecompression() Option {
+	return func(o *options) {
+		o.requestDecompression = true
+	}
+}
+
+// WithSuppressSuperfluousWriteHeaderLog disables the warning of superfluous WriteHeader calls.
+// By default, ridgenative logs the caller if the handler calls WriteHeader more than once, as net/http does.
+// It is useful for the handler frameworks where such calls are benign.
+func WithSuppressSuperfluousWriteHeaderLog() Option {
+	return func(o *options) {
+		o.suppressSuperfluousLog = true
+	}
+}
+
+// WithStreamingSniffSize specifies the maximum length of the body buffered for content-type detection in the streaming mode.
+// If the handler doesn't set the Content-Type header, the response is held until the body reaches n bytes,
+// the handler flushes it, or the handler returns, and the content type is detected from the buffered body.
+// The smaller n reduces the latency to the first byte for slow producers, and zero disables the buffering;
+// the content type is detected from the empty body, i.e. "text/plain; charset=utf-8".
+// The default and the maximum is 512 bytes, because http.DetectContentType considers at most 512 bytes.
+func WithStreamingSniffSize(n int) Option {
+	return func(o *options) {
+		if n < 0 {
+			n = 0
+		}
+		if n > sniffLen {
+			n = sniffLen
+		}
+		o.streamingSniffLen = n
+	}
+}
+
+// WithStreamingContentLength keeps the Content-Length header set by the handler in the streaming mode.
+// By default, the header is removed from the streaming responses, because the length is often unknown
+// until the handler returns, and a wrong length breaks the response.
+// With this option, the handler is responsible for the accuracy of the header;
+// invalid values are still removed, and a mismatch with the body written is logged.
+func WithStreamingContentLength() Option {
+	return func(o *options) {
+		o.streamingContentLength = true
+	}
+}
+
+// WithNextInvokeTimeout specifies the timeout of waiting for the next invoke from the runtime API.
+// If the runtime API doesn't respond in d, the runtime loop stops with an error instead of hanging.
+// The responses to the runtime API are not affected.
+// The default is zero, which means no timeout.
+//
+// Lambda freezes the execution environment while no invokes are available,
+// so the time to the next invoke is unpredictable in production.
+// It is mainly useful for the local runtime API emulators and the integration tests.
+func WithNextInvokeTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.nextTimeout = d
+	}
+}
@@ -0,0 +1,1307 @@
+package ridgenative
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestRuntimeAPI starts a fake runtime API that serves the events in order.
+// After all events are served, it responds to the next request with an error,
+// so the runtime loop stops.
+func newTestRuntimeAPI(t *testing.T, events ...string) *httptest.Server {
+	t.Helper()
+	var mu sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/2018-06-01/runtime/invocation/next" {
+			if _, err := io.Copy(io.Discard, r.Body); err != nil {
+				t.Error(err)
+			}
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(events) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		event := events[0]
+		events = events[1:]
+		w.Header().Set(headerAWSRequestID, "request-id")
+		w.Header().Set(headerDeadlineMS, encodeDeadline(time.Now().Add(time.Second)))
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := io.WriteString(w, event); err != nil {
+			t.Error(err)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	t.Setenv("AWS_LAMBDA_RUNTIME_API", strings.TrimPrefix(ts.URL, "http://"))
+	return ts
+}
+
+type testContextKey struct{}
+
+func TestStart_Options(t *testing.T) {
+	newTestRuntimeAPI(t, `{"httpMethod":"GET","path":"/"}`)
+
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+	ctx := context.WithValue(context.Background(), testContextKey{}, "base-context-value")
+	var called bool
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if v := r.Context().Value(testContextKey{}); v != "base-context-value" {
+			t.Errorf("unexpected context value: want %q, got %v", "base-context-value", v)
+		}
+	})
+	err := Start(h, InvokeModeBuffered, WithLogger(logger), WithBaseContext(ctx))
+	if err == nil {
+		t.Fatal("want error, got nil")
+	}
+	if !called {
+		t.Error("the handler is not called")
+	}
+	if !strings.Contains(buf.String(), "got unexpected status code: 500") {
+		t.Errorf("unexpected log: %q", buf.String())
+	}
+}
+
+func TestStart_InvokeMode(t *testing.T) {
+	t.Run("WithInvokeMode is used if the mode is empty", func(t *testing.T) {
+		newTestRuntimeAPI(t, `{"httpMethod":"GET","path":"/"}`)
+
+		var called bool
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		})
+		err := Start(h, "", WithLogger(log.New(io.Discard, "", 0)), WithInvokeMode(InvokeModeBuffered))
+		if err == nil {
+			t.Fatal("want error, got nil")
+		}
+		if strings.Contains(err.Error(), "invalid InvokeMode") {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if !called {
+			t.Error("the handler is not called")
+		}
+	})
+
+	t.Run("the same mode", func(t *testing.T) {
+		newTestRuntimeAPI(t, `{"httpMethod":"GET","path":"/"}`)
+
+		var called bool
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		})
+		err := Start(h, InvokeModeBuffered, WithLogger(log.New(io.Discard, "", 0)), WithInvokeMode(InvokeModeBuffered))
+		if err == nil {
+			t.Fatal("want error, got nil")
+		}
+		if !called {
+			t.Error("the handler is not called")
+		}
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		newTestRuntimeAPI(t, `{"httpMethod":"GET","path":"/"}`)
+
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("the handler must not be called")
+		})
+		err := Start(h, InvokeModeBuffered, WithInvokeMode(InvokeModeResponseStream))
+		if err == nil {
+			t.Fatal("want error, got nil")
+		}
+		if !strings.Contains(err.Error(), "conflicts with WithInvokeMode") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestStartFunc(t *testing.T) {
+	t.Run("the handler function serves the requests", func(t *testing.T) {
+		newTestRuntimeAPI(t, `{"httpMethod":"GET","path":"/"}`)
+		t.Setenv("RIDGENATIVE_INVOKE_MODE", "")
+
+		var called bool
+		err := StartFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		}, WithLogger(log.New(io.Discard, "", 0)))
+		if err == nil {
+			t.Fatal("want error, got nil")
+		}
+		if !called {
+			t.Error("the handler is not called")
+		}
+	})
+
+	t.Run("nil handler", func(t *testing.T) {
+		err := StartFunc(nil)
+		if err == nil {
+			t.Fatal("want error, got nil")
+		}
+	})
+
+	t.Run("invalid mode", func(t *testing.T) {
+		t.Setenv("RIDGENATIVE_INVOKE_MODE", "invalid")
+		err := StartFunc(func(w http.ResponseWriter, r *http.Request) {})
+		if err == nil {
+			t.Fatal("want error, got nil")
+		}
+	})
+}
+
+func TestWithBaseContext(t *testing.T) {
+	for _, mode := range []InvokeMode{InvokeModeBuffered, InvokeModeResponseStream} {
+		mode := mode
+		t.Run(string(mode), func(t *testing.T) {
+			newTestRuntimeAPI(t, `{"version":"2.0","rawPath":"/","requestContext":{"http":{"method":"GET","path":"/"}}}`)
+
+			ctx := context.WithValue(context.Background(), testContextKey{}, "base-context-value")
+			called := make(chan struct{}, 1)
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer func() { called <- struct{}{} }()
+				if v := r.Context().Value(testContextKey{}); v != "base-context-value" {
+					t.Errorf("unexpected context value: want %q, got %v", "base-context-value", v)
+				}
+				if _, ok := r.Context().Deadline(); !ok {
+					t.Error("want deadline, got none")
+				}
+				if _, ok := RequestID(r.Context()); !ok {
+					t.Error("request id not found")
+				}
+			})
+			err := Start(h, mode, WithLogger(log.New(io.Discard, "", 0)), WithBaseContext(ctx))
+			if err == nil {
+				t.Fatal("want error, got nil")
+			}
+			select {
+			case <-called:
+			case <-time.After(time.Second):
+				t.Error("the handler is not called")
+			}
+		})
+	}
+}
+
+func TestListenAndServeMode(t *testing.T) {
+	t.Run("the mode overrides the environment value", func(t *testing.T) {
+		newTestRuntimeAPI(t, `{"httpMethod":"GET","path":"/"}`)
+		t.Setenv("RIDGENATIVE_INVOKE_MODE", "invalid")
+
+		var called bool
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		})
+		err := ListenAndServeMode(":8080", h, InvokeModeBuffered, WithLogger(log.New(io.Discard, "", 0)))
+		if err == nil {
+			t.Fatal("want error, got nil")
+		}
+		if !called {
+			t.Error("the handler is not called")
+		}
+	})
+
+	t.Run("fall back to the environment value", func(t *testing.T) {
+		newTestRuntimeAPI(t, `{"httpMethod":"GET","path":"/"}`)
+		t.Setenv("RIDGENATIVE_INVOKE_MODE", "invalid")
+
+		err := ListenAndServeMode(":8080", http.NotFoundHandler(), "")
+		if err == nil || err.Error() != "ridgenative: invalid RIDGENATIVE_INVOKE_MODE" {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestInvokeMode_ResponseStreamingEnv(t *testing.T) {
+	tests := []struct {
+		mode      string
+		streaming string
+		want      InvokeMode
+		err       bool
+	}{
+		{"", "", InvokeModeBuffered, false},
+		{"", "true", InvokeModeResponseStream, false},
+		{"", "1", InvokeModeResponseStream, false},
+		{"", "false", InvokeModeBuffered, false},
+		{"", "invalid", "", true},
+		{"BUFFERED", "true", InvokeModeBuffered, false},
+		{"RESPONSE_STREAM", "false", InvokeModeResponseStream, false},
+	}
+	for _, tt := range tests {
+		t.Setenv("RIDGENATIVE_INVOKE_MODE", tt.mode)
+		t.Setenv("AWS_LAMBDA_FUNCTION_RESPONSE_STREAMING", tt.streaming)
+		got, err := newOptions(nil).invokeMode()
+		if (err != nil) != tt.err {
+			t.Errorf("env %q, %q: unexpected error: %v", tt.mode, tt.streaming, err)
+		}
+		if got != tt.want {
+			t.Errorf("env %q, %q: unexpected mode: want %q, got %q", tt.mode, tt.streaming, tt.want, got)
+		}
+	}
+}
+
+func TestListenAndServe_ResponseStreamingEnv(t *testing.T) {
+	t.Run("streaming", func(t *testing.T) {
+		newTestRuntimeAPI(t, `{"version":"2.0","rawPath":"/","requestContext":{"http":{"method":"GET","path":"/"}}}`)
+		t.Setenv("RIDGENATIVE_INVOKE_MODE", "")
+		t.Setenv("AWS_LAMBDA_FUNCTION_RESPONSE_STREAMING", "true")
+
+		called := make(chan bool, 1)
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, ok := w.(*streamingResponseWriter)
+			called <- ok
+		})
+		err := ListenAndServe(":8080", h, WithLogger(log.New(io.Discard, "", 0)))
+		if err == nil {
+			t.Fatal("want error, got nil")
+		}
+		select {
+		case streaming := <-called:
+			if !streaming {
+				t.Error("want the streaming mode, got the buffered mode")
+			}
+		case <-time.After(time.Second):
+			t.Error("the handler is not called")
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		newTestRuntimeAPI(t)
+		t.Setenv("RIDGENATIVE_INVOKE_MODE", "")
+		t.Setenv("AWS_LAMBDA_FUNCTION_RESPONSE_STREAMING", "invalid")
+
+		err := ListenAndServe(":8080", http.NotFoundHandler())
+		if err == nil || err.Error() != "ridgenative: invalid AWS_LAMBDA_FUNCTION_RESPONSE_STREAMING" {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestInvokeMode(t *testing.T) {
+	tests := []struct {
+		env  string
+		opts []Option
+		want InvokeMode
+		err  bool
+	}{
+		{"", nil, InvokeModeBuffered, false},
+		{"BUFFERED", nil, InvokeModeBuffered, false},
+		{"RESPONSE_STREAM", nil, InvokeModeResponseStream, false},
+		{"invalid", nil, "", true},
+		{"", []Option{WithInvokeMode(InvokeModeResponseStream)}, InvokeModeResponseStream, false},
+		{"BUFFERED", []Option{WithInvokeMode(InvokeModeResponseStream)}, InvokeModeResponseStream, false},
+		{"invalid", []Option{WithInvokeMode(InvokeModeBuffered)}, InvokeModeBuffered, false},
+	}
+	for _, tt := range tests {
+		t.Setenv("RIDGENATIVE_INVOKE_MODE", tt.env)
+		got, err := newOptions(tt.opts).invokeMode()
+		if (err != nil) != tt.err {
+			t.Errorf("env %q: unexpected error: %v", tt.env, err)
+		}
+		if got != tt.want {
+			t.Errorf("env %q: unexpected mode: want %q, got %q", tt.env, tt.want, got)
+		}
+	}
+}
+
+type testLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *testLogger) Printf(format string, v ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, fmt.Sprintf(format, v...))
+}
+
+func TestWithLogger(t *testing.T) {
+	t.Run("buffered", func(t *testing.T) {
+		logger := &testLogger{}
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.WriteHeader(http.StatusOK)
+		}))
+		l.logger = logger
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if len(logger.logs) != 1 || !strings.HasPrefix(logger.logs[0], "ridgenative: superfluous response.WriteHeader call") {
+			t.Errorf("unexpected logs: %#v", logger.logs)
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		logger := &testLogger{}
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.WriteHeader(http.StatusOK)
+		}))
+		l.logger = logger
+		req, err := loadRequest("testdata/function-urls-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, w := io.Pipe()
+		if _, err := l.lambdaHandlerStreaming(context.Background(), req, w); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(r); err != nil {
+			t.Fatal(err)
+		}
+		logger.mu.Lock()
+		defer logger.mu.Unlock()
+		if len(logger.logs) != 1 || !strings.HasPrefix(logger.logs[0], "ridgenative: superfluous response.WriteHeader call") {
+			t.Errorf("unexpected logs: %#v", logger.logs)
+		}
+	})
+}
+
+func TestWithSuppressSuperfluousWriteHeaderLog(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	t.Run("buffered", func(t *testing.T) {
+		logger := &testLogger{}
+		l := newOptions([]Option{WithLogger(logger), WithSuppressSuperfluousWriteHeaderLog()}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if len(logger.logs) != 0 {
+			t.Errorf("unexpected logs: %#v", logger.logs)
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		logger := &testLogger{}
+		l := newOptions([]Option{WithLogger(logger), WithSuppressSuperfluousWriteHeaderLog()}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/function-urls-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, w := io.Pipe()
+		if _, err := l.lambdaHandlerStreaming(context.Background(), req, w); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(r); err != nil {
+			t.Fatal(err)
+		}
+		logger.mu.Lock()
+		defer logger.mu.Unlock()
+		if len(logger.logs) != 0 {
+			t.Errorf("unexpected logs: %#v", logger.logs)
+		}
+	})
+}
+
+func TestWithShutdownHook(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+
+	var invoked bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/2018-06-01/runtime/invocation/next":
+			mu.Lock()
+			first := !invoked
+			invoked = true
+			mu.Unlock()
+			if !first {
+				// no more invokes. wait for shutting down.
+				<-r.Context().Done()
+				return
+			}
+			w.Header().Set(headerAWSRequestID, "request-id")
+			w.Header().Set(headerDeadlineMS, encodeDeadline(time.Now().Add(time.Second)))
+			if _, err := io.WriteString(w, `{"httpMethod":"GET","path":"/"}`); err != nil {
+				t.Error(err)
+			}
+		case "/2018-06-01/runtime/invocation/request-id/response":
+			record("response")
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+	t.Setenv("AWS_LAMBDA_RUNTIME_API", strings.TrimPrefix(ts.URL, "http://"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// shutting down is initiated during the invoke.
+		cancel()
+		if err := r.Context().Err(); err != nil {
+			t.Errorf("the in-flight invoke is canceled: %v", err)
+		}
+		record("handler")
+	})
+	hook := func(ctx context.Context) error {
+		record("hook")
+		return nil
+	}
+	if err := Start(h, InvokeModeBuffered, WithBaseContext(ctx), WithShutdownHook(hook)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"handler", "response", "hook"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("unexpected events: want %v, got %v", want, events)
+	}
+}
+
+func TestWithInitHook(t *testing.T) {
+	t.Run("the hook runs once", func(t *testing.T) {
+		newTestRuntimeAPI(t, `{"httpMethod":"GET","path":"/"}`, `{"httpMethod":"GET","path":"/"}`)
+
+		var count, invokes int
+		hook := func(ctx context.Context) error {
+			count++
+			if invokes != 0 {
+				t.Error("the hook runs after the invoke")
+			}
+			if _, ok := ctx.Deadline(); ok {
+				t.Error("the context of the hook must not have deadline")
+			}
+			return nil
+		}
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invokes++
+		})
+		err := Start(h, InvokeModeBuffered, WithLogger(log.New(io.Discard, "", 0)), WithInitHook(hook))
+		if err == nil {
+			t.Fatal("want error, got nil")
+		}
+		if count != 1 {
+			t.Errorf("want the hook runs once, got %d", count)
+		}
+		if invokes != 2 {
+			t.Errorf("want 2 invokes, got %d", invokes)
+		}
+	})
+
+	t.Run("the error is reported", func(t *testing.T) {
+		var mu sync.Mutex
+		var initErrorBody string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/2018-06-01/runtime/init/error":
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Error(err)
+				}
+				mu.Lock()
+				initErrorBody = string(body)
+				mu.Unlock()
+				w.WriteHeader(http.StatusAccepted)
+			default:
+				t.Errorf("unexpected path: %s", r.URL.Path)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+		defer ts.Close()
+		t.Setenv("AWS_LAMBDA_RUNTIME_API", strings.TrimPrefix(ts.URL, "http://"))
+
+		var count int
+		hook := func(ctx context.Context) error {
+			count++
+			return &myError{msg: "failed to connect to the database"}
+		}
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("the handler must not be called")
+		})
+		err := Start(h, InvokeModeResponseStream, WithLogger(log.New(io.Discard, "", 0)), WithInitHook(hook))
+		var myErr *myError
+		if !errors.As(err, &myErr) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if count != 1 {
+			t.Errorf("want the hook runs once, got %d", count)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		want := `{"errorMessage":"failed to connect to the database","errorType":"myError"}`
+		if initErrorBody != want {
+			t.Errorf("unexpected init error: want %s, got %s", want, initErrorBody)
+		}
+	})
+}
+
+func TestWithBinaryTypeFunc(t *testing.T) {
+	isBinaryType := func(contentType string) bool {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		switch mediaType {
+		case "application/x-ndjson":
+			return false
+		case "text/csv":
+			return true
+		}
+		return isBinaryContentType(contentType)
+	}
+
+	tests := []struct {
+		contentType string
+		body        string
+		want        bool
+	}{
+		{"application/x-ndjson", "{\"hello\":\"world\"}\n", false},
+		{"text/csv", "hello,world\n", true},
+		{"text/plain", "hello world\n", false},
+		{"image/png", "\x89PNG\r\n\x1a\n", true},
+	}
+	for _, tt := range tests {
+		l := newOptions([]Option{WithBinaryTypeFunc(isBinaryType)}).newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tt.contentType)
+			if _, err := io.WriteString(w, tt.body); err != nil {
+				t.Error(err)
+			}
+		}))
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.IsBase64Encoded != tt.want {
+			t.Errorf("%s: unexpected IsBase64Encoded: want %t, got %t", tt.contentType, tt.want, resp.IsBase64Encoded)
+		}
+	}
+}
+
+func TestWithTrustedProxyCount(t *testing.T) {
+	tests := []struct {
+		name          string
+		count         int
+		xForwardedFor []string
+		want          string
+	}{
+		{"default", 0, []string{"203.0.113.1, 198.51.100.1"}, "192.0.2.1:0"},
+		{"one proxy", 1, []string{"203.0.113.1, 198.51.100.1"}, "198.51.100.1:0"},
+		{"two proxies", 2, []string{"203.0.113.1, 198.51.100.1"}, "203.0.113.1:0"},
+		{"spoofed", 2, []string{"192.0.2.100, 203.0.113.1, 198.51.100.1"}, "203.0.113.1:0"},
+		{"too many proxies", 3, []string{"203.0.113.1, 198.51.100.1"}, "203.0.113.1:0"},
+		{"multiple headers", 2, []string{"203.0.113.1", "198.51.100.1"}, "203.0.113.1:0"},
+		{"ipv6", 1, []string{"2001:db8::1"}, "[2001:db8::1]:0"},
+		{"invalid", 1, []string{"unknown"}, "192.0.2.1:0"},
+		{"no header", 1, nil, "192.0.2.1:0"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var remoteAddr string
+			l := newOptions([]Option{WithTrustedProxyCount(tt.count)}).newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				remoteAddr = r.RemoteAddr
+			}))
+
+			// API Gateway v1
+			req, err := loadRequest("testdata/apigateway-get-request.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Headers = nil
+			req.MultiValueHeaders = map[string][]string{}
+			if tt.xForwardedFor != nil {
+				req.MultiValueHeaders["X-Forwarded-For"] = tt.xForwardedFor
+			}
+			if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+			if remoteAddr != tt.want {
+				t.Errorf("v1: unexpected RemoteAddr: want %q, got %q", tt.want, remoteAddr)
+			}
+
+			// API Gateway v2
+			req, err = loadRequest("testdata/apigateway-v2-get-request.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			delete(req.Headers, "x-forwarded-for")
+			if tt.xForwardedFor != nil {
+				req.Headers["x-forwarded-for"] = strings.Join(tt.xForwardedFor, ",")
+			}
+			if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+			if remoteAddr != tt.want {
+				t.Errorf("v2: unexpected RemoteAddr: want %q, got %q", tt.want, remoteAddr)
+			}
+		})
+	}
+}
+
+func TestWithRecoverHandler(t *testing.T) {
+	recoverHandler := func(w http.ResponseWriter, r *http.Request, v any) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "<h1>Internal Server Error</h1><p>%v</p>", v)
+	}
+
+	t.Run("recovered", func(t *testing.T) {
+		l := newOptions([]Option{WithRecoverHandler(recoverHandler)}).newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Partial", "true")
+			w.WriteHeader(http.StatusOK)
+			if _, err := io.WriteString(w, "partial"); err != nil {
+				t.Error(err)
+			}
+			panic("something wrong")
+		}))
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusInternalServerError, resp.StatusCode)
+		}
+		if v, ok := resp.Headers["X-Partial"]; ok {
+			t.Errorf("unexpected X-Partial header: %q", v)
+		}
+		if want := "<h1>Internal Server Error</h1><p>something wrong</p>"; resp.Body != want {
+			t.Errorf("unexpected body: want %q, got %q", want, resp.Body)
+		}
+	})
+
+	t.Run("abort handler", func(t *testing.T) {
+		l := newOptions([]Option{WithRecoverHandler(recoverHandler)}).newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic(http.ErrAbortHandler)
+		}))
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if v := recover(); v != http.ErrAbortHandler {
+				t.Errorf("want http.ErrAbortHandler, got %v", v)
+			}
+		}()
+		_, _ = l.lambdaHandler(context.Background(), req)
+		t.Error("want panic, but not")
+	})
+
+	t.Run("default", func(t *testing.T) {
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("something wrong")
+		}))
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if v := recover(); v != "something wrong" {
+				t.Errorf("want %q, got %v", "something wrong", v)
+			}
+		}()
+		_, _ = l.lambdaHandler(context.Background(), req)
+		t.Error("want panic, but not")
+	})
+}
+
+func TestWithBadRequestResponse(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the handler must not be called")
+	})
+
+	t.Run("invalid path v1", func(t *testing.T) {
+		l := newOptions([]Option{WithBadRequestResponse()}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Path = "/foo%zz"
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+		if resp.Body != "400 Bad Request\n" {
+			t.Errorf("unexpected body: want %q, got %q", "400 Bad Request\n", resp.Body)
+		}
+	})
+
+	t.Run("invalid path v2", func(t *testing.T) {
+		l := newOptions([]Option{WithBadRequestResponse()}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RequestContext.HTTP.Path = "/foo%zz"
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
+	t.Run("invalid base64", func(t *testing.T) {
+		l := newOptions([]Option{WithBadRequestResponse()}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-v2-base64-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Body = "!!invalid base64!!"
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		l := newOptions([]Option{WithBadRequestResponse()}).newLambdaFunction(h)
+		r, w := io.Pipe()
+		_, err := l.lambdaHandlerStreaming(context.Background(), &request{
+			RequestContext: ProxyRequestContext{
+				HTTP: &ProxyRequestContextHTTP{
+					Method: http.MethodGet,
+					Path:   "/foo%zz",
+				},
+			},
+		}, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(data), `{"statusCode":400,`) {
+			t.Errorf("unexpected response: %q", string(data))
+		}
+		if !strings.HasSuffix(string(data), "\x00\x00\x00\x00\x00\x00\x00\x00400 Bad Request\n") {
+			t.Errorf("unexpected response: %q", string(data))
+		}
+	})
+
+	t.Run("default", func(t *testing.T) {
+		l := newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Path = "/foo%zz"
+		if _, err := l.lambdaHandler(context.Background(), req); err == nil {
+			t.Error("want error, got nil")
+		}
+	})
+}
+
+func TestWithMaxRequestBodySize(t *testing.T) {
+	var called bool
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	tests := []struct {
+		name   string
+		body   string
+		base64 bool
+		status int
+		called bool
+	}{
+		{"within the limit", "0123456789", false, http.StatusOK, true},
+		{"exceeding the limit", "0123456789a", false, http.StatusRequestEntityTooLarge, false},
+		{"base64 within the limit", base64.StdEncoding.EncodeToString([]byte("0123456789")), true, http.StatusOK, true},
+		{"base64 exceeding the limit", base64.StdEncoding.EncodeToString([]byte("0123456789a")), true, http.StatusRequestEntityTooLarge, false},
+	}
+	for _, tt := range tests {
+		called = false
+		l := newOptions([]Option{WithMaxRequestBodySize(10)}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-v2-post-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Body = tt.body
+		req.IsBase64Encoded = tt.base64
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: unexpected status code: want %d, got %d", tt.name, tt.status, resp.StatusCode)
+		}
+		if called != tt.called {
+			t.Errorf("%s: unexpected handler call: want %t, got %t", tt.name, tt.called, called)
+		}
+	}
+}
+
+func TestWithRuntimeAPIHTTPClient(t *testing.T) {
+	newTestRuntimeAPI(t, `{"httpMethod":"GET","path":"/"}`)
+
+	var count int
+	var mu sync.Mutex
+	client := &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			count++
+			mu.Unlock()
+			return http.DefaultTransport.RoundTrip(req)
+		}),
+	}
+	err := Start(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), InvokeModeBuffered, WithRuntimeAPIHTTPClient(client), WithLogger(log.New(io.Discard, "", 0)))
+	if err == nil {
+		t.Error("want error, got nil")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// next, response, and next that fails.
+	if count != 3 {
+		t.Errorf("want 3 requests, got %d", count)
+	}
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestWithHealthCheck(t *testing.T) {
+	var called bool
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	tests := []struct {
+		name   string
+		path   string
+		modify func(req *request)
+		status int
+		called bool
+	}{
+		{
+			name:   "alb health check",
+			path:   "/healthz",
+			status: http.StatusOK,
+		},
+		{
+			name: "health check path",
+			path: "/healthz",
+			modify: func(req *request) {
+				req.Path = "/healthz"
+				req.Headers = map[string]string{"user-agent": "curl/7.54.0"}
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "other path",
+			path: "/healthz",
+			modify: func(req *request) {
+				req.Headers = map[string]string{"user-agent": "curl/7.54.0"}
+			},
+			status: http.StatusTeapot,
+			called: true,
+		},
+		{
+			name: "post",
+			path: "/healthz",
+			modify: func(req *request) {
+				req.HTTPMethod = http.MethodPost
+			},
+			status: http.StatusTeapot,
+			called: true,
+		},
+		{
+			name:   "disabled",
+			path:   "",
+			status: http.StatusTeapot,
+			called: true,
+		},
+	}
+	for _, tt := range tests {
+		called = false
+		l := newOptions([]Option{WithHealthCheck(tt.path)}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/alb-health-check-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.modify != nil {
+			tt.modify(req)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: unexpected status code: want %d, got %d", tt.name, tt.status, resp.StatusCode)
+		}
+		if called != tt.called {
+			t.Errorf("%s: unexpected handler call: want %t, got %t", tt.name, tt.called, called)
+		}
+	}
+}
+
+func TestWithMultiValueHeaders(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-Foo", "foo")
+		w.Header().Add("X-Foo", "bar")
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		l := newOptions([]Option{WithMultiValueHeaders(true)}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resp.MultiValueHeaders["X-Foo"], []string{"foo", "bar"}) {
+			t.Errorf("unexpected X-Foo: want %v, got %v", []string{"foo", "bar"}, resp.MultiValueHeaders["X-Foo"])
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		l := newOptions([]Option{WithMultiValueHeaders(false)}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.MultiValueHeaders != nil {
+			t.Errorf("unexpected multiValueHeaders: %v", resp.MultiValueHeaders)
+		}
+		if resp.Headers["X-Foo"] != "foo, bar" {
+			t.Errorf("unexpected X-Foo: want %q, got %q", "foo, bar", resp.Headers["X-Foo"])
+		}
+	})
+}
+
+func TestWithPathPrefixStrip(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		rawPath string
+		path    string
+		uri     string
+	}{
+		{"/prod", "/prod/my/path", "/my/path", "/my/path?parameter1=value1&parameter1=value2&parameter2=value"},
+		{"prod/", "/prod/my/path", "/my/path", "/my/path?parameter1=value1&parameter1=value2&parameter2=value"},
+		{"/prod", "/prod", "/", "/?parameter1=value1&parameter1=value2&parameter2=value"},
+		{"/prod", "/products", "/products", "/products?parameter1=value1&parameter1=value2&parameter2=value"},
+		{"/prod", "/my/path", "/my/path", "/my/path?parameter1=value1&parameter1=value2&parameter2=value"},
+		{"", "/prod/my/path", "/prod/my/path", "/prod/my/path?parameter1=value1&parameter1=value2&parameter2=value"},
+	}
+	for _, tt := range tests {
+		var called bool
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			if r.URL.Path != tt.path {
+				t.Errorf("prefix %q, path %q: unexpected path: want %q, got %q", tt.prefix, tt.rawPath, tt.path, r.URL.Path)
+			}
+			if r.RequestURI != tt.uri {
+				t.Errorf("prefix %q, path %q: unexpected RequestURI: want %q, got %q", tt.prefix, tt.rawPath, tt.uri, r.RequestURI)
+			}
+		})
+		l := newOptions([]Option{WithPathPrefixStrip(tt.prefix)}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RawPath = tt.rawPath
+		req.RequestContext.HTTP.Path = tt.rawPath
+		if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if !called {
+			t.Errorf("prefix %q, path %q: the handler is not called", tt.prefix, tt.rawPath)
+		}
+	}
+}
+
+func TestWithStageStrip(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		path string
+		want string
+	}{
+		{"stage-prefixed path", []Option{WithStageStrip()}, "/prod/foo/bar", "/foo/bar"},
+		{"path without stage", []Option{WithStageStrip()}, "/foo/bar", "/foo/bar"},
+		{"disabled", nil, "/prod/foo/bar", "/prod/foo/bar"},
+		{"with base path", []Option{WithStageStrip(), WithPathPrefixStrip("/v1")}, "/prod/v1/foo/bar", "/foo/bar"},
+	}
+	for _, tt := range tests {
+		var called bool
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			if r.URL.Path != tt.want {
+				t.Errorf("%s: unexpected path: want %q, got %q", tt.name, tt.want, r.URL.Path)
+			}
+		})
+		l := newOptions(tt.opts).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Path = tt.path
+		if req.RequestContext.Stage != "prod" {
+			t.Fatalf("unexpected stage: want %q, got %q", "prod", req.RequestContext.Stage)
+		}
+		if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if !called {
+			t.Errorf("%s: the handler is not called", tt.name)
+		}
+	}
+}
+
+func TestWithRawPath(t *testing.T) {
+	tests := []struct {
+		name           string
+		opts           []Option
+		rawPath        string
+		httpPath       string
+		wantPath       string
+		wantRequestURI string
+	}{
+		{"base path mapping", nil, "/api/hello", "/hello", "/hello", "/api/hello"},
+		{"base path mapping with raw path", []Option{WithRawPath()}, "/api/hello", "/hello", "/api/hello", "/api/hello"},
+		{"escaped raw path", []Option{WithRawPath()}, "/api/foo%2Fbar", "/foo/bar", "/api/foo/bar", "/api/foo%2Fbar"},
+		{"raw path with prefix strip", []Option{WithRawPath(), WithPathPrefixStrip("/api")}, "/api/hello", "/hello", "/hello", "/hello"},
+		{"same paths", []Option{WithRawPath()}, "/hello", "/hello", "/hello", "/hello"},
+	}
+	for _, tt := range tests {
+		var called bool
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			if r.URL.Path != tt.wantPath {
+				t.Errorf("%s: unexpected path: want %q, got %q", tt.name, tt.wantPath, r.URL.Path)
+			}
+			if r.RequestURI != tt.wantRequestURI {
+				t.Errorf("%s: unexpected request uri: want %q, got %q", tt.name, tt.wantRequestURI, r.RequestURI)
+			}
+		})
+		l := newOptions(tt.opts).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RawPath = tt.rawPath
+		req.RawQueryString = ""
+		req.RequestContext.HTTP.Path = tt.httpPath
+		if _, err := l.lambdaHandler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if !called {
+			t.Errorf("%s: the handler is not called", tt.name)
+		}
+	}
+}
+
+func TestWithJSONContentTypeDetection(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		body string
+		want string
+	}{
+		{"object", []Option{WithJSONContentTypeDetection()}, ` {"hello":"world"}`, "application/json"},
+		{"array", []Option{WithJSONContentTypeDetection()}, `[1, 2, 3]`, "application/json"},
+		{"invalid json", []Option{WithJSONContentTypeDetection()}, `{"hello":`, "text/plain; charset=utf-8"},
+		{"string", []Option{WithJSONContentTypeDetection()}, `"hello"`, "text/plain; charset=utf-8"},
+		{"disabled", nil, `{"hello":"world"}`, "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, tt.body)
+		})
+		l := newOptions(tt.opts).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Headers["Content-Type"]; got != tt.want {
+			t.Errorf("%s: unexpected content type: want %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestWithResponseBase64Encoding(t *testing.T) {
+	data := []byte{0xfb, 0xff, 0xfe, 0x00}
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"default", nil, "+//+AA=="},
+		{"url", []Option{WithResponseBase64Encoding(base64.URLEncoding)}, "-__-AA=="},
+		{"raw url", []Option{WithResponseBase64Encoding(base64.RawURLEncoding)}, "-__-AA"},
+	}
+	for _, tt := range tests {
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = w.Write(data)
+		})
+		l := newOptions(tt.opts).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.IsBase64Encoded {
+			t.Errorf("%s: want base64 encoded, but not", tt.name)
+		}
+		if resp.Body != tt.want {
+			t.Errorf("%s: unexpected body: want %q, got %q", tt.name, tt.want, resp.Body)
+		}
+	}
+}
+
+func TestWithAlwaysBase64(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain", "hello world"},
+		{"application/json", `{"hello":"world"}`},
+		{"image/png", "\x89PNG\r\n\x1a\n"},
+		{"", "hello world"},
+	}
+	for _, tt := range tests {
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.contentType != "" {
+				w.Header().Set("Content-Type", tt.contentType)
+			}
+			_, _ = io.WriteString(w, tt.body)
+		})
+		l := newOptions([]Option{WithAlwaysBase64()}).newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.IsBase64Encoded {
+			t.Errorf("%q: want base64 encoded, but not", tt.contentType)
+		}
+		if want := base64.StdEncoding.EncodeToString([]byte(tt.body)); resp.Body != want {
+			t.Errorf("%q: unexpected body: want %q, got %q", tt.contentType, want, resp.Body)
+		}
+		if got := resp.Headers["Content-Type"]; got != tt.contentType {
+			t.Errorf("%q: unexpected content type: got %q", tt.contentType, got)
+		}
+	}
+}
+
+func TestWithStreamingSniffSize(t *testing.T) {
+	tests := []struct {
+		name        string
+		size        int
+		contentType string
+	}{
+		{"small prelude", 4, "text/plain; charset=utf-8"},
+		{"disabled", 0, "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			received := make(chan struct{})
+			l := newOptions([]Option{WithStreamingSniffSize(tt.size)}).newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if _, err := io.WriteString(w, "hello"); err != nil {
+					t.Error(err)
+				}
+				// the prelude is sent before the handler returns, without an explicit flush.
+				select {
+				case <-received:
+				case <-time.After(time.Second):
+					t.Error("the prelude is not sent")
+				}
+			}))
+			req, err := loadRequest("testdata/function-urls-get-request.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, w := io.Pipe()
+			if _, err := l.lambdaHandlerStreaming(context.Background(), req, w); err != nil {
+				t.Fatal(err)
+			}
+
+			// read the prelude.
+			br := bufio.NewReader(r)
+			var prelude []byte
+			for !bytes.HasSuffix(prelude, []byte("\x00\x00\x00\x00\x00\x00\x00\x00")) {
+				b, err := br.ReadByte()
+				if err != nil {
+					t.Fatal(err)
+				}
+				prelude = append(prelude, b)
+			}
+			close(received)
+
+			var resp streamingResponse
+			if err := json.Unmarshal(bytes.TrimRight(prelude, "\x00"), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.Headers["Content-Type"]; got != tt.contentType {
+				t.Errorf("unexpected Content-Type: want %q, got %q", tt.contentType, got)
+			}
+			body, err := io.ReadAll(br)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != "hello" {
+				t.Errorf("unexpected body: want %q, got %q", "hello", string(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+//go:build go1.20
+// +build go1.20
+
+package ridgenative
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestResponseController_Flush(t *testing.T) {
+	t.Run("buffered", func(t *testing.T) {
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			if _, err := io.WriteString(w, "hello"); err != nil {
+				t.Error(err)
+			}
+			if err := http.NewResponseController(w).Flush(); err != nil {
+				t.Error(err)
+			}
+			if _, err := io.WriteString(w, " world"); err != nil {
+				t.Error(err)
+			}
+		}))
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Body != "hello world" {
+			t.Errorf("unexpected body: want %q, got %q", "hello world", resp.Body)
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		flushed := make(chan struct{})
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			if _, err := io.WriteString(w, "hello"); err != nil {
+				t.Error(err)
+			}
+			if err := http.NewResponseController(w).Flush(); err != nil {
+				t.Error(err)
+			}
+
+			// wait for the client to receive the flushed data.
+			select {
+			case <-flushed:
+			case <-time.After(time.Second):
+				t.Error("the data is not flushed")
+			}
+
+			if _, err := io.WriteString(w, " world"); err != nil {
+				t.Error(err)
+			}
+		}))
+		r, w := io.Pipe()
+		_, err := l.lambdaHandlerStreaming(context.Background(), &request{
+			RequestContext: ProxyRequestContext{
+				HTTP: &ProxyRequestContextHTTP{
+					Path: "/",
+				},
+			},
+		}, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var data []byte
+		buf := make([]byte, 1024)
+		for !bytes.HasSuffix(data, []byte("hello")) {
+			n, err := r.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = append(data, buf[:n]...)
+		}
+		close(flushed)
+
+		rest, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(rest) != " world" {
+			t.Errorf("unexpected rest: want %q, got %q", " world", string(rest))
+		}
+	})
+
+	t.Run("streaming after the client is gone", func(t *testing.T) {
+		done := make(chan struct{})
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer close(done)
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = io.WriteString(w, "hello") // it may fail because the client is gone.
+			if err := http.NewResponseController(w).Flush(); err == nil {
+				t.Error("want error, got nil")
+			}
+		}))
+		r, w := io.Pipe()
+		r.Close()
+		_, err := l.lambdaHandlerStreaming(context.Background(), &request{
+			RequestContext: ProxyRequestContext{
+				HTTP: &ProxyRequestContextHTTP{
+					Path: "/",
+				},
+			},
+		}, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+	})
+}
@@ -4,23 +4,98 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/textproto"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
 )
 
 type lambdaFunction struct {
-	mux http.Handler
+	mux          http.Handler
+	logger       Logger
+	isBinaryType func(contentType string) bool
+	compression  bool
+
+	// responseEncoders are the encoders for the response compression in the order of preference.
+	responseEncoders []responseEncoder
+
+	// trustedProxyCount is the number of the proxies in front of the function
+	// whose X-Forwarded-For entries are trusted.
+	trustedProxyCount int
+
+	// recoverHandler handles the panics in the handler.
+	recoverHandler func(w http.ResponseWriter, r *http.Request, v any)
+
+	// badRequestResponse enables responding with 400 Bad Request to malformed events.
+	badRequestResponse bool
+
+	// maxRequestBodySize is the maximum size of the request bodies.
+	// Zero means unlimited.
+	maxRequestBodySize int64
+
+	// pathPrefix is the prefix stripped from the request paths.
+	// Empty means no prefix is stripped.
+	pathPrefix string
+
+	// stageStrip enables stripping the stage of API Gateway REST APIs from the request paths.
+	stageStrip bool
+
+	// rawPath makes the paths of the payload format version 2.0 requests derived from rawPath
+	// instead of requestContext.http.path.
+	rawPath bool
+
+	// detectJSON enables detecting JSON bodies in the content type detection.
+	detectJSON bool
+
+	// base64Encoding is the encoding of the binary response bodies.
+	base64Encoding *base64.Encoding
+
+	// alwaysBase64 makes all the response bodies binary.
+	alwaysBase64 bool
+
+	// requestDecompression enables decompression of the request bodies.
+	requestDecompression bool
+
+	// suppressSuperfluousLog disables the warning of superfluous WriteHeader calls.
+	suppressSuperfluousLog bool
+
+	// streamingSniffLen is the maximum length of the body buffered for content-type detection in the streaming mode.
+	streamingSniffLen int
+
+	// streamingContentLength keeps the Content-Length header set by the handler in the streaming mode.
+	streamingContentLength bool
+
+	// disableMultiValueHeaders disables multiValueHeaders in the responses for API Gateway REST APIs.
+	disableMultiValueHeaders bool
+
+	// healthCheckPath is the path of the health check requests.
+	// Empty means the health check is disabled.
+	healthCheckPath string
+
+	// accessLog is the destination of the access logs.
+	accessLog   io.Writer
+	accessLogMu sync.Mutex
+
+	// mangledBodyWarning logs the warning of warnMangledBody only once.
+	mangledBodyWarning sync.Once
 }
 
 type request struct {
@@ -33,7 +108,7 @@ type request struct {
 	MultiValueHeaders               map[string][]string `json:"multiValueHeaders,omitempty"`
 	IsBase64Encoded                 bool                `json:"isBase64Encoded"`
 	Body                            string              `json:"body"`
-	RequestContext                  requestContext      `json:"requestContext"`
+	RequestContext                  ProxyRequestContext `json:"requestContext"`
 
 	// for API Gateway events
 	Resource       string            `json:"resource"`
@@ -45,25 +120,116 @@ type request struct {
 	RawPath        string   `json:"rawPath"`
 	RawQueryString string   `json:"rawQueryString"`
 	Cookies        []string `json:"cookies"`
+
+	// queryKeys is the keys of the query string parameters in the order of the event.
+	queryKeys []string
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+// It records the order of the query string parameters that Go maps don't keep.
+func (r *request) UnmarshalJSON(data []byte) error {
+	type requestAlias request
+	var v struct {
+		*requestAlias
+		QueryStringParameters           json.RawMessage `json:"queryStringParameters"`
+		MultiValueQueryStringParameters json.RawMessage `json:"multiValueQueryStringParameters"`
+	}
+	*r = request{}
+	v.requestAlias = (*requestAlias)(r)
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	var err error
+	if len(v.QueryStringParameters) > 0 {
+		if err := json.Unmarshal(v.QueryStringParameters, &r.QueryStringParameters); err != nil {
+			return err
+		}
+		r.queryKeys, err = objectKeys(v.QueryStringParameters)
+		if err != nil {
+			return err
+		}
+	}
+	if len(v.MultiValueQueryStringParameters) > 0 {
+		if err := json.Unmarshal(v.MultiValueQueryStringParameters, &r.MultiValueQueryStringParameters); err != nil {
+			return err
+		}
+		if len(r.MultiValueQueryStringParameters) > 0 {
+			// the keys of multiValueQueryStringParameters come first,
+			// and then the keys only in queryStringParameters.
+			keys, err := objectKeys(v.MultiValueQueryStringParameters)
+			if err != nil {
+				return err
+			}
+			r.queryKeys = append(keys, r.queryKeys...)
+		}
+	}
+	return nil
+}
+
+// objectKeys returns the keys of the JSON object in order.
+// It returns nil if data is not an object, such as null.
+func objectKeys(data []byte) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok != json.Delim('{') {
+		return nil, nil
+	}
+	var keys []string
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		keys = append(keys, key)
+
+		// skip the value
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
 }
 
-type requestContext struct {
+// ProxyRequestContext contains the information to identify the AWS account and resources invoking the Lambda function.
+// It is the requestContext field of the event.
+type ProxyRequestContext struct {
 	// for API Gateway events
 	AccountID    string                 `json:"accountId"`
 	ResourceID   string                 `json:"resourceId"`
 	Stage        string                 `json:"stage"`
 	RequestID    string                 `json:"requestId"`
-	Identity     requestIdentity        `json:"identity"`
+	Identity     ProxyRequestIdentity   `json:"identity"`
 	ResourcePath string                 `json:"resourcePath"`
 	Authorizer   map[string]interface{} `json:"authorizer"`
 	HTTPMethod   string                 `json:"httpMethod"`
 	APIID        string                 `json:"apiId"` // The API Gateway rest API Id
+	DomainName   string                 `json:"domainName"`
 
 	// for API Gateway v2 events
-	HTTP *requestContextHTTP `json:"http"`
+	HTTP *ProxyRequestContextHTTP `json:"http"`
+
+	// JWT is the result of the JWT authorizer of API Gateway HTTP APIs.
+	// It is decoded from Authorizer["jwt"] of API Gateway v2 events.
+	JWT *ProxyRequestContextJWT `json:"-"`
+
+	// for ALB events
+	ELB *ProxyRequestContextELB `json:"elb"`
+
+	// for API Gateway WebSocket events
+	RouteKey     string `json:"routeKey"`
+	EventType    string `json:"eventType"`
+	ConnectionID string `json:"connectionId"`
 }
 
-type requestContextHTTP struct {
+// ProxyRequestContextHTTP contains the information about the HTTP request.
+// It is available only in API Gateway v2 events and Lambda Function URLs.
+type ProxyRequestContextHTTP struct {
 	Method    string `json:"method"`
 	Path      string `json:"path"`
 	Protocol  string `json:"protocol"`
@@ -71,8 +237,21 @@ type requestContextHTTP struct {
 	UserAgent string `json:"userAgent"`
 }
 
-// apiIGatewayRequestIdentity contains identity information for the request caller.
-type requestIdentity struct {
+// ProxyRequestContextJWT contains the claims and the scopes verified by the JWT authorizer.
+// It is requestContext.authorizer.jwt of API Gateway v2 events.
+type ProxyRequestContextJWT struct {
+	Claims map[string]string `json:"claims"`
+	Scopes []string          `json:"scopes"`
+}
+
+// ProxyRequestContextELB contains the information about the target group of ALB.
+// It is available only in ALB events.
+type ProxyRequestContextELB struct {
+	TargetGroupARN string `json:"targetGroupArn"`
+}
+
+// ProxyRequestIdentity contains identity information for the request caller.
+type ProxyRequestIdentity struct {
 	CognitoIdentityPoolID         string `json:"cognitoIdentityPoolId"`
 	AccountID                     string `json:"accountId"`
 	CognitoIdentityID             string `json:"cognitoIdentityId"`
@@ -88,56 +267,170 @@ type requestIdentity struct {
 	User                          string `json:"user"`
 }
 
+// isV2Request reports whether r is an event of the payload format version 2.0,
+// which is sent by API Gateway HTTP APIs and Lambda Function URLs.
+// It depends only on the version field,
+// because HTTP APIs configured with the payload format version 1.0 may send requestContext.http.
+// The events without the version field, such as the events of API Gateway REST APIs and ALB, are version 1.0.
 func isV2Request(r *request) bool {
 	return r.Version == "2" || strings.HasPrefix(r.Version, "2.")
 }
 
-func (f *lambdaFunction) httpRequestV1(ctx context.Context, r *request) (*http.Request, error) {
-	// decode header
-	var headers http.Header
+// isALBRequest reports whether r is an event of ALB.
+func isALBRequest(r *request) bool {
+	return r.RequestContext.ELB != nil
+}
+
+// the headers that carry the metadata of API Gateway WebSocket events.
+const (
+	headerRouteKey     = "X-Ridgenative-Route-Key"
+	headerEventType    = "X-Ridgenative-Event-Type"
+	headerConnectionID = "X-Ridgenative-Connection-Id"
+)
+
+func isWebSocketRequest(r *request) bool {
+	return r.RequestContext.ConnectionID != "" && r.RequestContext.EventType != ""
+}
+
+// decodeHeadersV1 decodes the headers of API Gateway v1, ALB, and API Gateway WebSocket events.
+func decodeHeadersV1(r *request) http.Header {
 	if len(r.MultiValueHeaders) > 0 {
-		headers = make(http.Header, len(r.MultiValueHeaders))
+		headers := make(http.Header, len(r.MultiValueHeaders))
 		for k, v := range r.MultiValueHeaders {
-			headers[textproto.CanonicalMIMEHeaderKey(k)] = v
+			// the keys may differ only in case, e.g. "x-forwarded-for" and "X-Forwarded-For".
+			// append the values not to lose them, and keep the order of the values of each key.
+			key := textproto.CanonicalMIMEHeaderKey(k)
+			headers[key] = append(headers[key], v...)
 		}
-	} else {
-		// fall back to headers
-		headers = make(http.Header, len(r.Headers))
-		for k, v := range r.Headers {
-			headers[textproto.CanonicalMIMEHeaderKey(k)] = []string{v}
+		return headers
+	}
+
+	// fall back to headers
+	headers := make(http.Header, len(r.Headers))
+	for k, v := range r.Headers {
+		key := textproto.CanonicalMIMEHeaderKey(k)
+		headers[key] = append(headers[key], v)
+	}
+	return headers
+}
+
+// decodeQueryV1 decodes the query string of API Gateway v1, ALB, and API Gateway WebSocket events.
+// The events may have both queryStringParameters and multiValueQueryStringParameters,
+// and they may disagree, so they are merged.
+// multiValueQueryStringParameters takes precedence for the keys in both.
+func decodeQueryV1(r *request) url.Values {
+	if len(r.MultiValueQueryStringParameters) == 0 && len(r.QueryStringParameters) == 0 {
+		return nil
+	}
+	values := make(url.Values, len(r.MultiValueQueryStringParameters)+len(r.QueryStringParameters))
+	for k, v := range r.MultiValueQueryStringParameters {
+		values[k] = v
+	}
+	for k, v := range r.QueryStringParameters {
+		if _, ok := values[k]; !ok {
+			values[k] = []string{v}
 		}
 	}
+	return values
+}
+
+// encodeQueryV1 encodes the query string of API Gateway v1, ALB, and API Gateway WebSocket events.
+//
+// These events don't have the raw query string, so the original percent-encoding is lost,
+// and the values of the same key are grouped together.
+// The keys with empty values are encoded without "=", such as "?flag".
+// The order of the keys is the same as the event if it is known, otherwise the keys are sorted.
+func encodeQueryV1(r *request) string {
+	values := decodeQueryV1(r)
+	if len(values) == 0 {
+		return ""
+	}
 
-	// decode query string
-	var values url.Values
-	if len(r.MultiValueQueryStringParameters) > 0 {
-		values = make(url.Values, len(r.MultiValueQueryStringParameters))
-		for k, v := range r.MultiValueQueryStringParameters {
-			values[k] = v
+	keys := make([]string, 0, len(values))
+	seen := make(map[string]struct{}, len(values))
+	for _, k := range r.queryKeys {
+		if _, ok := values[k]; !ok {
+			continue
 		}
-	} else if len(r.QueryStringParameters) > 0 {
-		// fall back to queryStringParameters
-		values = make(url.Values, len(r.QueryStringParameters))
-		for k, v := range r.QueryStringParameters {
-			values[k] = []string{v}
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		keys = append(keys, k)
+	}
+	if len(keys) < len(values) {
+		rest := make([]string, 0, len(values)-len(keys))
+		for k := range values {
+			if _, ok := seen[k]; !ok {
+				rest = append(rest, k)
+			}
+		}
+		sort.Strings(rest)
+		keys = append(keys, rest...)
+	}
+
+	var buf strings.Builder
+	for _, k := range keys {
+		keyEscaped := url.QueryEscape(k)
+		for _, v := range values[k] {
+			if buf.Len() > 0 {
+				buf.WriteByte('&')
+			}
+			buf.WriteString(keyEscaped)
+			if v == "" {
+				// the event can't distinguish "?flag" from "?flag=",
+				// so the valueless form is used, and url.ParseQuery decodes both into "".
+				continue
+			}
+			buf.WriteByte('=')
+			buf.WriteString(url.QueryEscape(v))
 		}
 	}
+	return buf.String()
+}
+
+// isLambdaAuthorizer reports whether authorizer is the result of custom Lambda authorizers.
+// They always set principalId, while the other authorizers, such as Amazon Cognito user pool authorizers, don't.
+func isLambdaAuthorizer(authorizer map[string]interface{}) bool {
+	_, ok := authorizer["principalId"]
+	return ok
+}
+
+func (f *lambdaFunction) httpRequestV1(ctx context.Context, r *request) (*http.Request, error) {
+	headers := decodeHeadersV1(r)
+	setTraceID(ctx, headers)
+	query := encodeQueryV1(r)
 
 	// build uri
-	uri := r.Path
-	if len(values) > 0 {
-		uri = uri + "?" + values.Encode()
+	// the path may contain the query string if the integration is misconfigured.
+	// the query parameters of the event take precedence over it, to avoid duplicating them.
+	uri, pathQuery, _ := strings.Cut(r.Path, "?")
+	if query == "" {
+		query = pathQuery
+	}
+	if query != "" {
+		uri = uri + "?" + query
 	}
 	u, err := url.Parse(uri)
 	if err != nil {
-		return nil, err
+		return nil, &requestError{statusCode: http.StatusBadRequest, err: err}
 	}
+	host := requestHost(headers, r)
+	u.Host = host
+	u.Scheme = requestScheme(headers)
 
 	// build body
 	body, contentLength, err := f.decodeBody(r)
 	if err != nil {
 		return nil, err
 	}
+	body, contentLength, err = f.decompressBody(headers, body, contentLength)
+	if err != nil {
+		return nil, err
+	}
+	reconcileContentLength(headers, contentLength)
+	removeExpectContinue(headers)
+	removeRequestHopByHopHeaders(headers)
 
 	req := &http.Request{
 		Method:        r.HTTPMethod,
@@ -145,18 +438,45 @@ func (f *lambdaFunction) httpRequestV1(ctx context.Context, r *request) (*http.R
 		ProtoMajor:    1,
 		ProtoMinor:    0,
 		Header:        headers,
-		RemoteAddr:    r.RequestContext.Identity.SourceIP,
+		RemoteAddr:    remoteAddr(f.clientIP(headers, r.RequestContext.Identity.SourceIP)),
 		ContentLength: contentLength,
 		Body:          body,
 		RequestURI:    uri,
 		URL:           u,
-		Host:          headers.Get("Host"),
+		Host:          host,
+		Trailer:       make(http.Header),
+	}
+	if u.Scheme == "https" {
+		// API Gateway and ALB terminate TLS connections,
+		// so we don't have any details of the connection.
+		req.TLS = &tls.ConnectionState{
+			HandshakeComplete: true,
+		}
+	}
+	ctx = context.WithValue(ctx, requestContextKey, &r.RequestContext)
+	if r.StageVariables != nil {
+		ctx = context.WithValue(ctx, stageVariablesContextKey, r.StageVariables)
+	}
+	if r.PathParameters != nil {
+		ctx = context.WithValue(ctx, pathParametersContextKey, r.PathParameters)
 	}
+	if isLambdaAuthorizer(r.RequestContext.Authorizer) {
+		// the context of custom Lambda authorizers is the authorizer field itself in the payload format version 1.0.
+		ctx = context.WithValue(ctx, authorizerContextKey, r.RequestContext.Authorizer)
+	}
+	if f.stageStrip && r.RequestContext.Stage != "" {
+		stripPathPrefix(req, "/"+r.RequestContext.Stage)
+	}
+	stripPathPrefix(req, f.pathPrefix)
 	req = req.WithContext(ctx)
 	return req, nil
 }
 
 func (f *lambdaFunction) httpRequestV2(ctx context.Context, r *request) (*http.Request, error) {
+	if r.RequestContext.HTTP == nil {
+		return nil, &requestError{statusCode: http.StatusBadRequest, err: errMissingRequestContextHTTP}
+	}
+
 	// build headers
 	headers := make(http.Header, len(r.Headers))
 	for k, v := range r.Headers {
@@ -167,9 +487,14 @@ func (f *lambdaFunction) httpRequestV2(ctx context.Context, r *request) (*http.R
 	if len(r.Cookies) > 0 {
 		headers.Set("Cookie", strings.Join(r.Cookies, ";"))
 	}
+	setTraceID(ctx, headers)
 
 	// build uri
 	uri := r.RequestContext.HTTP.Path
+	if f.rawPath && r.RawPath != "" {
+		// rawPath may differ from requestContext.http.path, e.g. it includes the base path of a custom domain name.
+		uri = r.RawPath
+	}
 	rawURI := r.RawPath
 	if r.RawQueryString != "" {
 		uri = uri + "?" + r.RawQueryString
@@ -177,65 +502,447 @@ func (f *lambdaFunction) httpRequestV2(ctx context.Context, r *request) (*http.R
 	}
 	u, err := url.Parse(uri)
 	if err != nil {
-		return nil, err
+		return nil, &requestError{statusCode: http.StatusBadRequest, err: err}
 	}
+	// keep the original encoding of the path, such as %2F.
+	// EscapedPath ignores RawPath if it is not a valid encoding of Path.
+	u.RawPath = r.RawPath
+	host := requestHost(headers, r)
+	u.Host = host
+	u.Scheme = requestScheme(headers)
 
 	// build body
 	body, contentLength, err := f.decodeBody(r)
 	if err != nil {
 		return nil, err
 	}
+	body, contentLength, err = f.decompressBody(headers, body, contentLength)
+	if err != nil {
+		return nil, err
+	}
+	reconcileContentLength(headers, contentLength)
+	removeExpectContinue(headers)
+	removeRequestHopByHopHeaders(headers)
 
+	proto, major, minor := protocolVersion(r.RequestContext.HTTP.Protocol)
 	req := &http.Request{
 		Method:        r.RequestContext.HTTP.Method,
+		Proto:         proto,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        headers,
+		RemoteAddr:    remoteAddr(f.clientIP(headers, r.RequestContext.HTTP.SourceIP)),
+		ContentLength: contentLength,
+		Body:          body,
+		RequestURI:    rawURI,
+		URL:           u,
+		Host:          host,
+		Trailer:       make(http.Header),
+	}
+	if u.Scheme == "https" {
+		// API Gateway and ALB terminate TLS connections,
+		// so we don't have any details of the connection.
+		req.TLS = &tls.ConnectionState{
+			HandshakeComplete: true,
+		}
+	}
+	if jwt, ok := r.RequestContext.Authorizer["jwt"].(map[string]interface{}); ok {
+		r.RequestContext.JWT = decodeJWTAuthorizer(jwt)
+	}
+	ctx = context.WithValue(ctx, requestContextKey, &r.RequestContext)
+	if lambda, ok := r.RequestContext.Authorizer["lambda"].(map[string]interface{}); ok {
+		ctx = context.WithValue(ctx, authorizerContextKey, lambda)
+	}
+	stripPathPrefix(req, f.pathPrefix)
+	req = req.WithContext(ctx)
+	return req, nil
+}
+
+// decodeJWTAuthorizer decodes the authorizer.jwt field of the payload format version 2.0.
+func decodeJWTAuthorizer(jwt map[string]interface{}) *ProxyRequestContextJWT {
+	v := &ProxyRequestContextJWT{}
+	if claims, ok := jwt["claims"].(map[string]interface{}); ok {
+		v.Claims = make(map[string]string, len(claims))
+		for key, value := range claims {
+			if s, ok := value.(string); ok {
+				v.Claims[key] = s
+			} else if data, err := json.Marshal(value); err == nil {
+				// API Gateway sends the claims as strings, but just in case.
+				v.Claims[key] = string(data)
+			}
+		}
+	}
+	if scopes, ok := jwt["scopes"].([]interface{}); ok {
+		v.Scopes = make([]string, 0, len(scopes))
+		for _, scope := range scopes {
+			if s, ok := scope.(string); ok {
+				v.Scopes = append(v.Scopes, s)
+			}
+		}
+	}
+	return v
+}
+
+// setTraceID sets the trace id of the invoke to the X-Amzn-Trace-Id header
+// for the HTTP-level instrumentations, such as OpenTelemetry.
+// The header sent by the client takes precedence.
+func setTraceID(ctx context.Context, headers http.Header) {
+	if headers.Get("X-Amzn-Trace-Id") != "" {
+		return
+	}
+	// nolint:staticcheck
+	if traceID, _ := ctx.Value("x-amzn-trace-id").(string); traceID != "" {
+		headers.Set("X-Amzn-Trace-Id", traceID)
+	}
+}
+
+// stripPathPrefix removes prefix from the path of r if the path is prefix or starts with prefix + "/".
+// The stripped path is always absolute.
+func stripPathPrefix(r *http.Request, prefix string) {
+	if prefix == "" {
+		return
+	}
+	p, ok := cutPathPrefix(r.URL.Path, prefix)
+	if !ok {
+		return
+	}
+	r.URL.Path = p
+	if r.URL.RawPath != "" {
+		if rp, ok := cutPathPrefix(r.URL.RawPath, prefix); ok {
+			r.URL.RawPath = rp
+		} else {
+			r.URL.RawPath = ""
+		}
+	}
+	r.RequestURI = r.URL.RequestURI()
+}
+
+func cutPathPrefix(p, prefix string) (string, bool) {
+	rest := strings.TrimPrefix(p, prefix)
+	if len(rest) == len(p) {
+		return p, false
+	}
+	if rest == "" {
+		return "/", true
+	}
+	if rest[0] != '/' {
+		// the prefix matches only a part of a segment, such as "/prod" and "/products".
+		return p, false
+	}
+	return rest, true
+}
+
+// httpRequestWebSocket converts an API Gateway WebSocket event into a POST request to "/".
+// The route key, the event type, and the connection id of the event are passed
+// via X-Ridgenative-Route-Key, X-Ridgenative-Event-Type, and X-Ridgenative-Connection-Id headers.
+func (f *lambdaFunction) httpRequestWebSocket(ctx context.Context, r *request) (*http.Request, error) {
+	headers := decodeHeadersV1(r)
+	setTraceID(ctx, headers)
+	headers.Set(headerRouteKey, r.RequestContext.RouteKey)
+	headers.Set(headerEventType, r.RequestContext.EventType)
+	headers.Set(headerConnectionID, r.RequestContext.ConnectionID)
+	query := encodeQueryV1(r)
+
+	// build uri
+	uri := "/"
+	if query != "" {
+		uri = uri + "?" + query
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, &requestError{statusCode: http.StatusBadRequest, err: err}
+	}
+	host := requestHost(headers, r)
+	u.Host = host
+	u.Scheme = "https" // API Gateway WebSocket APIs accept only wss.
+
+	// build body
+	body, contentLength, err := f.decodeBody(r)
+	if err != nil {
+		return nil, err
+	}
+	body, contentLength, err = f.decompressBody(headers, body, contentLength)
+	if err != nil {
+		return nil, err
+	}
+	reconcileContentLength(headers, contentLength)
+	removeExpectContinue(headers)
+	removeRequestHopByHopHeaders(headers)
+
+	req := &http.Request{
+		Method:        http.MethodPost,
 		Proto:         "HTTP/1.0",
 		ProtoMajor:    1,
 		ProtoMinor:    0,
 		Header:        headers,
-		RemoteAddr:    r.RequestContext.HTTP.SourceIP,
+		RemoteAddr:    remoteAddr(f.clientIP(headers, r.RequestContext.Identity.SourceIP)),
 		ContentLength: contentLength,
 		Body:          body,
-		RequestURI:    rawURI,
+		RequestURI:    uri,
 		URL:           u,
-		Host:          headers.Get("Host"),
+		Host:          host,
+		Trailer:       make(http.Header),
+		TLS: &tls.ConnectionState{
+			HandshakeComplete: true,
+		},
 	}
+	ctx = context.WithValue(ctx, requestContextKey, &r.RequestContext)
 	req = req.WithContext(ctx)
 	return req, nil
 }
 
+// protocolVersion parses the protocol of the request context.
+// It defaults to HTTP/1.1 if the protocol is absent or invalid.
+func protocolVersion(protocol string) (proto string, major, minor int) {
+	major, minor, ok := http.ParseHTTPVersion(protocol)
+	if !ok {
+		return "HTTP/1.1", 1, 1
+	}
+	return protocol, major, minor
+}
+
+// errRequestBodyTooLarge is returned when the request body exceeds the limit given by WithMaxRequestBodySize.
+var errRequestBodyTooLarge = errors.New("ridgenative: request body too large")
+
+// requestError is an error caused by the event.
+// It is responded with the status code instead of failing the invoke.
+type requestError struct {
+	statusCode int
+	err        error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+// requestErrorStatus returns the status code for err if it should be responded to the client.
+// 400 Bad Request is responded only if WithBadRequestResponse is enabled.
+func (f *lambdaFunction) requestErrorStatus(err error) (int, bool) {
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) {
+		return 0, false
+	}
+	if reqErr.statusCode == http.StatusBadRequest && !f.badRequestResponse {
+		return 0, false
+	}
+	return reqErr.statusCode, true
+}
+
+// remoteAddr returns the network address of the client in "host:port" form.
+// The events don't contain the source port, so the port is always 0.
+// It returns an empty string if the source IP is not available, e.g. in ALB events.
+func remoteAddr(sourceIP string) string {
+	if sourceIP == "" {
+		return ""
+	}
+	return net.JoinHostPort(sourceIP, "0")
+}
+
+// clientIP returns the IP address of the client.
+// If trustedProxyCount is positive, it is the n-th rightmost entry of the X-Forwarded-For header,
+// because each trusted proxy appends the address of its peer to the header.
+// Otherwise, or if the header is invalid, it is sourceIP.
+func (f *lambdaFunction) clientIP(headers http.Header, sourceIP string) string {
+	if f.trustedProxyCount <= 0 {
+		return sourceIP
+	}
+
+	var entries []string
+	for _, v := range headers.Values("X-Forwarded-For") {
+		for _, entry := range strings.Split(v, ",") {
+			entries = append(entries, strings.TrimSpace(entry))
+		}
+	}
+	if len(entries) == 0 {
+		return sourceIP
+	}
+
+	i := len(entries) - f.trustedProxyCount
+	if i < 0 {
+		// all entries are appended by the trusted proxies.
+		i = 0
+	}
+	if net.ParseIP(entries[i]) == nil {
+		return sourceIP
+	}
+	return entries[i]
+}
+
+// requestHost returns the host name of the request.
+// It falls back to the domainName of the request context if the Host header is absent.
+func requestHost(headers http.Header, r *request) string {
+	if h := headers.Get("Host"); h != "" {
+		return h
+	}
+	return r.RequestContext.DomainName
+}
+
+// requestScheme returns the scheme of the request.
+// It respects the first value of the X-Forwarded-Proto header, and defaults to https
+// because API Gateway and Lambda Function URLs accept only HTTPS.
+// The values other than http and https are ignored.
+func requestScheme(headers http.Header) string {
+	proto := headers.Get("X-Forwarded-Proto")
+	if i := strings.IndexByte(proto, ','); i >= 0 {
+		proto = proto[:i]
+	}
+	if strings.EqualFold(strings.TrimSpace(proto), "http") {
+		return "http"
+	}
+	return "https"
+}
+
 func (f *lambdaFunction) decodeBody(r *request) (body io.ReadCloser, contentLength int64, err error) {
-	if r.Body == "" {
+	data := r.Body
+	if r.IsBase64Encoded {
+		// the white spaces around the base64-encoded body are meaningless.
+		data = strings.TrimSpace(data)
+	}
+	if data == "" {
 		body = http.NoBody
 		return
 	}
+	if r.IsBase64Encoded && f.badRequestResponse {
+		// the body is decoded lazily, so the errors are usually reported on reading the body.
+		// validate it here to respond with 400 Bad Request.
+		if _, err = io.Copy(io.Discard, base64.NewDecoder(base64Encoding(data), strings.NewReader(data))); err != nil {
+			err = &requestError{statusCode: http.StatusBadRequest, err: fmt.Errorf("ridgenative: failed to decode the body: %w", err)}
+			return
+		}
+	}
 
 	var reader io.Reader
 	if r.IsBase64Encoded {
-		var b []byte
-		b, err = base64.StdEncoding.DecodeString(r.Body)
-		if err != nil {
-			return
-		}
-		contentLength = int64(len(b))
-		reader = bytes.NewReader(b)
+		// decode the body lazily to reduce memory usage for large bodies.
+		contentLength = int64(base64DecodedLen(data))
+		reader = base64.NewDecoder(base64Encoding(data), strings.NewReader(data))
 	} else {
-		contentLength = int64(len(r.Body))
-		reader = strings.NewReader(r.Body)
+		f.warnMangledBody(data)
+		contentLength = int64(len(data))
+		reader = strings.NewReader(data)
+	}
+	if f.maxRequestBodySize > 0 && contentLength > f.maxRequestBodySize {
+		err = &requestError{statusCode: http.StatusRequestEntityTooLarge, err: errRequestBodyTooLarge}
+		return
 	}
 	body = io.NopCloser(reader)
 	return
 }
 
+// warnMangledBody logs a warning if the text body is likely to be a binary mangled by API Gateway.
+// API Gateway encodes the body in base64 only if its content type is one of the binary media types,
+// otherwise it sends the body as text, and the invalid UTF-8 sequences are lost.
+// The invalid sequences are replaced with U+FFFD on decoding the event, so they are detected as U+FFFD.
+// The text may contain U+FFFD legitimately, so the warning is logged only once per function instance.
+func (f *lambdaFunction) warnMangledBody(data string) {
+	if utf8.ValidString(data) && !strings.ContainsRune(data, utf8.RuneError) {
+		return
+	}
+	f.mangledBodyWarning.Do(func() {
+		f.logger.Printf("ridgenative: the request body is not valid UTF-8 text, it may be a binary body mangled by API Gateway. " +
+			"add its content type to the binary media types of the API.")
+	})
+}
+
+// reconcileContentLength makes the Content-Length header agree with the length of the decoded body.
+// The header sent by the client may be wrong, for example, if the body is base64-encoded by the upstream.
+// The header is removed if the length is unknown, e.g. the body is decompressed.
+func reconcileContentLength(headers http.Header, contentLength int64) {
+	if _, ok := headers["Content-Length"]; !ok {
+		return
+	}
+	if contentLength < 0 {
+		headers.Del("Content-Length")
+		return
+	}
+	headers.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+}
+
+// removeExpectContinue removes the "Expect: 100-continue" header.
+// The client waits for 100 Continue before sending the body on a real server,
+// but the body of the event is already sent and buffered, so there is nothing to continue.
+// The header may confuse the middlewares that respond with 100 Continue or wait for it.
+func removeExpectContinue(headers http.Header) {
+	if strings.EqualFold(headers.Get("Expect"), "100-continue") {
+		headers.Del("Expect")
+	}
+}
+
+// base64Encoding returns the base64 encoding of s.
+// API Gateway sends the standard encoding with padding,
+// but some upstreams send the URL-safe encoding or drop the padding.
+func base64Encoding(s string) *base64.Encoding {
+	enc := base64.StdEncoding
+	if strings.ContainsAny(s, "-_") {
+		enc = base64.URLEncoding
+	}
+	if base64Len(s)%4 != 0 {
+		enc = enc.WithPadding(base64.NoPadding)
+	}
+	return enc
+}
+
+// base64Len returns the length of s excluding the newlines that the base64 decoders ignore.
+func base64Len(s string) int {
+	return len(s) - strings.Count(s, "\r") - strings.Count(s, "\n")
+}
+
+// base64DecodedLen returns the length in bytes of the base64-decoded data of s.
+// s may be padded or not.
+func base64DecodedLen(s string) int {
+	n := base64Len(s)
+	for i := 0; i < 2 && strings.HasSuffix(s, "="); i++ {
+		s = s[:len(s)-1]
+		n--
+	}
+	return n * 6 / 8
+}
+
 type responseWriter struct {
-	w           bytes.Buffer
-	isBinary    bool
-	wroteHeader bool
-	header      http.Header
-	statusCode  int
+	w            *bytes.Buffer
+	isBinary     bool
+	wroteHeader  bool
+	header       http.Header
+	statusCode   int
+	logger       Logger
+	isBinaryType func(contentType string) bool
+
+	// written is the number of bytes written by the handler.
+	written int64
+
+	// suppressSuperfluousLog disables the warning of superfluous WriteHeader calls.
+	suppressSuperfluousLog bool
+
+	// compression enables compression of the response body.
+	compression bool
+
+	// encoders are the encoders for compression in addition to gzip.
+	encoders []responseEncoder
+
+	// acceptEncoding is the Accept-Encoding header of the request.
+	acceptEncoding string
+
+	// detectJSON enables detecting JSON bodies in the content type detection.
+	detectJSON bool
+
+	// base64Encoding is the encoding of the binary response bodies.
+	base64Encoding *base64.Encoding
+
+	// alwaysBase64 makes all the response bodies binary.
+	alwaysBase64 bool
+
+	// isHead reports whether the request method is HEAD.
+	// The responses to HEAD requests may have Content-Length without the body.
+	isHead bool
 }
 
 type response struct {
-	StatusCode        int                 `json:"statusCode,omitempty"`
+	StatusCode        int                 `json:"statusCode"`
+	StatusDescription string              `json:"statusDescription,omitempty"`
 	Headers           map[string]string   `json:"headers,omitempty"`
 	MultiValueHeaders map[string][]string `json:"multiValueHeaders,omitempty"`
 	Body              string              `json:"body,omitempty"`
@@ -243,29 +950,80 @@ type response struct {
 	Cookies           []string            `json:"cookies,omitempty"`
 }
 
+// bufferPool is a pool of the buffers for the response bodies.
+var bufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	bufferPool.Put(buf)
+}
+
+// errMissingRequestContextHTTP is returned when the event of the payload format version 2.0 has no requestContext.http.
+var errMissingRequestContextHTTP = errors.New("ridgenative: requestContext.http is missing in the event")
+
+// errResponseSent is returned when the handler writes the body after the response is sent.
+var errResponseSent = errors.New("ridgenative: the response has already been sent")
+
 func newResponseWriter() *responseWriter {
 	return &responseWriter{
-		header: make(http.Header, 1),
+		w:            getBuffer(),
+		header:       make(http.Header, 1),
+		logger:       log.Default(),
+		isBinaryType: isBinaryContentType,
 	}
 }
 
-// relevantCaller searches the call stack for the first function outside of net/http.
+// newResponseWriter returns a new responseWriter for r configured by f.
+func (f *lambdaFunction) newResponseWriter(r *http.Request) *responseWriter {
+	rw := newResponseWriter()
+	rw.logger = f.logger
+	rw.isBinaryType = f.isBinaryType
+	rw.compression = f.compression
+	rw.encoders = f.responseEncoders
+	rw.detectJSON = f.detectJSON
+	rw.base64Encoding = f.base64Encoding
+	rw.alwaysBase64 = f.alwaysBase64
+	rw.suppressSuperfluousLog = f.suppressSuperfluousLog
+	if r != nil {
+		rw.acceptEncoding = r.Header.Get("Accept-Encoding")
+		rw.isHead = r.Method == http.MethodHead
+	}
+	return rw
+}
+
+// relevantCaller searches the call stack for the first function outside of net/http and ridgenative.
 // The purpose of this function is to provide more helpful error messages.
 func relevantCaller() runtime.Frame {
 	pc := make([]uintptr, 16)
 	n := runtime.Callers(1, pc)
 	frames := runtime.CallersFrames(pc[:n])
-	var frame runtime.Frame
 	for {
 		frame, more := frames.Next()
-		if !strings.HasPrefix(frame.Function, "github.com/shogo82148/ridgenative.") {
+		if !strings.HasPrefix(frame.Function, "net/http.") && !strings.HasPrefix(frame.Function, "github.com/shogo82148/ridgenative.") {
 			return frame
 		}
 		if !more {
-			break
+			return frame
 		}
 	}
-	return frame
+}
+
+// reset discards the response written so far.
+func (rw *responseWriter) reset() {
+	rw.w.Reset()
+	rw.header = make(http.Header, 1)
+	rw.wroteHeader = false
+	rw.statusCode = 0
+	rw.written = 0
 }
 
 func (rw *responseWriter) Header() http.Header {
@@ -274,8 +1032,10 @@ func (rw *responseWriter) Header() http.Header {
 
 func (rw *responseWriter) WriteHeader(code int) {
 	if rw.wroteHeader {
-		caller := relevantCaller()
-		log.Printf("ridgenative: superfluous response.WriteHeader call from %s (%s:%d)", caller.Function, path.Base(caller.File), caller.Line)
+		if !rw.suppressSuperfluousLog {
+			caller := relevantCaller()
+			rw.logger.Printf("ridgenative: superfluous response.WriteHeader call from %s (%s:%d)", caller.Function, path.Base(caller.File), caller.Line)
+		}
 		return
 	}
 	rw.statusCode = code
@@ -283,7 +1043,77 @@ func (rw *responseWriter) WriteHeader(code int) {
 }
 
 func (rw *responseWriter) Write(data []byte) (int, error) {
-	return rw.w.Write(data)
+	if rw.w == nil {
+		return 0, errResponseSent
+	}
+	n, err := rw.w.Write(data)
+	rw.written += int64(n)
+	return n, err
+}
+
+// BytesWritten returns the number of the body bytes written by the handler so far.
+// Middlewares can get it through an interface with the BytesWritten method.
+func (rw *responseWriter) BytesWritten() int64 {
+	return rw.written
+}
+
+// Flush implements http.Flusher.
+// It does nothing, because the response is sent after the handler returns in the buffered mode.
+// Use InvokeModeResponseStream for streaming the response.
+func (rw *responseWriter) Flush() {}
+
+// noFoldHeaders is the set of the headers that can't be folded into one line.
+// The %x2C (",") character is used by Set-Cookie in a way that conflicts with such folding,
+// and the challenges of WWW-Authenticate and Proxy-Authenticate may contain commas.
+var noFoldHeaders = map[string]struct{}{
+	"Set-Cookie":         {},
+	"Www-Authenticate":   {},
+	"Proxy-Authenticate": {},
+}
+
+// hopByHopHeaders are the hop-by-hop headers.
+// Connection is defined in RFC 7230 Section 6.1, and the others are listed in RFC 2616 Section 13.5.1,
+// or are widely used as such, e.g. Proxy-Connection.
+// They are meaningful only for a single connection, but Lambda manages the connection to the client,
+// so they are removed from both the requests and the responses.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// requestHopByHopHeaders are the hop-by-hop headers removed only from the requests.
+// They are hop-by-hop in RFC 2616 Section 13.5.1, as in httputil.ReverseProxy,
+// but Proxy-Authenticate is kept in the responses, because the handler may challenge the client with it.
+var requestHopByHopHeaders = []string{
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers, including the ones listed in the Connection header.
+func removeHopByHopHeaders(headers http.Header) {
+	for _, value := range headers.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				headers.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		headers.Del(name)
+	}
+}
+
+// removeRequestHopByHopHeaders is same as removeHopByHopHeaders, but it also removes requestHopByHopHeaders.
+func removeRequestHopByHopHeaders(headers http.Header) {
+	removeHopByHopHeaders(headers)
+	for _, name := range requestHopByHopHeaders {
+		headers.Del(name)
+	}
 }
 
 func (rw *responseWriter) lambdaResponseV1() (*response, error) {
@@ -292,9 +1122,9 @@ func (rw *responseWriter) lambdaResponseV1() (*response, error) {
 	// fall back to headers if multiValueHeaders is not available
 	h := make(map[string]string, len(rw.header))
 	for key, value := range rw.header {
-		if key == "Set-Cookie" {
-			// we can't fold Set-Cookie header, because the %x2C (",") character is used
-			// by Set-Cookie in a way that conflicts with such folding.
+		if _, ok := noFoldHeaders[key]; ok {
+			// the headers can't be folded, so send only the first value.
+			// multiValueHeaders has all the values.
 			if len(value) > 0 {
 				h[key] = value[0]
 			}
@@ -312,10 +1142,50 @@ func (rw *responseWriter) lambdaResponseV1() (*response, error) {
 	}, nil
 }
 
+// lambdaResponseV1SingleValue is same as lambdaResponseV1, but it doesn't have multiValueHeaders.
+func (rw *responseWriter) lambdaResponseV1SingleValue() (*response, error) {
+	resp, err := rw.lambdaResponseV1()
+	if err != nil {
+		return nil, err
+	}
+	rw.warnMultipleCookies()
+	resp.MultiValueHeaders = nil
+	return resp, nil
+}
+
+// lambdaResponseALB is same as lambdaResponseV1, but it adds statusDescription that ALB expects.
+// ALB uses either headers or multiValueHeaders depending on the configuration of the target group,
+// so the response has only the one that the request has.
+func (rw *responseWriter) lambdaResponseALB(multiValueHeaders bool) (*response, error) {
+	resp, err := rw.lambdaResponseV1()
+	if err != nil {
+		return nil, err
+	}
+	resp.StatusDescription = strings.TrimSpace(fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode)))
+	if multiValueHeaders {
+		resp.Headers = nil
+	} else {
+		rw.warnMultipleCookies()
+		resp.MultiValueHeaders = nil
+	}
+	return resp, nil
+}
+
+// warnMultipleCookies logs a warning if the response has multiple Set-Cookie headers,
+// but it is sent without multiValueHeaders.
+// Only the first cookie reaches the client in that case.
+func (rw *responseWriter) warnMultipleCookies() {
+	if n := len(rw.header["Set-Cookie"]); n > 1 {
+		rw.logger.Printf("ridgenative: only the first of %d Set-Cookie headers is sent, because multi-value headers are disabled", n)
+	}
+}
+
 func (rw *responseWriter) lambdaResponseV2() (*response, error) {
 	body := rw.encodeBody()
 
-	// multiValueHeaders is not available in V2; fall back to headers
+	// multiValueHeaders is not available in V2; fall back to headers.
+	// the headers that can't be folded, such as WWW-Authenticate, are folded anyway,
+	// because V2 has no way to send them separately, except Set-Cookie.
 	h := make(map[string]string, len(rw.header))
 	for key, value := range rw.header {
 		if key == "Set-Cookie" {
@@ -335,32 +1205,214 @@ func (rw *responseWriter) lambdaResponseV2() (*response, error) {
 	}, nil
 }
 
+func (rw *responseWriter) lambdaResponseWebSocket() (*response, error) {
+	body := rw.encodeBody()
+
+	// API Gateway WebSocket APIs don't support multiValueHeaders and cookies.
+	h := make(map[string]string, len(rw.header))
+	for key, value := range rw.header {
+		if key == "Set-Cookie" {
+			continue
+		}
+		h[key] = strings.Join(value, ", ")
+	}
+
+	return &response{
+		StatusCode:      rw.statusCode,
+		Headers:         h,
+		Body:            body,
+		IsBase64Encoded: rw.isBinary,
+	}, nil
+}
+
 func (rw *responseWriter) encodeBody() string {
 	if !rw.wroteHeader {
 		rw.WriteHeader(http.StatusOK)
 	}
+	removeHopByHopHeaders(rw.header)
+	if rw.statusCode == 0 {
+		// API Gateway rejects the response without the status code.
+		rw.statusCode = http.StatusOK
+	}
 
-	if typ := rw.header.Get("Content-Type"); typ != "" {
-		rw.isBinary = isBinary(rw.header)
-	} else {
+	if !bodyAllowedForStatus(rw.statusCode) {
+		return rw.emptyBody()
+	}
+	if rw.header.Get("X-Lambda-Http-Content-Encoding") == "base64" {
+		return rw.passThroughBase64()
+	}
+
+	if typ := rw.header.Get("Content-Type"); typ == "" && !rw.alwaysBase64 {
 		rw.detectContentType()
 	}
+	rw.checkContentLength()
+	if rw.compression {
+		// negotiate the encoding before discarding the body of HEAD responses,
+		// so that they have the same Content-Encoding and Vary as the GET responses.
+		rw.compress()
+	}
+	if rw.isHead {
+		rw.discardBody()
+	}
+	if rw.alwaysBase64 {
+		rw.isBinary = true
+	} else {
+		rw.isBinary = isBinaryWithFunc(rw.header, rw.isBinaryType)
+	}
 
+	// X-Lambda-Http-Content-Encoding is a hint for ridgenative, it is not for clients.
+	rw.header.Del("X-Lambda-Http-Content-Encoding")
+
+	var body string
 	if rw.isBinary {
-		return base64.StdEncoding.EncodeToString(rw.w.Bytes())
+		body = encodeBase64(rw.base64Encoding, rw.w.Bytes())
 	} else {
-		return rw.w.String()
+		body = rw.w.String()
+	}
+
+	// body is a copy of the buffer, so the buffer can be reused.
+	putBuffer(rw.w)
+	rw.w = nil
+	return body
+}
+
+// bodyAllowedForStatus reports whether a given response status code permits a body.
+// See RFC 7230, section 3.3.
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent:
+		return false
+	case status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// emptyBody discards the body for the status codes that don't permit a body.
+// The content type is not detected, because there is no content.
+func (rw *responseWriter) emptyBody() string {
+	if rw.w.Len() > 0 {
+		rw.logger.Printf("ridgenative: the body of the response with status %d is discarded", rw.statusCode)
+	}
+	rw.header.Del("X-Lambda-Http-Content-Encoding")
+	rw.isBinary = false
+	putBuffer(rw.w)
+	rw.w = nil
+	return ""
+}
+
+// discardBody discards the body written by the handler for HEAD requests.
+// The Content-Length header is set to the length of the body if the handler doesn't set it,
+// so that the response has the same headers as the GET response.
+// The compressed responses have no Content-Length, because compress has already discarded the body.
+func (rw *responseWriter) discardBody() {
+	if rw.header.Get("Content-Length") == "" && rw.w.Len() > 0 {
+		rw.header.Set("Content-Length", strconv.Itoa(rw.w.Len()))
+	}
+	rw.w.Reset()
+}
+
+// passThroughBase64 returns the body that the handler has already encoded in base64 as it is.
+// The handler marks it with the "X-Lambda-Http-Content-Encoding: base64" header.
+func (rw *responseWriter) passThroughBase64() string {
+	rw.header.Del("X-Lambda-Http-Content-Encoding")
+	if typ := rw.header.Get("Content-Type"); typ == "" {
+		// detect the content type from the decoded data.
+		// 684 bytes of base64 are decoded into 513 bytes, it is enough for http.DetectContentType.
+		data := rw.w.Bytes()
+		if len(data) > 684 {
+			data = data[:684]
+		}
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+		n, _ := base64.StdEncoding.Decode(decoded, data)
+		rw.header.Set("Content-Type", http.DetectContentType(decoded[:n]))
+	}
+	if rw.isHead {
+		// discard the body as discardBody does, but the length is the one of the decoded body.
+		if rw.header.Get("Content-Length") == "" && rw.w.Len() > 0 {
+			rw.header.Set("Content-Length", strconv.Itoa(base64DecodedLen(strings.TrimSpace(rw.w.String()))))
+		}
+		rw.isBinary = false
+		putBuffer(rw.w)
+		rw.w = nil
+		return ""
+	}
+	rw.isBinary = true
+	body := rw.w.String()
+	putBuffer(rw.w)
+	rw.w = nil
+	return body
+}
+
+// encodeBase64 is same as enc.EncodeToString, but it reduces allocations.
+// enc.EncodeToString allocates the encoded bytes and then copies them into a string,
+// while encodeBase64 encodes directly into the memory of the string.
+// The builder can't be reused, because the returned string shares its memory.
+// If enc is nil, base64.StdEncoding is used.
+func encodeBase64(enc *base64.Encoding, data []byte) string {
+	if enc == nil {
+		enc = base64.StdEncoding
+	}
+	var b strings.Builder
+	b.Grow(enc.EncodedLen(len(data)))
+
+	// encode 768 bytes into 1024 bytes at a time.
+	// 768 is a multiple of 3, so no padding is inserted in the middle.
+	var buf [1024]byte
+	for len(data) > 0 {
+		n := len(data)
+		if n > 768 {
+			n = 768
+		}
+		enc.Encode(buf[:], data[:n])
+		b.Write(buf[:enc.EncodedLen(n)])
+		data = data[n:]
+	}
+	return b.String()
+}
+
+// checkContentLength corrects the Content-Length header set by the handler
+// if it doesn't match the length of the body.
+func (rw *responseWriter) checkContentLength() {
+	cl := rw.header.Get("Content-Length")
+	if cl == "" || rw.isHead || rw.statusCode == http.StatusNotModified {
+		return
+	}
+	n, err := strconv.ParseInt(cl, 10, 64)
+	if err == nil && n == int64(rw.w.Len()) {
+		return
 	}
+	rw.logger.Printf("ridgenative: Content-Length %q doesn't match the body length %d, corrected", cl, rw.w.Len())
+	rw.header.Set("Content-Length", strconv.Itoa(rw.w.Len()))
 }
 
 func (rw *responseWriter) detectContentType() {
+	if rw.detectJSON && isJSON(rw.w.Bytes()) {
+		rw.header.Set("Content-Type", "application/json")
+		return
+	}
 	contentType := http.DetectContentType(rw.w.Bytes())
 	rw.header.Set("Content-Type", contentType)
-	rw.isBinary = isBinary(rw.header)
 }
 
-// assume text/*, application/json, application/javascript, application/xml, */*+json, */*+xml as text
+// isJSON reports whether data is a JSON object or array.
+func isJSON(data []byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	if len(data) == 0 || (data[0] != '{' && data[0] != '[') {
+		return false
+	}
+	return json.Valid(data)
+}
+
+// isBinary reports whether the response with the headers should be encoded in base64.
 func isBinary(headers http.Header) bool {
+	return isBinaryWithFunc(headers, isBinaryContentType)
+}
+
+// isBinaryWithFunc is same as isBinary, but it uses isBinaryType to classify the content type.
+func isBinaryWithFunc(headers http.Header, isBinaryType func(contentType string) bool) bool {
 	contentEncoding := headers.Values("Content-Encoding")
 	if len(contentEncoding) > 0 {
 		// typically, gzip, deflate, br, etc.
@@ -376,7 +1428,12 @@ func isBinary(headers http.Header) bool {
 		return false
 	}
 
-	contentType := headers.Get("Content-Type")
+	return isBinaryType(headers.Get("Content-Type"))
+}
+
+// isBinaryContentType is the default classifier of the content types.
+// assume text/*, application/json, application/javascript, application/xml, */*+json, */*+xml as text
+func isBinaryContentType(contentType string) bool {
 	i := strings.Index(contentType, ";")
 	if i == -1 {
 		i = len(contentType)
@@ -425,26 +1482,98 @@ func isBinary(headers http.Header) bool {
 	return true
 }
 
+// isHealthCheck reports whether r is a health check request that ridgenative responds to without calling the handler.
+func (f *lambdaFunction) isHealthCheck(r *http.Request) bool {
+	if f.healthCheckPath == "" {
+		return false
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return r.URL.Path == f.healthCheckPath || strings.HasPrefix(r.Header.Get("User-Agent"), "ELB-HealthChecker/")
+}
+
+// healthCheckResponse returns the response writer that has the response for the health check requests.
+func (f *lambdaFunction) healthCheckResponse() *responseWriter {
+	rw := f.newResponseWriter(nil)
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(rw, "OK\n")
+	return rw
+}
+
+// serveHTTP calls the handler in the buffered mode.
+// If recoverHandler is set, it recovers panics in the handler,
+// discards the response written so far, and calls recoverHandler to write the response instead.
+func (f *lambdaFunction) serveHTTP(rw *responseWriter, r *http.Request) {
+	if f.recoverHandler != nil {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// the handler wants to abort the response.
+				panic(v)
+			}
+			rw.reset()
+			f.recoverHandler(rw, r, v)
+		}()
+	}
+	f.mux.ServeHTTP(rw, r)
+}
+
 func (f *lambdaFunction) lambdaHandler(ctx context.Context, req *request) (*response, error) {
-	if isV2Request(req) {
+	var r *http.Request
+	var err error
+	var lambdaResponse func(rw *responseWriter) (*response, error)
+	switch {
+	case isWebSocketRequest(req):
+		// API Gateway WebSocket APIs
+		r, err = f.httpRequestWebSocket(ctx, req)
+		lambdaResponse = (*responseWriter).lambdaResponseWebSocket
+	case isV2Request(req):
 		// Lambda Function URLs or API Gateway v2
-		r, err := f.httpRequestV2(ctx, req)
-		if err != nil {
-			return nil, err
+		r, err = f.httpRequestV2(ctx, req)
+		lambdaResponse = (*responseWriter).lambdaResponseV2
+	case isALBRequest(req):
+		// ALB
+		r, err = f.httpRequestV1(ctx, req)
+		multiValueHeaders := len(req.MultiValueHeaders) > 0
+		lambdaResponse = func(rw *responseWriter) (*response, error) {
+			return rw.lambdaResponseALB(multiValueHeaders)
 		}
-		rw := newResponseWriter()
-		f.mux.ServeHTTP(rw, r)
-		return rw.lambdaResponseV2()
-	} else {
-		// API Gateway v1 or ALB
-		r, err := f.httpRequestV1(ctx, req)
-		if err != nil {
+		if err == nil && f.isHealthCheck(r) {
+			return lambdaResponse(f.healthCheckResponse())
+		}
+	default:
+		// API Gateway v1
+		r, err = f.httpRequestV1(ctx, req)
+		lambdaResponse = (*responseWriter).lambdaResponseV1
+		if f.disableMultiValueHeaders {
+			lambdaResponse = (*responseWriter).lambdaResponseV1SingleValue
+		}
+		if err == nil && f.isHealthCheck(r) {
+			return lambdaResponse(f.healthCheckResponse())
+		}
+	}
+	if err != nil {
+		code, ok := f.requestErrorStatus(err)
+		if !ok {
 			return nil, err
 		}
-		rw := newResponseWriter()
-		f.mux.ServeHTTP(rw, r)
-		return rw.lambdaResponseV1()
+		f.logger.Printf("ridgenative: failed to convert the event into a request: %v", err)
+		rw := f.newResponseWriter(nil)
+		http.Error(rw, fmt.Sprintf("%d %s", code, http.StatusText(code)), code)
+		return lambdaResponse(rw)
 	}
+
+	start := time.Now()
+	rw := f.newResponseWriter(r)
+	f.serveHTTP(rw, r)
+	resp, err := lambdaResponse(rw)
+	f.writeAccessLog(r, eventBodyLen(req), rw.statusCode, rw.written, start)
+	return resp, err
 }
 
 type streamingResponse struct {
@@ -461,19 +1590,70 @@ type streamingResponseWriter struct {
 	header      http.Header
 	statusCode  int
 	err         error
+	logger      Logger
+
+	// suppressSuperfluousLog disables the warning of superfluous WriteHeader calls.
+	suppressSuperfluousLog bool
+
+	// keepContentLength keeps the Content-Length header set by the handler in the prelude.
+	keepContentLength bool
+
+	// contentLength is the length of the body declared in the prelude, or -1 if it is unknown.
+	contentLength int64
+
+	// written is the number of bytes written by the handler.
+	written int64
+
+	// cancel cancels the request context when writing to the pipe fails.
+	cancel context.CancelFunc
 
 	// prelude is the first part of the body.
 	// it is used for detecting content-type.
 	prelude []byte
 }
 
+// sniffLen is the maximum length of the data that http.DetectContentType considers.
+const sniffLen = 512
+
 func newStreamingResponseWriter(w *io.PipeWriter) *streamingResponseWriter {
-	return &streamingResponseWriter{
-		w:       w,
-		buf:     bufio.NewWriter(w),
-		header:  make(http.Header, 1),
-		prelude: make([]byte, 0, 512),
+	rw := &streamingResponseWriter{
+		w:             w,
+		header:        make(http.Header, 1),
+		prelude:       make([]byte, 0, sniffLen),
+		logger:        log.Default(),
+		contentLength: -1,
 	}
+	rw.buf = bufio.NewWriter(writerFunc(rw.writePipe))
+	return rw
+}
+
+// newStreamingResponseWriter returns a new streamingResponseWriter configured by f.
+func (f *lambdaFunction) newStreamingResponseWriter(w *io.PipeWriter) *streamingResponseWriter {
+	rw := newStreamingResponseWriter(w)
+	rw.logger = f.logger
+	rw.suppressSuperfluousLog = f.suppressSuperfluousLog
+	rw.keepContentLength = f.streamingContentLength
+	if f.streamingSniffLen != sniffLen {
+		rw.prelude = make([]byte, 0, f.streamingSniffLen)
+	}
+	return rw
+}
+
+// writerFunc is an adapter to allow the use of ordinary functions as io.Writer.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// writePipe writes p to the pipe.
+// If it fails, the client is gone, so it cancels the request context.
+func (rw *streamingResponseWriter) writePipe(p []byte) (int, error) {
+	n, err := rw.w.Write(p)
+	if err != nil && rw.cancel != nil {
+		rw.cancel()
+	}
+	return n, err
 }
 
 func (rw *streamingResponseWriter) Header() http.Header {
@@ -482,8 +1662,10 @@ func (rw *streamingResponseWriter) Header() http.Header {
 
 func (rw *streamingResponseWriter) WriteHeader(code int) {
 	if rw.wroteHeader {
-		caller := relevantCaller()
-		log.Printf("ridgenative: superfluous response.WriteHeader call from %s (%s:%d)", caller.Function, path.Base(caller.File), caller.Line)
+		if !rw.suppressSuperfluousLog {
+			caller := relevantCaller()
+			rw.logger.Printf("ridgenative: superfluous response.WriteHeader call from %s (%s:%d)", caller.Function, path.Base(caller.File), caller.Line)
+		}
 		return
 	}
 	if rw.err != nil {
@@ -497,6 +1679,23 @@ func (rw *streamingResponseWriter) WriteHeader(code int) {
 	rw.wroteHeader = true
 	rw.statusCode = code
 
+	// X-Lambda-Http-Content-Encoding is a hint for ridgenative, it is not for clients.
+	rw.header.Del("X-Lambda-Http-Content-Encoding")
+
+	// Lambda sends the streaming responses in chunked encoding,
+	// so Content-Length is meaningless and may mismatch the body.
+	// It is kept only if the handler opts in and the value is valid.
+	rw.contentLength = -1
+	if rw.keepContentLength {
+		if n, err := strconv.ParseInt(rw.header.Get("Content-Length"), 10, 64); err == nil && n >= 0 {
+			rw.contentLength = n
+		}
+	}
+	if rw.contentLength < 0 {
+		rw.header.Del("Content-Length")
+	}
+	removeHopByHopHeaders(rw.header)
+
 	// build the prelude
 	h := make(map[string]string, len(rw.header))
 	for key, value := range rw.header {
@@ -541,6 +1740,18 @@ func (rw *streamingResponseWriter) hasContentType() bool {
 }
 
 func (rw *streamingResponseWriter) Write(data []byte) (int, error) {
+	n, err := rw.write(data)
+	rw.written += int64(n)
+	return n, err
+}
+
+// BytesWritten returns the number of the body bytes written by the handler so far.
+// It doesn't include the prelude of the streaming response that has the status code and the headers.
+func (rw *streamingResponseWriter) BytesWritten() int64 {
+	return rw.written
+}
+
+func (rw *streamingResponseWriter) write(data []byte) (int, error) {
 	var m int
 	if !rw.wroteHeader {
 		if rw.hasContentType() {
@@ -574,9 +1785,14 @@ func (rw *streamingResponseWriter) closeWithError(err error) error {
 	if rw.err != nil {
 		err = rw.err
 	}
-	if err0 := rw.buf.Flush(); err0 != nil {
+	if err0 := rw.buf.Flush(); err0 != nil && err == nil {
+		// keep the original error, it is reported in the trailers even if the body is partially sent.
 		err = err0
 	}
+	if err == nil && rw.contentLength >= 0 && rw.contentLength != rw.written {
+		// the prelude is already sent, so it can't be corrected.
+		rw.logger.Printf("ridgenative: Content-Length %d doesn't match the body length %d of the streaming response", rw.contentLength, rw.written)
+	}
 	return rw.w.CloseWithError(err)
 }
 
@@ -585,25 +1801,61 @@ func (rw *streamingResponseWriter) close() error {
 }
 
 func (rw *streamingResponseWriter) Flush() {
+	_ = rw.FlushError()
+}
+
+// FlushError is same as Flush, but it returns the error.
+// http.ResponseController of Go 1.20 or later uses it.
+func (rw *streamingResponseWriter) FlushError() error {
 	if !rw.wroteHeader {
 		rw.WriteHeader(http.StatusOK)
 	}
-	rw.buf.Flush()
+	if rw.err != nil {
+		return rw.err
+	}
+	return rw.buf.Flush()
 }
 
 func (f *lambdaFunction) lambdaHandlerStreaming(ctx context.Context, req *request, w *io.PipeWriter) (string, error) {
 	r, err := f.httpRequestV2(ctx, req)
 	if err != nil {
-		return "", err
+		code, ok := f.requestErrorStatus(err)
+		if !ok {
+			return "", err
+		}
+		f.logger.Printf("ridgenative: failed to convert the event into a request: %v", err)
+		go func() {
+			rw := f.newStreamingResponseWriter(w)
+			http.Error(rw, fmt.Sprintf("%d %s", code, http.StatusText(code)), code)
+			invokeStatsFromContext(ctx).setResponse(code, rw.written)
+			_ = rw.close()
+		}()
+		return contentTypeHTTPIntegrationResponse, nil
 	}
+	ctx, cancel := context.WithCancel(r.Context())
+	r = r.WithContext(ctx)
 	go func() {
-		rw := newStreamingResponseWriter(w)
+		defer cancel()
+		start := time.Now()
+		rw := f.newStreamingResponseWriter(w)
+		rw.cancel = cancel
 		defer func() {
+			// record the statistics before closing, because the invoke finishes on closing.
+			stats := invokeStatsFromContext(ctx)
 			if v := recover(); v != nil {
-				_ = rw.closeWithError(lambdaPanicResponse(v))
+				err := lambdaPanicResponse(v)
+				stats.setError(err)
+				_ = rw.closeWithError(err)
 			} else {
+				code := rw.statusCode
+				if !rw.wroteHeader {
+					// close writes 200 OK.
+					code = http.StatusOK
+				}
+				stats.setResponse(code, rw.written)
 				_ = rw.close()
 			}
+			f.writeAccessLog(r, eventBodyLen(req), rw.statusCode, rw.written, start)
 		}()
 		f.mux.ServeHTTP(rw, r)
 	}()
@@ -612,7 +1864,10 @@ func (f *lambdaFunction) lambdaHandlerStreaming(ctx context.Context, req *reques
 
 func newLambdaFunction(mux http.Handler) *lambdaFunction {
 	return &lambdaFunction{
-		mux: mux,
+		mux:               mux,
+		logger:            log.Default(),
+		isBinaryType:      isBinaryContentType,
+		streamingSniffLen: sniffLen,
 	}
 }
 
@@ -632,26 +1887,105 @@ const (
 
 // Start starts the AWS Lambda function.
 // The handler is typically nil, in which case the DefaultServeMux is used.
-func Start(mux http.Handler, mode InvokeMode) error {
-	api := os.Getenv("AWS_LAMBDA_RUNTIME_API")
-	if mux == nil {
-		mux = http.DefaultServeMux
+// The invokes are handled sequentially, the handler is never called concurrently within a function instance,
+// unless WithTimeoutResponse is specified; the handler that times out keeps running while the next invoke is handled.
+// The opts customize the behavior of the function.
+// If mode is empty, the mode specified by WithInvokeMode is used.
+// It returns an error if both of them are specified and they conflict.
+func Start(mux http.Handler, mode InvokeMode, opts ...Option) error {
+	o := newOptions(opts)
+	if mode != "" {
+		if o.mode != "" && o.mode != mode {
+			return fmt.Errorf("ridgenative: the invoke mode %s conflicts with WithInvokeMode(%s)", mode, o.mode)
+		}
+		o.mode = mode
+	}
+	return start(mux, o)
+}
+
+// StartFunc starts the AWS Lambda function with the handler function h.
+// Unlike Start, it never falls back to the DefaultServeMux,
+// so the handlers registered to the DefaultServeMux by other packages are not exposed.
+// If RIDGENATIVE_INVOKE_MODE environment value is defined, it is used as the invoke mode.
+// Otherwise, if AWS_LAMBDA_FUNCTION_RESPONSE_STREAMING environment value is true, such as "true" or "1",
+// InvokeModeResponseStream is used.
+// The default is InvokeModeBuffered.
+// WithInvokeMode overrides the environment values.
+func StartFunc(h http.HandlerFunc, opts ...Option) error {
+	if h == nil {
+		return errors.New("ridgenative: nil handler")
+	}
+	o := newOptions(opts)
+	mode, err := o.invokeMode()
+	if err != nil {
+		return err
 	}
-	f := newLambdaFunction(mux)
-	c := newRuntimeAPIClient(api)
-	switch mode {
+	o.mode = mode
+	return start(h, o)
+}
+
+func start(mux http.Handler, o *options) error {
+	ctx := o.baseContext
+	if len(o.shutdownHooks) > 0 {
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, syscall.SIGTERM)
+		defer stop()
+	}
+	return serve(ctx, mux, o)
+}
+
+// serve handles the invokes from the runtime API until ctx is canceled, and then runs the shutdown hooks.
+// The in-flight invoke completes even if ctx is canceled.
+func serve(ctx context.Context, mux http.Handler, o *options) error {
+	api := os.Getenv("AWS_LAMBDA_RUNTIME_API")
+	f := o.newLambdaFunction(mux)
+	c := o.newRuntimeAPIClient(api)
+
+	var loop func(ctx context.Context) error
+	switch o.mode {
 	case InvokeModeBuffered:
-		if err := c.start(context.Background(), f.lambdaHandler); err != nil {
-			log.Println(err)
-			return err
+		loop = func(ctx context.Context) error {
+			return c.start(ctx, f.lambdaHandler)
 		}
 	case InvokeModeResponseStream:
-		if err := c.startStreaming(context.Background(), f.lambdaHandlerStreaming); err != nil {
-			log.Println(err)
-			return err
+		loop = func(ctx context.Context) error {
+			return c.startStreaming(ctx, f.lambdaHandlerStreaming)
 		}
 	default:
-		return fmt.Errorf("ridgenative: invalid InvokeMode: %s", mode)
+		return fmt.Errorf("ridgenative: invalid InvokeMode: %s", o.mode)
+	}
+
+	err := runInitHooks(ctx, c, o.initHooks)
+	if err == nil {
+		err = loop(ctx)
+	}
+	if err != nil {
+		o.logger.Printf("%v", err)
+	}
+
+	// run shutdown hooks
+	hookCtx := withoutCancel(ctx)
+	for _, hook := range o.shutdownHooks {
+		if hookErr := hook(hookCtx); hookErr != nil {
+			o.logger.Printf("ridgenative: shutdown hook failed: %v", hookErr)
+			if err == nil {
+				err = hookErr
+			}
+		}
+	}
+	return err
+}
+
+// runInitHooks runs the init hooks in the order they are registered.
+// If a hook fails, it reports the error to the runtime API, and returns the error.
+func runInitHooks(ctx context.Context, c *runtimeAPIClient, hooks []func(ctx context.Context) error) error {
+	for _, hook := range hooks {
+		if err := hook(ctx); err != nil {
+			if reportErr := c.reportInitError(ctx, lambdaErrorResponse(err)); reportErr != nil {
+				return reportErr
+			}
+			return fmt.Errorf("ridgenative: init hook failed: %w", err)
+		}
 	}
 	return nil
 }
@@ -671,29 +2005,76 @@ func Start(mux http.Handler, mode InvokeMode) error {
 //
 // The handler is typically nil, in which case the DefaultServeMux is used.
 //
-// If AWS_LAMBDA_RUNTIME_API environment value is defined, ListenAndServe uses it as the invoke mode.
+// If RIDGENATIVE_INVOKE_MODE environment value is defined, ListenAndServe uses it as the invoke mode.
+// Otherwise, if AWS_LAMBDA_FUNCTION_RESPONSE_STREAMING environment value is true, such as "true" or "1",
+// ListenAndServe uses InvokeModeResponseStream.
 // The default is InvokeModeBuffered.
-func ListenAndServe(address string, mux http.Handler) error {
+// WithInvokeMode overrides the environment values.
+// Use ListenAndServeMode if the invoke mode is known at build time.
+func ListenAndServe(address string, mux http.Handler, opts ...Option) error {
 	if go1 := os.Getenv("AWS_EXECUTION_ENV"); go1 == "AWS_Lambda_go1.x" {
 		// run on go1.x runtime
 		return errors.New("ridgenative: go1.x runtime is not supported")
 	}
 
+	o := newOptions(opts)
 	api := os.Getenv("AWS_LAMBDA_RUNTIME_API")
 	if api == "" {
 		// fall back to normal HTTP server.
-		return http.ListenAndServe(address, mux)
+		return http.ListenAndServe(address, o.handler(mux))
 	}
 
 	// run on provided or provided.al2 runtime
-	var mode InvokeMode
+	mode, err := o.invokeMode()
+	if err != nil {
+		return err
+	}
+	o.mode = mode
+	return start(mux, o)
+}
+
+// ListenAndServeMode is same as ListenAndServe, but it uses mode as the invoke mode
+// instead of RIDGENATIVE_INVOKE_MODE and AWS_LAMBDA_FUNCTION_RESPONSE_STREAMING environment values.
+// If mode is empty, it falls back to the environment values.
+func ListenAndServeMode(address string, mux http.Handler, mode InvokeMode, opts ...Option) error {
+	if mode != "" {
+		opts = append(opts[:len(opts):len(opts)], WithInvokeMode(mode))
+	}
+	return ListenAndServe(address, mux, opts...)
+}
+
+// invokeMode returns the invoke mode for ListenAndServe and StartFunc.
+// WithInvokeMode takes precedence over RIDGENATIVE_INVOKE_MODE environment value,
+// and RIDGENATIVE_INVOKE_MODE takes precedence over AWS_LAMBDA_FUNCTION_RESPONSE_STREAMING environment value.
+//
+// The invoke mode can't be probed on startup, because the runtime API doesn't expose the configuration of the function.
+// A mismatch is detected only when the runtime API rejects the first streaming response.
+// So the invoke mode is selected from the environment values that the deployment sets along with the configuration.
+func (o *options) invokeMode() (InvokeMode, error) {
+	if o.mode != "" {
+		return o.mode, nil
+	}
 	switch os.Getenv("RIDGENATIVE_INVOKE_MODE") {
-	case "BUFFERED", "":
-		mode = InvokeModeBuffered
+	case "BUFFERED":
+		return InvokeModeBuffered, nil
 	case "RESPONSE_STREAM":
-		mode = InvokeModeResponseStream
+		return InvokeModeResponseStream, nil
+	case "":
+		// fall back to AWS_LAMBDA_FUNCTION_RESPONSE_STREAMING.
 	default:
-		return errors.New("ridgenative: invalid RIDGENATIVE_INVOKE_MODE")
+		return "", errors.New("ridgenative: invalid RIDGENATIVE_INVOKE_MODE")
+	}
+
+	streaming := os.Getenv("AWS_LAMBDA_FUNCTION_RESPONSE_STREAMING")
+	if streaming == "" {
+		return InvokeModeBuffered, nil
+	}
+	enabled, err := strconv.ParseBool(streaming)
+	if err != nil {
+		return "", errors.New("ridgenative: invalid AWS_LAMBDA_FUNCTION_RESPONSE_STREAMING")
+	}
+	if enabled {
+		return InvokeModeResponseStream, nil
 	}
-	return Start(mux, mode)
+	return InvokeModeBuffered, nil
 }
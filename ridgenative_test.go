@@ -1,14 +1,22 @@
 package ridgenative
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
 	"os"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func loadRequest(path string) (*request, error) {
@@ -61,6 +69,49 @@ func TestHTTPRequest(t *testing.T) {
 		}
 	})
 
+	t.Run("alb repeated headers", func(t *testing.T) {
+		req, err := loadRequest("testdata/alb-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.MultiValueHeaders["x-forwarded-for"] = []string{"192.0.2.1", "198.51.100.1", "203.0.113.1"}
+		req.MultiValueHeaders["cookie"] = []string{"foo=bar", "hoge=fuga"}
+		httpReq, err := l.httpRequestV1(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"192.0.2.1", "198.51.100.1", "203.0.113.1"}; !reflect.DeepEqual(httpReq.Header["X-Forwarded-For"], want) {
+			t.Errorf("unexpected X-Forwarded-For: want %v, got %v", want, httpReq.Header["X-Forwarded-For"])
+		}
+		if want := []string{"foo=bar", "hoge=fuga"}; !reflect.DeepEqual(httpReq.Header["Cookie"], want) {
+			t.Errorf("unexpected Cookie: want %v, got %v", want, httpReq.Header["Cookie"])
+		}
+		if len(httpReq.Cookies()) != 2 {
+			t.Errorf("unexpected cookies: %v", httpReq.Cookies())
+		}
+	})
+
+	t.Run("alb headers differ only in case", func(t *testing.T) {
+		req, err := loadRequest("testdata/alb-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.MultiValueHeaders["X-Custom"] = []string{"value1", "value2"}
+		req.MultiValueHeaders["x-custom"] = []string{"value3"}
+		httpReq, err := l.httpRequestV1(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := httpReq.Header["X-Custom"]
+		if len(got) != 3 {
+			t.Fatalf("unexpected X-Custom: %v", got)
+		}
+		// the order of the values of each key is preserved.
+		if !reflect.DeepEqual(got, []string{"value1", "value2", "value3"}) && !reflect.DeepEqual(got, []string{"value3", "value1", "value2"}) {
+			t.Errorf("unexpected X-Custom: %v", got)
+		}
+	})
+
 	t.Run("alb post request", func(t *testing.T) {
 		req, err := loadRequest("testdata/alb-post-request.json")
 		if err != nil {
@@ -133,6 +184,9 @@ func TestHTTPRequest(t *testing.T) {
 		if httpReq.Method != http.MethodGet {
 			t.Errorf("unexpected method: want %s, got %s", http.MethodGet, httpReq.Method)
 		}
+		if httpReq.RemoteAddr != "192.0.2.1:0" {
+			t.Errorf("unexpected RemoteAddr: want %q, got %q", "192.0.2.1:0", httpReq.RemoteAddr)
+		}
 		if !reflect.DeepEqual(httpReq.Header["Header-Name"], []string{"Value1", "Value2"}) {
 			t.Errorf("unexpected header: want %v, got %v", []string{"Value1", "Value2"}, httpReq.Header["Header-Name"])
 		}
@@ -152,6 +206,15 @@ func TestHTTPRequest(t *testing.T) {
 		if httpReq.Host != "xxxxxxxxxx.execute-api.ap-northeast-1.amazonaws.com" {
 			t.Errorf("unexpected host: want %q, got %q", "xxxxxxxxxx.execute-api.ap-northeast-1.amazonaws.com", httpReq.Host)
 		}
+		if httpReq.URL.Scheme != "https" {
+			t.Errorf("unexpected scheme: want %q, got %q", "https", httpReq.URL.Scheme)
+		}
+		if httpReq.URL.Host != "xxxxxxxxxx.execute-api.ap-northeast-1.amazonaws.com" {
+			t.Errorf("unexpected url host: want %q, got %q", "xxxxxxxxxx.execute-api.ap-northeast-1.amazonaws.com", httpReq.URL.Host)
+		}
+		if httpReq.URL.String() != "https://xxxxxxxxxx.execute-api.ap-northeast-1.amazonaws.com/foo%20/bar?query=hoge&query=fuga" {
+			t.Errorf("unexpected url: want %q, got %q", "https://xxxxxxxxxx.execute-api.ap-northeast-1.amazonaws.com/foo%20/bar?query=hoge&query=fuga", httpReq.URL.String())
+		}
 	})
 
 	t.Run("api gateway post request", func(t *testing.T) {
@@ -226,6 +289,12 @@ func TestHTTPRequest(t *testing.T) {
 		if httpReq.Method != http.MethodGet {
 			t.Errorf("unexpected method: want %s, got %s", http.MethodGet, httpReq.Method)
 		}
+		if httpReq.RemoteAddr != "192.0.2.1:0" {
+			t.Errorf("unexpected RemoteAddr: want %q, got %q", "192.0.2.1:0", httpReq.RemoteAddr)
+		}
+		if httpReq.Proto != "HTTP/1.1" || httpReq.ProtoMajor != 1 || httpReq.ProtoMinor != 1 {
+			t.Errorf("unexpected protocol: want %q, got %q (%d.%d)", "HTTP/1.1", httpReq.Proto, httpReq.ProtoMajor, httpReq.ProtoMinor)
+		}
 		if !reflect.DeepEqual(httpReq.Header["Header1"], []string{"value1,value2"}) {
 			t.Errorf("unexpected header: want %v, got %v", []string{"value1,value2"}, httpReq.Header["Header1"])
 		}
@@ -245,6 +314,12 @@ func TestHTTPRequest(t *testing.T) {
 		if httpReq.Host != "xxxxxxxxxx.execute-api.ap-northeast-1.amazonaws.com" {
 			t.Errorf("unexpected host: want %q, got %q", "xxxxxxxxxx.execute-api.ap-northeast-1.amazonaws.com", httpReq.Host)
 		}
+		if httpReq.URL.Scheme != "https" {
+			t.Errorf("unexpected scheme: want %q, got %q", "https", httpReq.URL.Scheme)
+		}
+		if httpReq.URL.Host != "xxxxxxxxxx.execute-api.ap-northeast-1.amazonaws.com" {
+			t.Errorf("unexpected url host: want %q, got %q", "xxxxxxxxxx.execute-api.ap-northeast-1.amazonaws.com", httpReq.URL.Host)
+		}
 	})
 
 	t.Run("api gateway v2 post request", func(t *testing.T) {
@@ -399,555 +474,2605 @@ func TestHTTPRequest(t *testing.T) {
 			t.Errorf("unexpected host: want %q, got %q", "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx.lambda-url.ap-northeast-1.on.aws", httpReq.Host)
 		}
 	})
-}
-
-func TestResponseV1(t *testing.T) {
-	t.Run("normal", func(t *testing.T) {
-		rw := newResponseWriter()
-		// normal header fields
-		rw.Header().Add("foo", "foo")
-
-		// multi line header fields
-		rw.Header().Add("bar", "bar1")
-		rw.Header().Add("bar", "bar2")
-
-		// cookie
-		rw.Header().Add("Set-Cookie", "foo1=bar1")
-		rw.Header().Add("Set-Cookie", "foo2=bar2")
 
-		if _, err := io.WriteString(rw, "<!DOCTYPE html>\n"); err != nil {
-			t.Error(err)
+	t.Run("https request", func(t *testing.T) {
+		req, err := loadRequest("testdata/alb-get-request.json")
+		if err != nil {
+			t.Fatal(err)
 		}
-		if _, err := rw.Write([]byte("<html><body>Hello!</body></html>")); err != nil {
-			t.Error(err)
+		req.MultiValueHeaders["x-forwarded-proto"] = []string{"https"}
+		httpReq, err := l.httpRequestV1(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
 		}
+		if httpReq.TLS == nil {
+			t.Error("want TLS, got nil")
+		}
+	})
 
-		resp, err := rw.lambdaResponseV1()
+	t.Run("http request", func(t *testing.T) {
+		req, err := loadRequest("testdata/alb-get-request.json")
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
-		if resp.Headers["Foo"] != "foo" {
-			t.Errorf("unexpected header: want %q, got %q", "foo", resp.Headers["Foo"])
+		req.MultiValueHeaders["x-forwarded-proto"] = []string{"http"}
+		httpReq, err := l.httpRequestV1(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
 		}
-		if resp.Headers["Bar"] != "bar1, bar2" {
-			t.Errorf("unexpected header: want %q, got %q", "bar1, bar2", resp.Headers["Bar"])
+		if httpReq.TLS != nil {
+			t.Errorf("want nil, got %#v", httpReq.TLS)
 		}
-		if resp.Headers["Set-Cookie"] != "foo1=bar1" {
-			t.Errorf("unexpected header: want %q, got %q", "bar1, bar2", resp.Headers["Bar"])
+		if httpReq.URL.Scheme != "http" {
+			t.Errorf("unexpected scheme: want %q, got %q", "http", httpReq.URL.Scheme)
 		}
-		if !reflect.DeepEqual(resp.MultiValueHeaders["Foo"], []string{"foo"}) {
-			t.Errorf("unexpected header: want %#v, got %#v", []string{"foo"}, resp.MultiValueHeaders["Foo"])
+	})
+
+	t.Run("multiple forwarded protos", func(t *testing.T) {
+		req, err := loadRequest("testdata/alb-get-request.json")
+		if err != nil {
+			t.Fatal(err)
 		}
-		if !reflect.DeepEqual(resp.MultiValueHeaders["Bar"], []string{"bar1", "bar2"}) {
-			t.Errorf("unexpected header: want %#v, got %#v", []string{"bar1", "bar2"}, resp.MultiValueHeaders["Bar"])
+		req.MultiValueHeaders["x-forwarded-proto"] = []string{"https, http"}
+		httpReq, err := l.httpRequestV1(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
 		}
-
-		// Content-Type is auto detected.
-		if resp.Headers["Content-Type"] != "text/html; charset=utf-8" {
-			t.Errorf("unexpected header: want %q, got %q", "text/html; charset=utf-8", resp.Headers["Content-Type"])
+		if httpReq.TLS == nil {
+			t.Error("want TLS, got nil")
+		}
+		if httpReq.URL.Scheme != "https" {
+			t.Errorf("unexpected scheme: want %q, got %q", "https", httpReq.URL.Scheme)
 		}
+	})
 
-		if resp.StatusCode != http.StatusOK {
-			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, resp.StatusCode)
+	t.Run("multiple forwarded protos starting with http", func(t *testing.T) {
+		req, err := loadRequest("testdata/alb-get-request.json")
+		if err != nil {
+			t.Fatal(err)
 		}
-		if resp.Body != "<!DOCTYPE html>\n<html><body>Hello!</body></html>" {
-			t.Errorf("unexpected body: want %q, got %q", "<!DOCTYPE html>\n<html><body>Hello!</body></html>", resp.Body)
+		req.MultiValueHeaders["x-forwarded-proto"] = []string{" HTTP ,https"}
+		httpReq, err := l.httpRequestV1(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
 		}
-		if resp.IsBase64Encoded {
-			t.Error("unexpected IsBase64Encoded: want false, got true")
+		if httpReq.TLS != nil {
+			t.Errorf("want nil, got %#v", httpReq.TLS)
+		}
+		if httpReq.URL.Scheme != "http" {
+			t.Errorf("unexpected scheme: want %q, got %q", "http", httpReq.URL.Scheme)
 		}
 	})
-	t.Run("set content-type", func(t *testing.T) {
-		rw := newResponseWriter()
-		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		if _, err := io.WriteString(rw, "<!DOCTYPE html>\n"); err != nil {
-			t.Error(err)
+
+	t.Run("unknown forwarded proto", func(t *testing.T) {
+		req, err := loadRequest("testdata/alb-get-request.json")
+		if err != nil {
+			t.Fatal(err)
 		}
-		if _, err := rw.Write([]byte("<html><body>Hello!</body></html>")); err != nil {
-			t.Error(err)
+		req.MultiValueHeaders["x-forwarded-proto"] = []string{"wss"}
+		httpReq, err := l.httpRequestV1(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
 		}
+		if httpReq.URL.Scheme != "https" {
+			t.Errorf("unexpected scheme: want %q, got %q", "https", httpReq.URL.Scheme)
+		}
+	})
 
-		resp, err := rw.lambdaResponseV1()
+	t.Run("function urls https request", func(t *testing.T) {
+		req, err := loadRequest("testdata/function-urls-get-request.json")
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
-
-		// Content-Type is auto detected.
-		if resp.Headers["Content-Type"] != "text/plain; charset=utf-8" {
-			t.Errorf("unexpected header: want %q, got %q", "text/plain; charset=utf-8", resp.Headers["Content-Type"])
+		httpReq, err := l.httpRequestV2(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if httpReq.TLS == nil {
+			t.Error("want TLS, got nil")
 		}
+	})
 
-		if resp.StatusCode != http.StatusOK {
-			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, resp.StatusCode)
+	t.Run("api gateway without host header", func(t *testing.T) {
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
 		}
-		if resp.Body != "<!DOCTYPE html>\n<html><body>Hello!</body></html>" {
-			t.Errorf("unexpected body: want %q, got %q", "<!DOCTYPE html>\n<html><body>Hello!</body></html>", resp.Body)
+		delete(req.Headers, "Host")
+		delete(req.MultiValueHeaders, "Host")
+		httpReq, err := l.httpRequestV1(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
 		}
-		if resp.IsBase64Encoded {
-			t.Error("unexpected IsBase64Encoded: want false, got true")
+		if httpReq.Host != "xxxxxxxxxx.execute-api.ap-northeast-1.amazonaws.com" {
+			t.Errorf("unexpected host: want %q, got %q", "xxxxxxxxxx.execute-api.ap-northeast-1.amazonaws.com", httpReq.Host)
 		}
 	})
-	t.Run("redirect to example.com", func(t *testing.T) {
-		rw := newResponseWriter()
-		rw.Header().Add("location", "http://example.com/")
-		rw.WriteHeader(http.StatusFound)
-		if _, err := io.WriteString(rw, "<!DOCTYPE html>\n"); err != nil {
-			t.Error(err)
+
+	t.Run("api gateway v2 without host header", func(t *testing.T) {
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
 		}
-		if _, err := rw.Write([]byte("<html><body>Redirect to <a href=http://example.com/>example.com</a></body></html>")); err != nil {
-			t.Error(err)
+		delete(req.Headers, "host")
+		httpReq, err := l.httpRequestV2(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if httpReq.Host != "xxxxxxxxxx.execute-api.ap-northeast-1.amazonaws.com" {
+			t.Errorf("unexpected host: want %q, got %q", "xxxxxxxxxx.execute-api.ap-northeast-1.amazonaws.com", httpReq.Host)
 		}
+	})
+}
 
-		resp, err := rw.lambdaResponseV1()
+func TestHTTPRequestWebSocket(t *testing.T) {
+	l := newLambdaFunction(nil)
+	t.Run("connect", func(t *testing.T) {
+		req, err := loadRequest("testdata/websocket-connect-request.json")
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
-		if resp.Headers["Location"] != "http://example.com/" {
-			t.Errorf("unexpected header: want %q, got %q", "http://example.com/", resp.Headers["Foo"])
+		if !isWebSocketRequest(req) {
+			t.Fatal("want WebSocket request, but not")
 		}
-		if resp.StatusCode != http.StatusFound {
-			t.Errorf("unexpected status code: want %d, got %d", http.StatusFound, resp.StatusCode)
+		httpReq, err := l.httpRequestWebSocket(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
 		}
-		if resp.Body != "<!DOCTYPE html>\n<html><body>Redirect to <a href=http://example.com/>example.com</a></body></html>" {
-			t.Errorf("unexpected body: want %q, got %q", "<!DOCTYPE html>\n<html><body>Redirect to <a href=http://example.com/>example.com</a></body></html>", resp.Body)
+		if httpReq.Method != http.MethodPost {
+			t.Errorf("unexpected method: want %s, got %s", http.MethodPost, httpReq.Method)
 		}
-		if resp.IsBase64Encoded {
-			t.Error("unexpected IsBase64Encoded: want false, got true")
+		if httpReq.RequestURI != "/?token=hoge" {
+			t.Errorf("unexpected RequestURI: want %q, got %q", "/?token=hoge", httpReq.RequestURI)
 		}
-	})
-	t.Run("base64", func(t *testing.T) {
-		rw := newResponseWriter()
-		// 1x1 PNG image
-		if _, err := io.WriteString(rw, "\x89\x50\x4e\x47\x0d\x0a\x1a\x0a\x00\x00\x00\x0d\x49\x48\x44\x52"); err != nil {
-			t.Error(err)
+		if got := httpReq.Header.Get("X-Ridgenative-Route-Key"); got != "$connect" {
+			t.Errorf("unexpected route key: want %q, got %q", "$connect", got)
 		}
-		if _, err := io.WriteString(rw, "\x00\x00\x00\x01\x00\x00\x00\x01\x08\x04\x00\x00\x00\xb5\x1c\x0c"); err != nil {
-			t.Error(err)
+		if got := httpReq.Header.Get("X-Ridgenative-Event-Type"); got != "CONNECT" {
+			t.Errorf("unexpected event type: want %q, got %q", "CONNECT", got)
 		}
-		if _, err := io.WriteString(rw, "\x02\x00\x00\x00\x0b\x49\x44\x41\x54\x08\xd7\x63\x60\x60\x00\x00"); err != nil {
-			t.Error(err)
+		if got := httpReq.Header.Get("X-Ridgenative-Connection-Id"); got != "RyFtyeMttjMCJgQ=" {
+			t.Errorf("unexpected connection id: want %q, got %q", "RyFtyeMttjMCJgQ=", got)
 		}
-		if _, err := io.WriteString(rw, "\x00\x03\x00\x01\x20\xd5\x94\xc7\x00\x00\x00\x00\x49\x45\x4e\x44"); err != nil {
-			t.Error(err)
+		if got := httpReq.Header.Get("Sec-Websocket-Key"); got != "dGhlIHNhbXBsZSBub25jZQ==" {
+			t.Errorf("unexpected Sec-WebSocket-Key: want %q, got %q", "dGhlIHNhbXBsZSBub25jZQ==", got)
 		}
-		if _, err := io.WriteString(rw, "\xae\x42\x60\x82"); err != nil {
-			t.Error(err)
+		if httpReq.Host != "xxxxxxxxxx.execute-api.ap-northeast-1.amazonaws.com" {
+			t.Errorf("unexpected host: want %q, got %q", "xxxxxxxxxx.execute-api.ap-northeast-1.amazonaws.com", httpReq.Host)
+		}
+		if httpReq.RemoteAddr != "192.0.2.1:0" {
+			t.Errorf("unexpected RemoteAddr: want %q, got %q", "192.0.2.1:0", httpReq.RemoteAddr)
 		}
+		rc, ok := RequestContext(httpReq.Context())
+		if !ok {
+			t.Fatal("request context not found")
+		}
+		if rc.ConnectionID != "RyFtyeMttjMCJgQ=" {
+			t.Errorf("unexpected connection id: want %q, got %q", "RyFtyeMttjMCJgQ=", rc.ConnectionID)
+		}
+	})
 
-		resp, err := rw.lambdaResponseV1()
+	t.Run("message", func(t *testing.T) {
+		req, err := loadRequest("testdata/websocket-message-request.json")
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
-		if resp.StatusCode != http.StatusOK {
-			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, resp.StatusCode)
+		if !isWebSocketRequest(req) {
+			t.Fatal("want WebSocket request, but not")
 		}
-		if resp.Body != "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVQI12NgYAAAAAMAASDVlMcAAAAASUVORK5CYII=" {
-			t.Errorf("unexpected body: want %q, got %q", "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVQI12NgYAAAAAMAASDVlMcAAAAASUVORK5CYII=", resp.Body)
+		httpReq, err := l.httpRequestWebSocket(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
 		}
-		if !resp.IsBase64Encoded {
-			t.Error("unexpected IsBase64Encoded: want true, got false")
+		if httpReq.RequestURI != "/" {
+			t.Errorf("unexpected RequestURI: want %q, got %q", "/", httpReq.RequestURI)
+		}
+		if got := httpReq.Header.Get("X-Ridgenative-Route-Key"); got != "$default" {
+			t.Errorf("unexpected route key: want %q, got %q", "$default", got)
+		}
+		if got := httpReq.Header.Get("X-Ridgenative-Event-Type"); got != "MESSAGE" {
+			t.Errorf("unexpected event type: want %q, got %q", "MESSAGE", got)
+		}
+		if httpReq.Host != "xxxxxxxxxx.execute-api.ap-northeast-1.amazonaws.com" {
+			t.Errorf("unexpected host: want %q, got %q", "xxxxxxxxxx.execute-api.ap-northeast-1.amazonaws.com", httpReq.Host)
+		}
+		body, err := io.ReadAll(httpReq.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != `{"action":"sendmessage","data":"hello"}` {
+			t.Errorf("unexpected body: want %q, got %q", `{"action":"sendmessage","data":"hello"}`, string(body))
 		}
 	})
-}
-
-func TestResponseV2(t *testing.T) {
-	t.Run("normal", func(t *testing.T) {
-		rw := newResponseWriter()
-
-		// normal header fields
-		rw.Header().Add("foo", "foo")
-
-		// multi line header fields
-		rw.Header().Add("bar", "bar1")
-		rw.Header().Add("bar", "bar2")
 
-		// cookie
-		rw.Header().Add("Set-Cookie", "foo1=bar1")
-		rw.Header().Add("Set-Cookie", "foo2=bar2")
+	t.Run("api gateway v2 is not WebSocket", func(t *testing.T) {
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isWebSocketRequest(req) {
+			t.Error("want not WebSocket request, but it is")
+		}
+	})
+}
 
-		if _, err := io.WriteString(rw, "<!DOCTYPE html>\n"); err != nil {
-			t.Error(err)
+func TestLambdaHandlerWebSocket(t *testing.T) {
+	l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Ridgenative-Route-Key") == "$connect" {
+			// reject the connection
+			w.WriteHeader(http.StatusForbidden)
+			return
 		}
-		if _, err := rw.Write([]byte("<html><body>Hello!</body></html>")); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := io.Copy(w, r.Body); err != nil {
 			t.Error(err)
 		}
+	}))
 
-		resp, err := rw.lambdaResponseV2()
+	t.Run("connect", func(t *testing.T) {
+		req, err := loadRequest("testdata/websocket-connect-request.json")
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
-
-		// test headers
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, resp.StatusCode)
+		}
+	})
+
+	t.Run("message", func(t *testing.T) {
+		req, err := loadRequest("testdata/websocket-message-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if resp.Body != `{"action":"sendmessage","data":"hello"}` {
+			t.Errorf("unexpected body: want %q, got %q", `{"action":"sendmessage","data":"hello"}`, resp.Body)
+		}
+		if resp.MultiValueHeaders != nil {
+			t.Errorf("unexpected multiValueHeaders: %v", resp.MultiValueHeaders)
+		}
+	})
+}
+
+func TestLambdaHandler_PayloadFormatVersion1(t *testing.T) {
+	var called bool
+	l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if r.RequestURI != "/my/path?parameter1=value1&parameter1=value2&parameter2=value" {
+			t.Errorf("unexpected RequestURI: want %q, got %q", "/my/path?parameter1=value1&parameter1=value2&parameter2=value", r.RequestURI)
+		}
+		if r.RemoteAddr != "192.0.2.1:0" {
+			t.Errorf("unexpected RemoteAddr: want %q, got %q", "192.0.2.1:0", r.RemoteAddr)
+		}
+		http.SetCookie(w, &http.Cookie{Name: "foo", Value: "bar"})
+	}))
+	req, err := loadRequest("testdata/apigateway-v2-payload-v1-request.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isV2Request(req) {
+		t.Error("want version 1.0, got 2.0")
+	}
+	resp, err := l.lambdaHandler(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Error("the handler is not called")
+	}
+	if resp.Cookies != nil {
+		t.Errorf("unexpected cookies: %v", resp.Cookies)
+	}
+	if !reflect.DeepEqual(resp.MultiValueHeaders["Set-Cookie"], []string{"foo=bar"}) {
+		t.Errorf("unexpected Set-Cookie: want %v, got %v", []string{"foo=bar"}, resp.MultiValueHeaders["Set-Cookie"])
+	}
+}
+
+func TestHTTPRequestV2_MissingHTTP(t *testing.T) {
+	data := `{"version":"2.0","rawPath":"/","requestContext":{"requestId":"id"}}`
+	var req request
+	if err := json.Unmarshal([]byte(data), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("buffered", func(t *testing.T) {
+		l := newLambdaFunction(http.NotFoundHandler())
+		_, err := l.lambdaHandler(context.Background(), &req)
+		if !errors.Is(err, errMissingRequestContextHTTP) {
+			t.Errorf("want errMissingRequestContextHTTP, got %v", err)
+		}
+	})
+
+	t.Run("buffered with bad request response", func(t *testing.T) {
+		l := newLambdaFunction(http.NotFoundHandler())
+		l.logger = log.New(io.Discard, "", 0)
+		l.badRequestResponse = true
+		resp, err := l.lambdaHandler(context.Background(), &req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		l := newLambdaFunction(http.NotFoundHandler())
+		_, w := io.Pipe()
+		_, err := l.lambdaHandlerStreaming(context.Background(), &req, w)
+		if !errors.Is(err, errMissingRequestContextHTTP) {
+			t.Errorf("want errMissingRequestContextHTTP, got %v", err)
+		}
+	})
+}
+
+func TestHTTPRequest_ContentLength(t *testing.T) {
+	l := newLambdaFunction(nil)
+
+	t.Run("api gateway v1", func(t *testing.T) {
+		req, err := loadRequest("testdata/apigateway-post-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Headers["Content-Length"] = "1000"
+		req.MultiValueHeaders["Content-Length"] = []string{"1000"}
+		httpReq, err := l.httpRequestV1(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := strconv.FormatInt(httpReq.ContentLength, 10)
+		if httpReq.ContentLength != int64(len(req.Body)) {
+			t.Errorf("unexpected ContentLength: want %d, got %d", len(req.Body), httpReq.ContentLength)
+		}
+		if got := httpReq.Header.Get("Content-Length"); got != want {
+			t.Errorf("unexpected Content-Length: want %q, got %q", want, got)
+		}
+	})
+
+	t.Run("api gateway v2 with base64", func(t *testing.T) {
+		req, err := loadRequest("testdata/apigateway-v2-base64-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Headers["content-length"] = strconv.Itoa(len(req.Body)) // the length before decoding
+		httpReq, err := l.httpRequestV2(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(httpReq.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if httpReq.ContentLength != int64(len(body)) {
+			t.Errorf("unexpected ContentLength: want %d, got %d", len(body), httpReq.ContentLength)
+		}
+		if got, want := httpReq.Header.Get("Content-Length"), strconv.Itoa(len(body)); got != want {
+			t.Errorf("unexpected Content-Length: want %q, got %q", want, got)
+		}
+	})
+}
+
+func TestHTTPRequest_Trailer(t *testing.T) {
+	l := newLambdaFunction(nil)
+	tests := []struct {
+		name        string
+		path        string
+		httpRequest func(ctx context.Context, r *request) (*http.Request, error)
+	}{
+		{"api gateway v1", "testdata/apigateway-get-request.json", l.httpRequestV1},
+		{"api gateway v2", "testdata/apigateway-v2-get-request.json", l.httpRequestV2},
+		{"websocket", "testdata/websocket-message-request.json", l.httpRequestWebSocket},
+	}
+	for _, tt := range tests {
+		req, err := loadRequest(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpReq, err := tt.httpRequest(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if httpReq.Trailer == nil {
+			t.Errorf("%s: want non-nil Trailer, got nil", tt.name)
+		}
+	}
+}
+
+func TestHTTPRequest_TraceID(t *testing.T) {
+	l := newLambdaFunction(nil)
+	// nolint:staticcheck
+	ctx := context.WithValue(context.Background(), "x-amzn-trace-id", "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1")
+
+	t.Run("api gateway v1", func(t *testing.T) {
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(req.Headers, "X-Amzn-Trace-Id")
+		delete(req.MultiValueHeaders, "X-Amzn-Trace-Id")
+		httpReq, err := l.httpRequestV1(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := httpReq.Header.Get("X-Amzn-Trace-Id"); got != "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1" {
+			t.Errorf("unexpected X-Amzn-Trace-Id: %q", got)
+		}
+	})
+
+	t.Run("api gateway v2", func(t *testing.T) {
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(req.Headers, "x-amzn-trace-id")
+		httpReq, err := l.httpRequestV2(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := httpReq.Header.Get("X-Amzn-Trace-Id"); got != "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1" {
+			t.Errorf("unexpected X-Amzn-Trace-Id: %q", got)
+		}
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		req, err := loadRequest("testdata/websocket-message-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpReq, err := l.httpRequestWebSocket(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := httpReq.Header.Get("X-Amzn-Trace-Id"); got != "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1" {
+			t.Errorf("unexpected X-Amzn-Trace-Id: %q", got)
+		}
+	})
+
+	t.Run("alb", func(t *testing.T) {
+		req, err := loadRequest("testdata/alb-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpReq, err := l.httpRequestV1(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the header sent by ALB takes precedence.
+		if got := httpReq.Header.Get("X-Amzn-Trace-Id"); got != "Root=1-5c0f279e-761eb33e877ace561add4a4a" {
+			t.Errorf("unexpected X-Amzn-Trace-Id: %q", got)
+		}
+	})
+}
+
+func TestHTTPRequest_EncodedPath(t *testing.T) {
+	t.Run("api gateway v1", func(t *testing.T) {
+		req := &request{
+			HTTPMethod: http.MethodGet,
+			Path:       "/foo%2Fbar/baz",
+		}
+		l := newLambdaFunction(nil)
+		httpReq, err := l.httpRequestV1(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if httpReq.RequestURI != "/foo%2Fbar/baz" {
+			t.Errorf("unexpected RequestURI: want %q, got %q", "/foo%2Fbar/baz", httpReq.RequestURI)
+		}
+		if httpReq.URL.Path != "/foo/bar/baz" {
+			t.Errorf("unexpected Path: want %q, got %q", "/foo/bar/baz", httpReq.URL.Path)
+		}
+		if httpReq.URL.EscapedPath() != "/foo%2Fbar/baz" {
+			t.Errorf("unexpected EscapedPath: want %q, got %q", "/foo%2Fbar/baz", httpReq.URL.EscapedPath())
+		}
+	})
+
+	t.Run("api gateway v2", func(t *testing.T) {
+		req := &request{
+			Version: "2.0",
+			RawPath: "/foo%2Fbar/baz",
+			RequestContext: ProxyRequestContext{
+				HTTP: &ProxyRequestContextHTTP{
+					Method: http.MethodGet,
+					Path:   "/foo/bar/baz",
+				},
+			},
+		}
+		l := newLambdaFunction(nil)
+		httpReq, err := l.httpRequestV2(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if httpReq.RequestURI != "/foo%2Fbar/baz" {
+			t.Errorf("unexpected RequestURI: want %q, got %q", "/foo%2Fbar/baz", httpReq.RequestURI)
+		}
+		if httpReq.URL.Path != "/foo/bar/baz" {
+			t.Errorf("unexpected Path: want %q, got %q", "/foo/bar/baz", httpReq.URL.Path)
+		}
+		if httpReq.URL.EscapedPath() != "/foo%2Fbar/baz" {
+			t.Errorf("unexpected EscapedPath: want %q, got %q", "/foo%2Fbar/baz", httpReq.URL.EscapedPath())
+		}
+	})
+}
+
+func TestHTTPRequest_QueryOrder(t *testing.T) {
+	t.Run("single value", func(t *testing.T) {
+		var req request
+		data := `{"httpMethod":"GET","path":"/","queryStringParameters":{"z":"1","a":"2 3","m":"4"}}`
+		if err := json.Unmarshal([]byte(data), &req); err != nil {
+			t.Fatal(err)
+		}
+		l := newLambdaFunction(nil)
+		httpReq, err := l.httpRequestV1(context.Background(), &req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if httpReq.URL.RawQuery != "z=1&a=2+3&m=4" {
+			t.Errorf("unexpected RawQuery: want %q, got %q", "z=1&a=2+3&m=4", httpReq.URL.RawQuery)
+		}
+	})
+
+	t.Run("multi value", func(t *testing.T) {
+		var req request
+		data := `{"httpMethod":"GET","path":"/","queryStringParameters":{"z":"2","a":"3"},"multiValueQueryStringParameters":{"z":["1","2"],"a":["3"]}}`
+		if err := json.Unmarshal([]byte(data), &req); err != nil {
+			t.Fatal(err)
+		}
+		l := newLambdaFunction(nil)
+		httpReq, err := l.httpRequestV1(context.Background(), &req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if httpReq.URL.RawQuery != "z=1&z=2&a=3" {
+			t.Errorf("unexpected RawQuery: want %q, got %q", "z=1&z=2&a=3", httpReq.URL.RawQuery)
+		}
+	})
+
+	t.Run("unknown order", func(t *testing.T) {
+		req := &request{
+			HTTPMethod: http.MethodGet,
+			Path:       "/",
+			QueryStringParameters: map[string]string{
+				"z": "1",
+				"a": "2",
+			},
+		}
+		l := newLambdaFunction(nil)
+		httpReq, err := l.httpRequestV1(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if httpReq.URL.RawQuery != "a=2&z=1" {
+			t.Errorf("unexpected RawQuery: want %q, got %q", "a=2&z=1", httpReq.URL.RawQuery)
+		}
+	})
+}
+
+func TestHTTPRequest_QueryWithoutValue(t *testing.T) {
+	var req request
+	data := `{"httpMethod":"GET","path":"/",` +
+		`"queryStringParameters":{"flag":"","foo":"bar"},` +
+		`"multiValueQueryStringParameters":{"flag":[""],"foo":["bar"]}}`
+	if err := json.Unmarshal([]byte(data), &req); err != nil {
+		t.Fatal(err)
+	}
+	l := newLambdaFunction(nil)
+	httpReq, err := l.httpRequestV1(context.Background(), &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if httpReq.URL.RawQuery != "flag&foo=bar" {
+		t.Errorf("unexpected RawQuery: want %q, got %q", "flag&foo=bar", httpReq.URL.RawQuery)
+	}
+	if httpReq.RequestURI != "/?flag&foo=bar" {
+		t.Errorf("unexpected RequestURI: want %q, got %q", "/?flag&foo=bar", httpReq.RequestURI)
+	}
+	query := httpReq.URL.Query()
+	if v, ok := query["flag"]; !ok || !reflect.DeepEqual(v, []string{""}) {
+		t.Errorf("unexpected flag: want %q, got %q", []string{""}, v)
+	}
+	if got := query.Get("foo"); got != "bar" {
+		t.Errorf("unexpected foo: want %q, got %q", "bar", got)
+	}
+}
+
+func TestHTTPRequest_PathWithQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		want  string
+	}{
+		{
+			name:  "query only in path",
+			event: `{"httpMethod":"GET","path":"/a?b=c"}`,
+			want:  "/a?b=c",
+		},
+		{
+			name:  "query in both",
+			event: `{"httpMethod":"GET","path":"/a?b=c","queryStringParameters":{"query":"d"}}`,
+			want:  "/a?query=d",
+		},
+		{
+			name:  "empty query in path",
+			event: `{"httpMethod":"GET","path":"/a?","queryStringParameters":{"query":"d"}}`,
+			want:  "/a?query=d",
+		},
+	}
+	for _, tt := range tests {
+		var req request
+		if err := json.Unmarshal([]byte(tt.event), &req); err != nil {
+			t.Fatal(err)
+		}
+		l := newLambdaFunction(nil)
+		httpReq, err := l.httpRequestV1(context.Background(), &req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if httpReq.RequestURI != tt.want {
+			t.Errorf("%s: unexpected RequestURI: want %q, got %q", tt.name, tt.want, httpReq.RequestURI)
+		}
+		if httpReq.URL.Path != "/a" {
+			t.Errorf("%s: unexpected path: want %q, got %q", tt.name, "/a", httpReq.URL.Path)
+		}
+	}
+}
+
+func TestHTTPRequest_QueryMerge(t *testing.T) {
+	var req request
+	data := `{"httpMethod":"GET","path":"/",` +
+		`"queryStringParameters":{"single":"1","both":"2"},` +
+		`"multiValueQueryStringParameters":{"multi":["3","4"],"both":["5","6"]}}`
+	if err := json.Unmarshal([]byte(data), &req); err != nil {
+		t.Fatal(err)
+	}
+	l := newLambdaFunction(nil)
+	httpReq, err := l.httpRequestV1(context.Background(), &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "multi=3&multi=4&both=5&both=6&single=1"
+	if httpReq.URL.RawQuery != want {
+		t.Errorf("unexpected RawQuery: want %q, got %q", want, httpReq.URL.RawQuery)
+	}
+	query := httpReq.URL.Query()
+	if got := query["single"]; !reflect.DeepEqual(got, []string{"1"}) {
+		t.Errorf("unexpected single: want %v, got %v", []string{"1"}, got)
+	}
+	if got := query["multi"]; !reflect.DeepEqual(got, []string{"3", "4"}) {
+		t.Errorf("unexpected multi: want %v, got %v", []string{"3", "4"}, got)
+	}
+	if got := query["both"]; !reflect.DeepEqual(got, []string{"5", "6"}) {
+		t.Errorf("unexpected both: want %v, got %v", []string{"5", "6"}, got)
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	tests := []struct {
+		protocol string
+		proto    string
+		major    int
+		minor    int
+	}{
+		{"HTTP/1.1", "HTTP/1.1", 1, 1},
+		{"HTTP/1.0", "HTTP/1.0", 1, 0},
+		{"HTTP/2.0", "HTTP/2.0", 2, 0},
+		{"", "HTTP/1.1", 1, 1},
+		{"invalid", "HTTP/1.1", 1, 1},
+	}
+	for _, tt := range tests {
+		proto, major, minor := protocolVersion(tt.protocol)
+		if proto != tt.proto || major != tt.major || minor != tt.minor {
+			t.Errorf("protocolVersion(%q) = %q, %d, %d, want %q, %d, %d", tt.protocol, proto, major, minor, tt.proto, tt.major, tt.minor)
+		}
+	}
+}
+
+func TestRemoteAddr(t *testing.T) {
+	tests := []struct {
+		sourceIP string
+		want     string
+		host     string
+	}{
+		{"192.0.2.1", "192.0.2.1:0", "192.0.2.1"},
+		{"2001:db8::1", "[2001:db8::1]:0", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		got := remoteAddr(tt.sourceIP)
+		if got != tt.want {
+			t.Errorf("remoteAddr(%q) = %q, want %q", tt.sourceIP, got, tt.want)
+		}
+		host, port, err := net.SplitHostPort(got)
+		if err != nil {
+			t.Errorf("failed to split %q: %v", got, err)
+			continue
+		}
+		if host != tt.host || port != "0" {
+			t.Errorf("unexpected host and port: want %q and %q, got %q and %q", tt.host, "0", host, port)
+		}
+	}
+
+	if got := remoteAddr(""); got != "" {
+		t.Errorf("remoteAddr(%q) = %q, want %q", "", got, "")
+	}
+}
+
+func TestEncodeBase64(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 767, 768, 769, 1024, 1 << 20} {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		want := base64.StdEncoding.EncodeToString(data)
+		if got := encodeBase64(nil, data); got != want {
+			t.Errorf("encodeBase64: unexpected result for %d bytes", n)
+		}
+		want = base64.RawURLEncoding.EncodeToString(data)
+		if got := encodeBase64(base64.RawURLEncoding, data); got != want {
+			t.Errorf("encodeBase64: unexpected raw url encoding result for %d bytes", n)
+		}
+	}
+}
+
+func TestDecodeBody_EmptyBase64(t *testing.T) {
+	tests := []string{"", " ", "\n", " \r\n\t "}
+	for _, tt := range tests {
+		l := newLambdaFunction(nil)
+		l.badRequestResponse = true
+		body, contentLength, err := l.decodeBody(&request{
+			Body:            tt,
+			IsBase64Encoded: true,
+		})
+		if err != nil {
+			t.Errorf("decodeBody(%q) returns an error: %v", tt, err)
+			continue
+		}
+		if contentLength != 0 {
+			t.Errorf("decodeBody(%q): unexpected content length: want %d, got %d", tt, 0, contentLength)
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			t.Errorf("decodeBody(%q): failed to read the body: %v", tt, err)
+			continue
+		}
+		if len(data) != 0 {
+			t.Errorf("decodeBody(%q): unexpected body: %q", tt, data)
+		}
+	}
+}
+
+func TestDecodeBody_MangledBinary(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		warn  bool
+	}{
+		{"text", `{"httpMethod":"POST","path":"/","body":"hello, 世界"}`, false},
+		{"invalid utf-8", "{\"httpMethod\":\"POST\",\"path\":\"/\",\"body\":\"\x89PNG\"}", true},
+		{"replacement character", `{"httpMethod":"POST","path":"/","body":"\ufffdPNG"}`, true},
+		{"base64", `{"httpMethod":"POST","path":"/","body":"iVBORw==","isBase64Encoded":true}`, false},
+	}
+	for _, tt := range tests {
+		var logs strings.Builder
+		l := newLambdaFunction(nil)
+		l.logger = log.New(&logs, "", 0)
+		var req request
+		if err := json.Unmarshal([]byte(tt.event), &req); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := l.decodeBody(&req); err != nil {
+			t.Fatal(err)
+		}
+		if warned := strings.Contains(logs.String(), "binary media types"); warned != tt.warn {
+			t.Errorf("%s: unexpected log: %q", tt.name, logs.String())
+		}
+	}
+}
+
+func TestDecodeBody_MangledBinaryOnce(t *testing.T) {
+	var logs strings.Builder
+	l := newLambdaFunction(nil)
+	l.logger = log.New(&logs, "", 0)
+	for i := 0; i < 3; i++ {
+		req := &request{
+			HTTPMethod: http.MethodPost,
+			Path:       "/",
+			Body:       "\ufffdPNG",
+		}
+		if _, _, err := l.decodeBody(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := strings.Count(logs.String(), "binary media types"); n != 1 {
+		t.Errorf("want the warning once, got %d times: %q", n, logs.String())
+	}
+}
+
+func TestBase64DecodedLen(t *testing.T) {
+	tests := []string{
+		"",
+		"a",
+		"ab",
+		"abc",
+		"abcd",
+		"abcde",
+		"abcdef",
+		"{\"hello\":\"world\"}",
+	}
+	for _, tt := range tests {
+		encoded := base64.StdEncoding.EncodeToString([]byte(tt))
+		if got, want := base64DecodedLen(encoded), len(tt); got != want {
+			t.Errorf("base64DecodedLen(%q) = %d, want %d", encoded, got, want)
+		}
+		encoded = base64.RawStdEncoding.EncodeToString([]byte(tt))
+		if got, want := base64DecodedLen(encoded), len(tt); got != want {
+			t.Errorf("base64DecodedLen(%q) = %d, want %d", encoded, got, want)
+		}
+	}
+}
+
+func TestDecodeBody_Base64Encodings(t *testing.T) {
+	data := "\xfb\xff\xfe hello world"
+	tests := []struct {
+		name string
+		enc  *base64.Encoding
+	}{
+		{"standard", base64.StdEncoding},
+		{"raw standard", base64.RawStdEncoding},
+		{"url-safe", base64.URLEncoding},
+		{"raw url-safe", base64.RawURLEncoding},
+	}
+	for _, tt := range tests {
+		l := newLambdaFunction(nil)
+		l.badRequestResponse = true
+		body, contentLength, err := l.decodeBody(&request{
+			Body:            tt.enc.EncodeToString([]byte(data)),
+			IsBase64Encoded: true,
+		})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if contentLength != int64(len(data)) {
+			t.Errorf("%s: unexpected content length: want %d, got %d", tt.name, len(data), contentLength)
+		}
+		got, err := io.ReadAll(body)
+		if err != nil {
+			t.Errorf("%s: failed to read the body: %v", tt.name, err)
+			continue
+		}
+		if string(got) != data {
+			t.Errorf("%s: unexpected body: want %q, got %q", tt.name, data, got)
+		}
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		l := newLambdaFunction(nil)
+		l.badRequestResponse = true
+		_, _, err := l.decodeBody(&request{
+			Body:            "!!invalid!!",
+			IsBase64Encoded: true,
+		})
+		var reqErr *requestError
+		if !errors.As(err, &reqErr) || reqErr.statusCode != http.StatusBadRequest {
+			t.Errorf("want 400 Bad Request, got %v", err)
+		}
+	})
+}
+
+func TestResponseV1(t *testing.T) {
+	t.Run("normal", func(t *testing.T) {
+		rw := newResponseWriter()
+		// normal header fields
+		rw.Header().Add("foo", "foo")
+
+		// multi line header fields
+		rw.Header().Add("bar", "bar1")
+		rw.Header().Add("bar", "bar2")
+
+		// cookie
+		rw.Header().Add("Set-Cookie", "foo1=bar1")
+		rw.Header().Add("Set-Cookie", "foo2=bar2")
+
+		if _, err := io.WriteString(rw, "<!DOCTYPE html>\n"); err != nil {
+			t.Error(err)
+		}
+		if _, err := rw.Write([]byte("<html><body>Hello!</body></html>")); err != nil {
+			t.Error(err)
+		}
+
+		resp, err := rw.lambdaResponseV1()
+		if err != nil {
+			t.Error(err)
+		}
+		if resp.Headers["Foo"] != "foo" {
+			t.Errorf("unexpected header: want %q, got %q", "foo", resp.Headers["Foo"])
+		}
+		if resp.Headers["Bar"] != "bar1, bar2" {
+			t.Errorf("unexpected header: want %q, got %q", "bar1, bar2", resp.Headers["Bar"])
+		}
+		if resp.Headers["Set-Cookie"] != "foo1=bar1" {
+			t.Errorf("unexpected header: want %q, got %q", "bar1, bar2", resp.Headers["Bar"])
+		}
+		if !reflect.DeepEqual(resp.MultiValueHeaders["Foo"], []string{"foo"}) {
+			t.Errorf("unexpected header: want %#v, got %#v", []string{"foo"}, resp.MultiValueHeaders["Foo"])
+		}
+		if !reflect.DeepEqual(resp.MultiValueHeaders["Bar"], []string{"bar1", "bar2"}) {
+			t.Errorf("unexpected header: want %#v, got %#v", []string{"bar1", "bar2"}, resp.MultiValueHeaders["Bar"])
+		}
+
+		// Content-Type is auto detected.
+		if resp.Headers["Content-Type"] != "text/html; charset=utf-8" {
+			t.Errorf("unexpected header: want %q, got %q", "text/html; charset=utf-8", resp.Headers["Content-Type"])
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if resp.Body != "<!DOCTYPE html>\n<html><body>Hello!</body></html>" {
+			t.Errorf("unexpected body: want %q, got %q", "<!DOCTYPE html>\n<html><body>Hello!</body></html>", resp.Body)
+		}
+		if resp.IsBase64Encoded {
+			t.Error("unexpected IsBase64Encoded: want false, got true")
+		}
+	})
+	t.Run("set content-type", func(t *testing.T) {
+		rw := newResponseWriter()
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if _, err := io.WriteString(rw, "<!DOCTYPE html>\n"); err != nil {
+			t.Error(err)
+		}
+		if _, err := rw.Write([]byte("<html><body>Hello!</body></html>")); err != nil {
+			t.Error(err)
+		}
+
+		resp, err := rw.lambdaResponseV1()
+		if err != nil {
+			t.Error(err)
+		}
+
+		// Content-Type is auto detected.
+		if resp.Headers["Content-Type"] != "text/plain; charset=utf-8" {
+			t.Errorf("unexpected header: want %q, got %q", "text/plain; charset=utf-8", resp.Headers["Content-Type"])
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if resp.Body != "<!DOCTYPE html>\n<html><body>Hello!</body></html>" {
+			t.Errorf("unexpected body: want %q, got %q", "<!DOCTYPE html>\n<html><body>Hello!</body></html>", resp.Body)
+		}
+		if resp.IsBase64Encoded {
+			t.Error("unexpected IsBase64Encoded: want false, got true")
+		}
+	})
+	t.Run("svg as text", func(t *testing.T) {
+		rw := newResponseWriter()
+		rw.Header().Set("Content-Type", "image/svg+xml")
+		rw.Header().Set("X-Lambda-Http-Content-Encoding", "text")
+		if _, err := io.WriteString(rw, `<svg xmlns="http://www.w3.org/2000/svg"></svg>`); err != nil {
+			t.Error(err)
+		}
+
+		resp, err := rw.lambdaResponseV1()
+		if err != nil {
+			t.Error(err)
+		}
+		if resp.Body != `<svg xmlns="http://www.w3.org/2000/svg"></svg>` {
+			t.Errorf("unexpected body: want %q, got %q", `<svg xmlns="http://www.w3.org/2000/svg"></svg>`, resp.Body)
+		}
+		if resp.IsBase64Encoded {
+			t.Error("unexpected IsBase64Encoded: want false, got true")
+		}
+		if v, ok := resp.Headers["X-Lambda-Http-Content-Encoding"]; ok {
+			t.Errorf("unexpected header: want None, got %q", v)
+		}
+		if v, ok := resp.MultiValueHeaders["X-Lambda-Http-Content-Encoding"]; ok {
+			t.Errorf("unexpected header: want None, got %q", v)
+		}
+	})
+	t.Run("redirect to example.com", func(t *testing.T) {
+		rw := newResponseWriter()
+		rw.Header().Add("location", "http://example.com/")
+		rw.WriteHeader(http.StatusFound)
+		if _, err := io.WriteString(rw, "<!DOCTYPE html>\n"); err != nil {
+			t.Error(err)
+		}
+		if _, err := rw.Write([]byte("<html><body>Redirect to <a href=http://example.com/>example.com</a></body></html>")); err != nil {
+			t.Error(err)
+		}
+
+		resp, err := rw.lambdaResponseV1()
+		if err != nil {
+			t.Error(err)
+		}
+		if resp.Headers["Location"] != "http://example.com/" {
+			t.Errorf("unexpected header: want %q, got %q", "http://example.com/", resp.Headers["Foo"])
+		}
+		if resp.StatusCode != http.StatusFound {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusFound, resp.StatusCode)
+		}
+		if resp.Body != "<!DOCTYPE html>\n<html><body>Redirect to <a href=http://example.com/>example.com</a></body></html>" {
+			t.Errorf("unexpected body: want %q, got %q", "<!DOCTYPE html>\n<html><body>Redirect to <a href=http://example.com/>example.com</a></body></html>", resp.Body)
+		}
+		if resp.IsBase64Encoded {
+			t.Error("unexpected IsBase64Encoded: want false, got true")
+		}
+	})
+	t.Run("base64", func(t *testing.T) {
+		rw := newResponseWriter()
+		// 1x1 PNG image
+		if _, err := io.WriteString(rw, "\x89\x50\x4e\x47\x0d\x0a\x1a\x0a\x00\x00\x00\x0d\x49\x48\x44\x52"); err != nil {
+			t.Error(err)
+		}
+		if _, err := io.WriteString(rw, "\x00\x00\x00\x01\x00\x00\x00\x01\x08\x04\x00\x00\x00\xb5\x1c\x0c"); err != nil {
+			t.Error(err)
+		}
+		if _, err := io.WriteString(rw, "\x02\x00\x00\x00\x0b\x49\x44\x41\x54\x08\xd7\x63\x60\x60\x00\x00"); err != nil {
+			t.Error(err)
+		}
+		if _, err := io.WriteString(rw, "\x00\x03\x00\x01\x20\xd5\x94\xc7\x00\x00\x00\x00\x49\x45\x4e\x44"); err != nil {
+			t.Error(err)
+		}
+		if _, err := io.WriteString(rw, "\xae\x42\x60\x82"); err != nil {
+			t.Error(err)
+		}
+
+		resp, err := rw.lambdaResponseV1()
+		if err != nil {
+			t.Error(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if resp.Body != "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVQI12NgYAAAAAMAASDVlMcAAAAASUVORK5CYII=" {
+			t.Errorf("unexpected body: want %q, got %q", "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVQI12NgYAAAAAMAASDVlMcAAAAASUVORK5CYII=", resp.Body)
+		}
+		if !resp.IsBase64Encoded {
+			t.Error("unexpected IsBase64Encoded: want true, got false")
+		}
+	})
+}
+
+func TestResponse_MultipleCookies(t *testing.T) {
+	cookies := []string{"a=1", "b=2", "c=3"}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, cookie := range cookies {
+			w.Header().Add("Set-Cookie", cookie)
+		}
+	})
+
+	t.Run("api gateway v1", func(t *testing.T) {
+		var logs strings.Builder
+		l := newLambdaFunction(h)
+		l.logger = log.New(&logs, "", 0)
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resp.MultiValueHeaders["Set-Cookie"], cookies) {
+			t.Errorf("unexpected Set-Cookie: want %v, got %v", cookies, resp.MultiValueHeaders["Set-Cookie"])
+		}
+		if logs.Len() != 0 {
+			t.Errorf("unexpected log: %q", logs.String())
+		}
+	})
+
+	t.Run("alb with multi value headers", func(t *testing.T) {
+		var logs strings.Builder
+		l := newLambdaFunction(h)
+		l.logger = log.New(&logs, "", 0)
+		req, err := loadRequest("testdata/alb-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resp.MultiValueHeaders["Set-Cookie"], cookies) {
+			t.Errorf("unexpected Set-Cookie: want %v, got %v", cookies, resp.MultiValueHeaders["Set-Cookie"])
+		}
+		if logs.Len() != 0 {
+			t.Errorf("unexpected log: %q", logs.String())
+		}
+	})
+
+	t.Run("alb with single value headers", func(t *testing.T) {
+		var logs strings.Builder
+		l := newLambdaFunction(h)
+		l.logger = log.New(&logs, "", 0)
+		req, err := loadRequest("testdata/alb-single-value-headers-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Headers["Set-Cookie"] != "a=1" {
+			t.Errorf("unexpected Set-Cookie: want %q, got %q", "a=1", resp.Headers["Set-Cookie"])
+		}
+		if !strings.Contains(logs.String(), "only the first of 3 Set-Cookie headers is sent") {
+			t.Errorf("unexpected log: %q", logs.String())
+		}
+	})
+}
+
+func TestResponse_WWWAuthenticate(t *testing.T) {
+	challenges := []string{`Basic realm="foo, bar"`, `Bearer realm="example"`}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, challenge := range challenges {
+			w.Header().Add("WWW-Authenticate", challenge)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	t.Run("api gateway v1", func(t *testing.T) {
+		l := newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resp.MultiValueHeaders["Www-Authenticate"], challenges) {
+			t.Errorf("unexpected WWW-Authenticate: want %v, got %v", challenges, resp.MultiValueHeaders["Www-Authenticate"])
+		}
+		if resp.Headers["Www-Authenticate"] != challenges[0] {
+			t.Errorf("unexpected WWW-Authenticate: want %q, got %q", challenges[0], resp.Headers["Www-Authenticate"])
+		}
+	})
+
+	t.Run("api gateway v2", func(t *testing.T) {
+		l := newLambdaFunction(h)
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := strings.Join(challenges, ", ")
+		if resp.Headers["Www-Authenticate"] != want {
+			t.Errorf("unexpected WWW-Authenticate: want %q, got %q", want, resp.Headers["Www-Authenticate"])
+		}
+	})
+}
+
+func TestResponse_PassThroughBase64(t *testing.T) {
+	png := "\x89PNG\x0D\x0A\x1A\x0A" + strings.Repeat("\x00", 8)
+	encoded := base64.StdEncoding.EncodeToString([]byte(png))
+
+	t.Run("with content type", func(t *testing.T) {
+		rw := newResponseWriter()
+		rw.Header().Set("Content-Type", "application/octet-stream")
+		rw.Header().Set("X-Lambda-Http-Content-Encoding", "base64")
+		if _, err := io.WriteString(rw, encoded); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := rw.lambdaResponseV2()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Body != encoded {
+			t.Errorf("unexpected body: want %q, got %q", encoded, resp.Body)
+		}
+		if !resp.IsBase64Encoded {
+			t.Error("want base64 encoded, but not")
+		}
+		if _, ok := resp.Headers["X-Lambda-Http-Content-Encoding"]; ok {
+			t.Error("X-Lambda-Http-Content-Encoding must be removed")
+		}
+		if resp.Headers["Content-Type"] != "application/octet-stream" {
+			t.Errorf("unexpected content type: want %q, got %q", "application/octet-stream", resp.Headers["Content-Type"])
+		}
+	})
+
+	t.Run("without content type", func(t *testing.T) {
+		rw := newResponseWriter()
+		rw.Header().Set("X-Lambda-Http-Content-Encoding", "base64")
+		if _, err := io.WriteString(rw, encoded); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := rw.lambdaResponseV1()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Body != encoded {
+			t.Errorf("unexpected body: want %q, got %q", encoded, resp.Body)
+		}
+		if !resp.IsBase64Encoded {
+			t.Error("want base64 encoded, but not")
+		}
+		if resp.Headers["Content-Type"] != "image/png" {
+			t.Errorf("unexpected content type: want %q, got %q", "image/png", resp.Headers["Content-Type"])
+		}
+	})
+}
+
+func TestLambdaHandler_TextHint(t *testing.T) {
+	body := `<svg xmlns="http://www.w3.org/2000/svg"></svg>`
+	l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the content type is binary by WithBinaryTypeFunc, but the handler knows the body is text.
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Header().Set("X-Lambda-Http-Content-Encoding", "text")
+		_, _ = io.WriteString(w, body)
+	}))
+	l.isBinaryType = func(contentType string) bool { return true }
+
+	for _, path := range []string{
+		"testdata/apigateway-get-request.json",
+		"testdata/apigateway-v2-get-request.json",
+		"testdata/alb-get-request.json",
+	} {
+		req, err := loadRequest(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.IsBase64Encoded {
+			t.Errorf("%s: want text, got base64", path)
+		}
+		if resp.Body != body {
+			t.Errorf("%s: unexpected body: want %q, got %q", path, body, resp.Body)
+		}
+		if _, ok := resp.Headers["X-Lambda-Http-Content-Encoding"]; ok {
+			t.Errorf("%s: X-Lambda-Http-Content-Encoding must be removed", path)
+		}
+		if _, ok := resp.MultiValueHeaders["X-Lambda-Http-Content-Encoding"]; ok {
+			t.Errorf("%s: X-Lambda-Http-Content-Encoding must be removed", path)
+		}
+	}
+}
+
+func TestResponseALB(t *testing.T) {
+	l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	t.Run("alb", func(t *testing.T) {
+		req, err := loadRequest("testdata/alb-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.RequestContext.ELB == nil {
+			t.Fatal("want elb, got nil")
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusNotFound, resp.StatusCode)
+		}
+		if resp.StatusDescription != "404 Not Found" {
+			t.Errorf("unexpected status description: want %q, got %q", "404 Not Found", resp.StatusDescription)
+		}
+	})
+
+	t.Run("alb with multi value headers", func(t *testing.T) {
+		req, err := loadRequest("testdata/alb-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Headers != nil {
+			t.Errorf("unexpected headers: %v", resp.Headers)
+		}
+		if resp.MultiValueHeaders["Content-Type"] == nil {
+			t.Errorf("want Content-Type in multiValueHeaders, got %v", resp.MultiValueHeaders)
+		}
+	})
+
+	t.Run("alb with single value headers", func(t *testing.T) {
+		req, err := loadRequest("testdata/alb-single-value-headers-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusDescription != "404 Not Found" {
+			t.Errorf("unexpected status description: want %q, got %q", "404 Not Found", resp.StatusDescription)
+		}
+		if resp.MultiValueHeaders != nil {
+			t.Errorf("unexpected multiValueHeaders: %v", resp.MultiValueHeaders)
+		}
+		if resp.Headers["Content-Type"] == "" {
+			t.Errorf("want Content-Type in headers, got %v", resp.Headers)
+		}
+	})
+
+	t.Run("api gateway", func(t *testing.T) {
+		req, err := loadRequest("testdata/apigateway-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusDescription != "" {
+			t.Errorf("unexpected status description: want %q, got %q", "", resp.StatusDescription)
+		}
+		if resp.Headers == nil || resp.MultiValueHeaders == nil {
+			t.Errorf("want both headers and multiValueHeaders, got %v and %v", resp.Headers, resp.MultiValueHeaders)
+		}
+	})
+}
+
+func TestResponseV2(t *testing.T) {
+	t.Run("normal", func(t *testing.T) {
+		rw := newResponseWriter()
+
+		// normal header fields
+		rw.Header().Add("foo", "foo")
+
+		// multi line header fields
+		rw.Header().Add("bar", "bar1")
+		rw.Header().Add("bar", "bar2")
+
+		// cookie
+		rw.Header().Add("Set-Cookie", "foo1=bar1")
+		rw.Header().Add("Set-Cookie", "foo2=bar2")
+
+		if _, err := io.WriteString(rw, "<!DOCTYPE html>\n"); err != nil {
+			t.Error(err)
+		}
+		if _, err := rw.Write([]byte("<html><body>Hello!</body></html>")); err != nil {
+			t.Error(err)
+		}
+
+		resp, err := rw.lambdaResponseV2()
+		if err != nil {
+			t.Error(err)
+		}
+
+		// test headers
 		if resp.Headers["Foo"] != "foo" {
 			t.Errorf("unexpected header: want %q, got %q", "foo", resp.Headers["Foo"])
 		}
-		if resp.Headers["Bar"] != "bar1, bar2" {
-			t.Errorf("unexpected header: want %q, got %q", "bar1, bar2", resp.Headers["Bar"])
+		if resp.Headers["Bar"] != "bar1, bar2" {
+			t.Errorf("unexpected header: want %q, got %q", "bar1, bar2", resp.Headers["Bar"])
+		}
+		if v, ok := resp.Headers["Set-Cookie"]; ok {
+			t.Errorf("unexpected header: want None, got %q", v)
+		}
+		if got, want := resp.Cookies, []string{"foo1=bar1", "foo2=bar2"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected cookie: want %#v, got %#v", want, got)
+		}
+
+		// Content-Type is auto detected.
+		if resp.Headers["Content-Type"] != "text/html; charset=utf-8" {
+			t.Errorf("unexpected header: want %q, got %q", "text/html; charset=utf-8", resp.Headers["Content-Type"])
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if resp.Body != "<!DOCTYPE html>\n<html><body>Hello!</body></html>" {
+			t.Errorf("unexpected body: want %q, got %q", "<!DOCTYPE html>\n<html><body>Hello!</body></html>", resp.Body)
+		}
+		if resp.IsBase64Encoded {
+			t.Error("unexpected IsBase64Encoded: want false, got true")
+		}
+	})
+	t.Run("set content-type", func(t *testing.T) {
+		rw := newResponseWriter()
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if _, err := io.WriteString(rw, "<!DOCTYPE html>\n"); err != nil {
+			t.Error(err)
+		}
+		if _, err := rw.Write([]byte("<html><body>Hello!</body></html>")); err != nil {
+			t.Error(err)
+		}
+
+		resp, err := rw.lambdaResponseV1()
+		if err != nil {
+			t.Error(err)
+		}
+
+		// Content-Type is auto detected.
+		if resp.Headers["Content-Type"] != "text/plain; charset=utf-8" {
+			t.Errorf("unexpected header: want %q, got %q", "text/plain; charset=utf-8", resp.Headers["Content-Type"])
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if resp.Body != "<!DOCTYPE html>\n<html><body>Hello!</body></html>" {
+			t.Errorf("unexpected body: want %q, got %q", "<!DOCTYPE html>\n<html><body>Hello!</body></html>", resp.Body)
+		}
+		if resp.IsBase64Encoded {
+			t.Error("unexpected IsBase64Encoded: want false, got true")
+		}
+	})
+	t.Run("redirect to example.com", func(t *testing.T) {
+		rw := newResponseWriter()
+		rw.Header().Add("location", "http://example.com/")
+		rw.WriteHeader(http.StatusFound)
+		if _, err := io.WriteString(rw, "<!DOCTYPE html>\n"); err != nil {
+			t.Error(err)
+		}
+		if _, err := rw.Write([]byte("<html><body>Redirect to <a href=http://example.com/>example.com</a></body></html>")); err != nil {
+			t.Error(err)
+		}
+
+		resp, err := rw.lambdaResponseV1()
+		if err != nil {
+			t.Error(err)
+		}
+		if resp.Headers["Location"] != "http://example.com/" {
+			t.Errorf("unexpected header: want %q, got %q", "http://example.com/", resp.Headers["Foo"])
+		}
+		if resp.StatusCode != http.StatusFound {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusFound, resp.StatusCode)
+		}
+		if resp.Body != "<!DOCTYPE html>\n<html><body>Redirect to <a href=http://example.com/>example.com</a></body></html>" {
+			t.Errorf("unexpected body: want %q, got %q", "<!DOCTYPE html>\n<html><body>Redirect to <a href=http://example.com/>example.com</a></body></html>", resp.Body)
+		}
+		if resp.IsBase64Encoded {
+			t.Error("unexpected IsBase64Encoded: want false, got true")
+		}
+	})
+	t.Run("base64", func(t *testing.T) {
+		rw := newResponseWriter()
+		// 1x1 PNG image
+		if _, err := io.WriteString(rw, "\x89\x50\x4e\x47\x0d\x0a\x1a\x0a\x00\x00\x00\x0d\x49\x48\x44\x52"); err != nil {
+			t.Error(err)
+		}
+		if _, err := io.WriteString(rw, "\x00\x00\x00\x01\x00\x00\x00\x01\x08\x04\x00\x00\x00\xb5\x1c\x0c"); err != nil {
+			t.Error(err)
+		}
+		if _, err := io.WriteString(rw, "\x02\x00\x00\x00\x0b\x49\x44\x41\x54\x08\xd7\x63\x60\x60\x00\x00"); err != nil {
+			t.Error(err)
+		}
+		if _, err := io.WriteString(rw, "\x00\x03\x00\x01\x20\xd5\x94\xc7\x00\x00\x00\x00\x49\x45\x4e\x44"); err != nil {
+			t.Error(err)
+		}
+		if _, err := io.WriteString(rw, "\xae\x42\x60\x82"); err != nil {
+			t.Error(err)
+		}
+
+		resp, err := rw.lambdaResponseV1()
+		if err != nil {
+			t.Error(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if resp.Body != "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVQI12NgYAAAAAMAASDVlMcAAAAASUVORK5CYII=" {
+			t.Errorf("unexpected body: want %q, got %q", "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVQI12NgYAAAAAMAASDVlMcAAAAASUVORK5CYII=", resp.Body)
+		}
+		if !resp.IsBase64Encoded {
+			t.Error("unexpected IsBase64Encoded: want true, got false")
+		}
+	})
+}
+
+func BenchmarkRequest_binary(b *testing.B) {
+	l := newLambdaFunction(nil)
+	req, err := loadRequest("testdata/apigateway-base64-request.json")
+	if err != nil {
+		b.Fatal(err)
+	}
+	req.Body = base64.StdEncoding.EncodeToString(make([]byte, 1<<20))
+	req.IsBase64Encoded = true
+	buf := make([]byte, 1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, _ := l.httpRequestV1(context.Background(), req)
+		io.CopyBuffer(io.Discard, r.Body, buf)
+	}
+}
+
+func BenchmarkRequest_text(b *testing.B) {
+	l := newLambdaFunction(nil)
+	req, err := loadRequest("testdata/apigateway-base64-request.json")
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := make([]byte, 1<<20)
+	for i := 0; i < len(data); i++ {
+		data[i] = 'a'
+	}
+	req.Body = string(data)
+	req.IsBase64Encoded = false
+	buf := make([]byte, 1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, _ := l.httpRequestV1(context.Background(), req)
+		io.CopyBuffer(io.Discard, r.Body, buf)
+	}
+}
+
+func BenchmarkResponse_binary(b *testing.B) {
+	data := make([]byte, 1<<20) // 1MB: the maximum size of the response JSON in ALB
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rw := newResponseWriter()
+		rw.Write(data)
+		rw.lambdaResponseV1()
+	}
+}
+
+func BenchmarkResponse_text(b *testing.B) {
+	data := make([]byte, 1<<20) // 1MB: the maximum size of the response JSON in ALB
+	for i := 0; i < len(data); i++ {
+		data[i] = 'a'
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rw := newResponseWriter()
+		rw.Write(data)
+		rw.lambdaResponseV1()
+	}
+}
+
+func BenchmarkLambdaHandler(b *testing.B) {
+	data := make([]byte, 64<<10)
+	for i := 0; i < len(data); i++ {
+		data[i] = 'a'
+	}
+	l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(data)
+	}))
+	req, err := loadRequest("testdata/apigateway-get-request.json")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l.lambdaHandler(context.Background(), req)
+		}
+	})
+}
+
+func TestLambdaHandlerStreaming_ServerSentEvents(t *testing.T) {
+	received := make(chan struct{})
+	l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		f := w.(http.Flusher)
+		for i := 1; i <= 2; i++ {
+			if _, err := fmt.Fprintf(w, "data: %d\n\n", i); err != nil {
+				t.Error(err)
+			}
+			f.Flush()
+
+			// wait for the client to receive the event.
+			select {
+			case <-received:
+			case <-time.After(time.Second):
+				t.Errorf("event %d is not received", i)
+				return
+			}
+		}
+	}))
+	r, w := io.Pipe()
+	_, err := l.lambdaHandlerStreaming(context.Background(), &request{
+		RequestContext: ProxyRequestContext{
+			HTTP: &ProxyRequestContextHTTP{
+				Path: "/events",
+			},
+		},
+	}, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each write to the pipe is received by a separate read.
+	buf := make([]byte, 4096)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prelude := "{\"statusCode\":200,\"headers\":{\"Cache-Control\":\"no-cache\",\"Content-Type\":\"text/event-stream\"}}\x00\x00\x00\x00\x00\x00\x00\x00"
+	if got := string(buf[:n]); got != prelude {
+		t.Errorf("unexpected prelude: want %q, got %q", prelude, got)
+	}
+	for i := 1; i <= 2; i++ {
+		n, err := r.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(buf[:n]), fmt.Sprintf("data: %d\n\n", i); got != want {
+			t.Errorf("unexpected event: want %q, got %q", want, got)
+		}
+		received <- struct{}{}
+	}
+	if _, err := r.Read(buf); err != io.EOF {
+		t.Errorf("want io.EOF, got %v", err)
+	}
+}
+
+func TestLambdaHandlerStreaming_ContentLength(t *testing.T) {
+	l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "100")
+		_, _ = io.WriteString(w, "hello")
+	}))
+	r, w := io.Pipe()
+	_, err := l.lambdaHandlerStreaming(context.Background(), &request{
+		RequestContext: ProxyRequestContext{
+			HTTP: &ProxyRequestContextHTTP{
+				Path: "/",
+			},
+		},
+	}, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "{\"statusCode\":200,\"headers\":{\"Content-Type\":\"text/plain\"}}\x00\x00\x00\x00\x00\x00\x00\x00hello"
+	if string(data) != want {
+		t.Errorf("unexpected response: want %q, got %q", want, string(data))
+	}
+}
+
+func TestLambdaHandlerStreaming_ClientGone(t *testing.T) {
+	done := make(chan struct{})
+	l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, "hello") // it may fail because the client is gone.
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+			t.Error("the request context is not canceled")
+		}
+	}))
+	r, w := io.Pipe()
+	r.CloseWithError(errors.New("client is gone"))
+	_, err := l.lambdaHandlerStreaming(context.Background(), &request{
+		RequestContext: ProxyRequestContext{
+			HTTP: &ProxyRequestContextHTTP{
+				Path: "/",
+			},
+		},
+	}, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
+
+func TestLambdaHandlerStreaming_KeepContentLength(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentLength string
+		want          string
+		wantLog       bool
+	}{
+		{"accurate", "5", "{\"statusCode\":200,\"headers\":{\"Content-Length\":\"5\",\"Content-Type\":\"text/plain\"}}\x00\x00\x00\x00\x00\x00\x00\x00hello", false},
+		{"mismatch", "100", "{\"statusCode\":200,\"headers\":{\"Content-Length\":\"100\",\"Content-Type\":\"text/plain\"}}\x00\x00\x00\x00\x00\x00\x00\x00hello", true},
+		{"invalid", "five", "{\"statusCode\":200,\"headers\":{\"Content-Type\":\"text/plain\"}}\x00\x00\x00\x00\x00\x00\x00\x00hello", false},
+		{"absent", "", "{\"statusCode\":200,\"headers\":{\"Content-Type\":\"text/plain\"}}\x00\x00\x00\x00\x00\x00\x00\x00hello", false},
+	}
+	for _, tt := range tests {
+		var logs strings.Builder
+		l := newOptions([]Option{
+			WithStreamingContentLength(),
+			WithLogger(log.New(&logs, "", 0)),
+		}).newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			if tt.contentLength != "" {
+				w.Header().Set("Content-Length", tt.contentLength)
+			}
+			_, _ = io.WriteString(w, "hello")
+		}))
+		r, w := io.Pipe()
+		_, err := l.lambdaHandlerStreaming(context.Background(), &request{
+			RequestContext: ProxyRequestContext{
+				HTTP: &ProxyRequestContextHTTP{
+					Path: "/",
+				},
+			},
+		}, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("%s: unexpected response: want %q, got %q", tt.name, tt.want, string(data))
+		}
+		if got := strings.Contains(logs.String(), "doesn't match the body length"); got != tt.wantLog {
+			t.Errorf("%s: unexpected log: %q", tt.name, logs.String())
+		}
+	}
+}
+
+func TestLambdaHandlerStreaming(t *testing.T) {
+	t.Run("normal", func(t *testing.T) {
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if _, err := io.WriteString(w, `{"hello":"world"}`); err != nil {
+				t.Error(err)
+			}
+		}))
+		r, w := io.Pipe()
+		contentType, err := l.lambdaHandlerStreaming(context.Background(), &request{
+			RequestContext: ProxyRequestContext{
+				HTTP: &ProxyRequestContextHTTP{
+					Path: "/",
+				},
+			},
+		}, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := contentType, "application/vnd.awslambda.http-integration-response"; got != want {
+			t.Errorf("unexpected content type: want %q, got %q", want, got)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(data), "{\"statusCode\":200,\"headers\":{\"Content-Type\":\"application/json\"}}\x00\x00\x00\x00\x00\x00\x00\x00{\"hello\":\"world\"}"; got != want {
+			t.Errorf("unexpected body: want %q, got %q", want, got)
+		}
+	})
+
+	t.Run("WriteHeader", func(t *testing.T) {
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+
+			// Writes to ResponseWriter are buffered,
+			// so multiple writes to ResponseWriter become a single write to the pipe
+			if _, err := io.WriteString(w, `{"hello":`); err != nil {
+				t.Error(err)
+			}
+			if _, err := io.WriteString(w, `"world"}`); err != nil {
+				t.Error(err)
+			}
+		}))
+		r, w := io.Pipe()
+		contentType, err := l.lambdaHandlerStreaming(context.Background(), &request{
+			RequestContext: ProxyRequestContext{
+				HTTP: &ProxyRequestContextHTTP{
+					Path: "/",
+				},
+			},
+		}, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := contentType, "application/vnd.awslambda.http-integration-response"; got != want {
+			t.Errorf("unexpected content type: want %q, got %q", want, got)
+		}
+
+		// Reads and Writes on the pipe are matched one to one,
+		// so we get only the header on first read.
+		buf := make([]byte, 1024)
+		n, err := r.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(buf[:n]), "{\"statusCode\":200,\"headers\":{\"Content-Type\":\"application/json\"}}\x00\x00\x00\x00\x00\x00\x00\x00"; got != want {
+			t.Errorf("unexpected body: want %q, got %q", want, got)
+		}
+
+		// The second read gets the body.
+		n, err = r.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(buf[:n]), "{\"hello\":\"world\"}"; got != want {
+			t.Errorf("unexpected body: want %q, got %q", want, got)
+		}
+
+		// The third read gets EOF.
+		n, err = r.Read(buf)
+		if err != io.EOF {
+			t.Errorf("unexpected error: want %v, got %v", io.EOF, err)
+		}
+		if n != 0 {
+			t.Errorf("unexpected read size: want %d, got %d", 0, n)
+		}
+	})
+
+	t.Run("flush", func(t *testing.T) {
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			f, ok := w.(http.Flusher)
+			if !ok {
+				t.Error("http.ResponseWriter doesn't implement http.Flusher")
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+
+			if _, err := io.WriteString(w, `{"hello":`); err != nil {
+				t.Error(err)
+			}
+			f.Flush()
+			if _, err := io.WriteString(w, `"world"}`); err != nil {
+				t.Error(err)
+			}
+		}))
+		r, w := io.Pipe()
+		contentType, err := l.lambdaHandlerStreaming(context.Background(), &request{
+			RequestContext: ProxyRequestContext{
+				HTTP: &ProxyRequestContextHTTP{
+					Path: "/",
+				},
+			},
+		}, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := contentType, "application/vnd.awslambda.http-integration-response"; got != want {
+			t.Errorf("unexpected content type: want %q, got %q", want, got)
 		}
-		if v, ok := resp.Headers["Set-Cookie"]; ok {
-			t.Errorf("unexpected header: want None, got %q", v)
+
+		// Reads and Writes on the pipe are matched one to one,
+		// so we get only the header on first read.
+		buf := make([]byte, 1024)
+		n, err := r.Read(buf)
+		if err != nil {
+			t.Fatal(err)
 		}
-		if got, want := resp.Cookies, []string{"foo1=bar1", "foo2=bar2"}; !reflect.DeepEqual(got, want) {
-			t.Errorf("unexpected cookie: want %#v, got %#v", want, got)
+		if got, want := string(buf[:n]), "{\"statusCode\":200,\"headers\":{\"Content-Type\":\"application/json\"}}\x00\x00\x00\x00\x00\x00\x00\x00"; got != want {
+			t.Errorf("unexpected body: want %q, got %q", want, got)
 		}
 
-		// Content-Type is auto detected.
-		if resp.Headers["Content-Type"] != "text/html; charset=utf-8" {
-			t.Errorf("unexpected header: want %q, got %q", "text/html; charset=utf-8", resp.Headers["Content-Type"])
+		// The second read gets the half of the body.
+		n, err = r.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(buf[:n]), "{\"hello\":"; got != want {
+			t.Errorf("unexpected body: want %q, got %q", want, got)
 		}
 
-		if resp.StatusCode != http.StatusOK {
-			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, resp.StatusCode)
+		// The third read gets the rest of the body.
+		n, err = r.Read(buf)
+		if err != nil {
+			t.Fatal(err)
 		}
-		if resp.Body != "<!DOCTYPE html>\n<html><body>Hello!</body></html>" {
-			t.Errorf("unexpected body: want %q, got %q", "<!DOCTYPE html>\n<html><body>Hello!</body></html>", resp.Body)
+		if got, want := string(buf[:n]), "\"world\"}"; got != want {
+			t.Errorf("unexpected body: want %q, got %q", want, got)
 		}
-		if resp.IsBase64Encoded {
-			t.Error("unexpected IsBase64Encoded: want false, got true")
+
+		// The forth read gets EOF.
+		n, err = r.Read(buf)
+		if err != io.EOF {
+			t.Errorf("unexpected error: want %v, got %v", io.EOF, err)
+		}
+		if n != 0 {
+			t.Errorf("unexpected read size: want %d, got %d", 0, n)
 		}
 	})
-	t.Run("set content-type", func(t *testing.T) {
-		rw := newResponseWriter()
-		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		if _, err := io.WriteString(rw, "<!DOCTYPE html>\n"); err != nil {
-			t.Error(err)
+
+	t.Run("detect content-type", func(t *testing.T) {
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := io.WriteString(w, `<html></html>`); err != nil {
+				t.Error(err)
+			}
+		}))
+		r, w := io.Pipe()
+		contentType, err := l.lambdaHandlerStreaming(context.Background(), &request{
+			RequestContext: ProxyRequestContext{
+				HTTP: &ProxyRequestContextHTTP{
+					Path: "/",
+				},
+			},
+		}, w)
+		if err != nil {
+			t.Fatal(err)
 		}
-		if _, err := rw.Write([]byte("<html><body>Hello!</body></html>")); err != nil {
-			t.Error(err)
+		if got, want := contentType, "application/vnd.awslambda.http-integration-response"; got != want {
+			t.Errorf("unexpected content type: want %q, got %q", want, got)
+		}
+
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(data), "{\"statusCode\":200,\"headers\":{\"Content-Type\":\"text/html; charset=utf-8\"}}\x00\x00\x00\x00\x00\x00\x00\x00<html></html>"; got != want {
+			t.Errorf("unexpected body: want %q, got %q", want, got)
 		}
+	})
+}
 
+func TestResponse_EmptyBody(t *testing.T) {
+	t.Run("v1", func(t *testing.T) {
+		rw := newResponseWriter()
 		resp, err := rw.lambdaResponseV1()
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), `"statusCode":200`) {
+			t.Errorf("want statusCode 200, got %s", data)
 		}
+	})
 
-		// Content-Type is auto detected.
-		if resp.Headers["Content-Type"] != "text/plain; charset=utf-8" {
-			t.Errorf("unexpected header: want %q, got %q", "text/plain; charset=utf-8", resp.Headers["Content-Type"])
+	t.Run("v2", func(t *testing.T) {
+		rw := newResponseWriter()
+		resp, err := rw.lambdaResponseV2()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), `"statusCode":200`) {
+			t.Errorf("want statusCode 200, got %s", data)
 		}
+	})
 
+	t.Run("zero status code", func(t *testing.T) {
+		rw := newResponseWriter()
+		rw.WriteHeader(0)
+		resp, err := rw.lambdaResponseV2()
+		if err != nil {
+			t.Fatal(err)
+		}
 		if resp.StatusCode != http.StatusOK {
 			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, resp.StatusCode)
 		}
-		if resp.Body != "<!DOCTYPE html>\n<html><body>Hello!</body></html>" {
-			t.Errorf("unexpected body: want %q, got %q", "<!DOCTYPE html>\n<html><body>Hello!</body></html>", resp.Body)
+	})
+}
+
+func TestResponseWriter_Flush(t *testing.T) {
+	rw := newResponseWriter()
+	if _, err := io.WriteString(rw, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	f, ok := http.ResponseWriter(rw).(http.Flusher)
+	if !ok {
+		t.Fatal("want http.Flusher, but not")
+	}
+	f.Flush()
+	if _, err := io.WriteString(rw, " world"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := rw.lambdaResponseV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Body != "hello world" {
+		t.Errorf("unexpected body: want %q, got %q", "hello world", resp.Body)
+	}
+}
+
+func TestResponseWriter_ContentLength(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		contentLength string
+		body          string
+		want          string
+	}{
+		{"match", http.MethodGet, "5", "hello", "5"},
+		{"too long", http.MethodGet, "10", "hello", "5"},
+		{"too short", http.MethodGet, "3", "hello", "5"},
+		{"invalid", http.MethodGet, "five", "hello", "5"},
+		{"head", http.MethodHead, "5", "", "5"},
+	}
+	for _, tt := range tests {
+		var logs strings.Builder
+		l := newLambdaFunction(nil)
+		l.logger = log.New(&logs, "", 0)
+		rw := l.newResponseWriter(&http.Request{Method: tt.method, Header: http.Header{}})
+		rw.Header().Set("Content-Length", tt.contentLength)
+		if _, err := io.WriteString(rw, tt.body); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := rw.lambdaResponseV2()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Headers["Content-Length"]; got != tt.want {
+			t.Errorf("%s: unexpected Content-Length: want %q, got %q", tt.name, tt.want, got)
+		}
+		if corrected := tt.contentLength != tt.want; corrected != (logs.Len() > 0) {
+			t.Errorf("%s: unexpected log: %q", tt.name, logs.String())
+		}
+	}
+}
+
+func TestLambdaHandler_Head(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"api gateway v1", "testdata/apigateway-get-request.json"},
+		{"api gateway v2", "testdata/apigateway-v2-get-request.json"},
+		{"alb", "testdata/alb-get-request.json"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodHead {
+					t.Errorf("unexpected method: want %q, got %q", http.MethodHead, r.Method)
+				}
+				w.Header().Set("Content-Type", "text/plain")
+				_, _ = io.WriteString(w, "hello world")
+			}))
+			req, err := loadRequest(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.HTTPMethod = http.MethodHead
+			if req.RequestContext.HTTP != nil {
+				req.RequestContext.HTTP.Method = http.MethodHead
+			}
+			resp, err := l.lambdaHandler(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Body != "" {
+				t.Errorf("unexpected body: want empty, got %q", resp.Body)
+			}
+			header := http.Header(resp.MultiValueHeaders)
+			if header == nil {
+				header = make(http.Header)
+				for k, v := range resp.Headers {
+					header.Set(k, v)
+				}
+			}
+			if got := header.Get("Content-Length"); got != "11" {
+				t.Errorf("unexpected Content-Length: want %q, got %q", "11", got)
+			}
+			if got := header.Get("Content-Type"); got != "text/plain" {
+				t.Errorf("unexpected Content-Type: want %q, got %q", "text/plain", got)
+			}
+		})
+	}
+
+	t.Run("base64 passthrough", func(t *testing.T) {
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("X-Lambda-Http-Content-Encoding", "base64")
+			_, _ = io.WriteString(w, "aGVsbG8=")
+		}))
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RequestContext.HTTP.Method = http.MethodHead
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Body != "" {
+			t.Errorf("unexpected body: want empty, got %q", resp.Body)
 		}
 		if resp.IsBase64Encoded {
 			t.Error("unexpected IsBase64Encoded: want false, got true")
 		}
-	})
-	t.Run("redirect to example.com", func(t *testing.T) {
-		rw := newResponseWriter()
-		rw.Header().Add("location", "http://example.com/")
-		rw.WriteHeader(http.StatusFound)
-		if _, err := io.WriteString(rw, "<!DOCTYPE html>\n"); err != nil {
-			t.Error(err)
+		if got := resp.Headers["Content-Length"]; got != "5" {
+			t.Errorf("unexpected Content-Length: want %q, got %q", "5", got)
 		}
-		if _, err := rw.Write([]byte("<html><body>Redirect to <a href=http://example.com/>example.com</a></body></html>")); err != nil {
-			t.Error(err)
+		if got := resp.Headers["Content-Type"]; got != "application/octet-stream" {
+			t.Errorf("unexpected Content-Type: want %q, got %q", "application/octet-stream", got)
 		}
+		if _, ok := resp.Headers["X-Lambda-Http-Content-Encoding"]; ok {
+			t.Error("unexpected X-Lambda-Http-Content-Encoding header")
+		}
+	})
+}
 
+func TestResponseWriter_NoBodyStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"204 no content", http.StatusNoContent, ""},
+		{"204 with body", http.StatusNoContent, "hello"},
+		{"304 not modified", http.StatusNotModified, ""},
+		{"304 with body", http.StatusNotModified, "hello"},
+	}
+	for _, tt := range tests {
+		var logs strings.Builder
+		l := newLambdaFunction(nil)
+		l.logger = log.New(&logs, "", 0)
+		rw := l.newResponseWriter(&http.Request{Method: http.MethodGet, Header: http.Header{}})
+		rw.Header().Set("Etag", `"abc"`)
+		rw.WriteHeader(tt.status)
+		if _, err := io.WriteString(rw, tt.body); err != nil {
+			t.Fatal(err)
+		}
 		resp, err := rw.lambdaResponseV1()
 		if err != nil {
-			t.Error(err)
-		}
-		if resp.Headers["Location"] != "http://example.com/" {
-			t.Errorf("unexpected header: want %q, got %q", "http://example.com/", resp.Headers["Foo"])
+			t.Fatal(err)
 		}
-		if resp.StatusCode != http.StatusFound {
-			t.Errorf("unexpected status code: want %d, got %d", http.StatusFound, resp.StatusCode)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: unexpected status code: want %d, got %d", tt.name, tt.status, resp.StatusCode)
 		}
-		if resp.Body != "<!DOCTYPE html>\n<html><body>Redirect to <a href=http://example.com/>example.com</a></body></html>" {
-			t.Errorf("unexpected body: want %q, got %q", "<!DOCTYPE html>\n<html><body>Redirect to <a href=http://example.com/>example.com</a></body></html>", resp.Body)
+		if resp.Body != "" {
+			t.Errorf("%s: unexpected body: want empty, got %q", tt.name, resp.Body)
 		}
 		if resp.IsBase64Encoded {
-			t.Error("unexpected IsBase64Encoded: want false, got true")
+			t.Errorf("%s: want not base64 encoded, but encoded", tt.name)
 		}
-	})
-	t.Run("base64", func(t *testing.T) {
-		rw := newResponseWriter()
-		// 1x1 PNG image
-		if _, err := io.WriteString(rw, "\x89\x50\x4e\x47\x0d\x0a\x1a\x0a\x00\x00\x00\x0d\x49\x48\x44\x52"); err != nil {
-			t.Error(err)
+		if _, ok := resp.MultiValueHeaders["Content-Type"]; ok {
+			t.Errorf("%s: unexpected Content-Type: %v", tt.name, resp.MultiValueHeaders["Content-Type"])
 		}
-		if _, err := io.WriteString(rw, "\x00\x00\x00\x01\x00\x00\x00\x01\x08\x04\x00\x00\x00\xb5\x1c\x0c"); err != nil {
-			t.Error(err)
+		if got := resp.Headers["Etag"]; got != `"abc"` {
+			t.Errorf("%s: unexpected Etag: want %q, got %q", tt.name, `"abc"`, got)
 		}
-		if _, err := io.WriteString(rw, "\x02\x00\x00\x00\x0b\x49\x44\x41\x54\x08\xd7\x63\x60\x60\x00\x00"); err != nil {
-			t.Error(err)
+		if discarded := tt.body != ""; discarded != (logs.Len() > 0) {
+			t.Errorf("%s: unexpected log: %q", tt.name, logs.String())
 		}
-		if _, err := io.WriteString(rw, "\x00\x03\x00\x01\x20\xd5\x94\xc7\x00\x00\x00\x00\x49\x45\x4e\x44"); err != nil {
-			t.Error(err)
+	}
+}
+
+func TestRemoveExpectContinue(t *testing.T) {
+	l := newLambdaFunction(nil)
+
+	t.Run("v1", func(t *testing.T) {
+		req, err := loadRequest("testdata/apigateway-post-request.json")
+		if err != nil {
+			t.Fatal(err)
 		}
-		if _, err := io.WriteString(rw, "\xae\x42\x60\x82"); err != nil {
-			t.Error(err)
+		req.Headers["Expect"] = "100-continue"
+		req.MultiValueHeaders["Expect"] = []string{"100-continue"}
+		r, err := l.httpRequestV1(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := r.Header["Expect"]; ok {
+			t.Errorf("unexpected Expect header: %v", r.Header["Expect"])
 		}
+	})
 
-		resp, err := rw.lambdaResponseV1()
+	t.Run("v2", func(t *testing.T) {
+		req, err := loadRequest("testdata/apigateway-v2-post-request.json")
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
-		if resp.StatusCode != http.StatusOK {
-			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, resp.StatusCode)
+		req.Headers["expect"] = "100-Continue"
+		r, err := l.httpRequestV2(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
 		}
-		if resp.Body != "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVQI12NgYAAAAAMAASDVlMcAAAAASUVORK5CYII=" {
-			t.Errorf("unexpected body: want %q, got %q", "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVQI12NgYAAAAAMAASDVlMcAAAAASUVORK5CYII=", resp.Body)
+		if _, ok := r.Header["Expect"]; ok {
+			t.Errorf("unexpected Expect header: %v", r.Header["Expect"])
 		}
-		if !resp.IsBase64Encoded {
-			t.Error("unexpected IsBase64Encoded: want true, got false")
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		req, err := loadRequest("testdata/websocket-connect-request.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Headers["Expect"] = "100-continue"
+		r, err := l.httpRequestWebSocket(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := r.Header["Expect"]; ok {
+			t.Errorf("unexpected Expect header: %v", r.Header["Expect"])
+		}
+	})
+}
+
+func TestLambdaHandler_SetCookieV2(t *testing.T) {
+	cookies := []*http.Cookie{
+		{
+			Name:     "session",
+			Value:    "abc123",
+			Path:     "/",
+			Domain:   "example.com",
+			Expires:  time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+			MaxAge:   3600,
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		},
+		{
+			// the value with spaces and commas is quoted by http.SetCookie.
+			Name:     "quoted",
+			Value:    "hello, world",
+			SameSite: http.SameSiteLaxMode,
+		},
+		{
+			Name:     "expired",
+			Value:    "",
+			MaxAge:   -1,
+			SameSite: http.SameSiteNoneMode,
+			Secure:   true,
+		},
+	}
+	l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, cookie := range cookies {
+			http.SetCookie(w, cookie)
 		}
-	})
-}
+	}))
 
-func BenchmarkRequest_binary(b *testing.B) {
-	l := newLambdaFunction(nil)
-	req, err := loadRequest("testdata/apigateway-base64-request.json")
+	req, err := loadRequest("testdata/apigateway-v2-get-request.json")
 	if err != nil {
-		b.Fatal(err)
+		t.Fatal(err)
 	}
-	req.Body = base64.StdEncoding.EncodeToString(make([]byte, 1<<20))
-	req.IsBase64Encoded = true
-	buf := make([]byte, 1024)
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		r, _ := l.httpRequestV1(context.Background(), req)
-		io.CopyBuffer(io.Discard, r.Body, buf)
+	resp, err := l.lambdaHandler(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
 	}
-}
 
-func BenchmarkRequest_text(b *testing.B) {
-	l := newLambdaFunction(nil)
-	req, err := loadRequest("testdata/apigateway-base64-request.json")
-	if err != nil {
-		b.Fatal(err)
+	// the cookies are sent verbatim as http.SetCookie writes them.
+	want := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		want = append(want, cookie.String())
 	}
-	data := make([]byte, 1<<20)
-	for i := 0; i < len(data); i++ {
-		data[i] = 'a'
+	if !reflect.DeepEqual(resp.Cookies, want) {
+		t.Fatalf("unexpected cookies: want %#v, got %#v", want, resp.Cookies)
 	}
-	req.Body = string(data)
-	req.IsBase64Encoded = false
-	buf := make([]byte, 1024)
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		r, _ := l.httpRequestV1(context.Background(), req)
-		io.CopyBuffer(io.Discard, r.Body, buf)
+	if !strings.Contains(resp.Cookies[0], "SameSite=Strict") || !strings.Contains(resp.Cookies[0], "Max-Age=3600") {
+		t.Errorf("unexpected cookie attributes: %q", resp.Cookies[0])
 	}
-}
-
-func BenchmarkResponse_binary(b *testing.B) {
-	data := make([]byte, 1<<20) // 1MB: the maximum size of the response JSON in ALB
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		rw := newResponseWriter()
-		rw.Write(data)
-		rw.lambdaResponseV1()
+	if !strings.Contains(resp.Cookies[1], `"hello, world"`) {
+		t.Errorf("unexpected quoted value: %q", resp.Cookies[1])
+	}
+	if _, ok := resp.Headers["Set-Cookie"]; ok {
+		t.Errorf("unexpected Set-Cookie header: %q", resp.Headers["Set-Cookie"])
 	}
-}
 
-func BenchmarkResponse_text(b *testing.B) {
-	data := make([]byte, 1<<20) // 1MB: the maximum size of the response JSON in ALB
-	for i := 0; i < len(data); i++ {
-		data[i] = 'a'
+	// the client parses the cookies back into the original ones.
+	header := http.Header{"Set-Cookie": resp.Cookies}
+	parsed := (&http.Response{Header: header}).Cookies()
+	if len(parsed) != len(cookies) {
+		t.Fatalf("unexpected number of cookies: want %d, got %d", len(cookies), len(parsed))
 	}
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		rw := newResponseWriter()
-		rw.Write(data)
-		rw.lambdaResponseV1()
+	if parsed[1].Value != "hello, world" {
+		t.Errorf("unexpected cookie value: want %q, got %q", "hello, world", parsed[1].Value)
+	}
+	if parsed[0].SameSite != http.SameSiteStrictMode || parsed[0].MaxAge != 3600 {
+		t.Errorf("unexpected cookie attributes: SameSite=%v MaxAge=%d", parsed[0].SameSite, parsed[0].MaxAge)
 	}
 }
 
-func TestLambdaHandlerStreaming(t *testing.T) {
-	t.Run("normal", func(t *testing.T) {
-		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Content-Type", "application/json")
-			if _, err := io.WriteString(w, `{"hello":"world"}`); err != nil {
-				t.Error(err)
-			}
-		}))
-		r, w := io.Pipe()
-		contentType, err := l.lambdaHandlerStreaming(context.Background(), &request{
-			RequestContext: requestContext{
-				HTTP: &requestContextHTTP{
-					Path: "/",
-				},
-			},
-		}, w)
+func TestRemoveHopByHopHeaders_Request(t *testing.T) {
+	l := newLambdaFunction(nil)
+	removed := []string{"Connection", "X-Custom", "Keep-Alive", "Te", "Upgrade", "Proxy-Authorization", "Proxy-Authenticate"}
+
+	t.Run("v1", func(t *testing.T) {
+		req, err := loadRequest("testdata/apigateway-get-request.json")
 		if err != nil {
 			t.Fatal(err)
 		}
-		if got, want := contentType, "application/vnd.awslambda.http-integration-response"; got != want {
-			t.Errorf("unexpected content type: want %q, got %q", want, got)
-		}
-		data, err := io.ReadAll(r)
+		for key, value := range map[string]string{
+			"Connection":          "X-Custom",
+			"X-Custom":            "value",
+			"Keep-Alive":          "timeout=5",
+			"TE":                  "trailers",
+			"Upgrade":             "websocket",
+			"Proxy-Authorization": "Basic dXNlcjpwYXNz",
+			"Proxy-Authenticate":  "Basic",
+		} {
+			req.Headers[key] = value
+			req.MultiValueHeaders[key] = []string{value}
+		}
+		r, err := l.httpRequestV1(context.Background(), req)
 		if err != nil {
 			t.Fatal(err)
 		}
-		if got, want := string(data), "{\"statusCode\":200,\"headers\":{\"Content-Type\":\"application/json\"}}\x00\x00\x00\x00\x00\x00\x00\x00{\"hello\":\"world\"}"; got != want {
-			t.Errorf("unexpected body: want %q, got %q", want, got)
+		for _, name := range removed {
+			if _, ok := r.Header[name]; ok {
+				t.Errorf("unexpected %s header: %v", name, r.Header[name])
+			}
+		}
+		if r.Header.Get("User-Agent") == "" {
+			t.Error("want User-Agent header, got nothing")
 		}
 	})
 
-	t.Run("WriteHeader", func(t *testing.T) {
-		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-
-			// Writes to ResponseWriter are buffered,
-			// so multiple writes to ResponseWriter become a single write to the pipe
-			if _, err := io.WriteString(w, `{"hello":`); err != nil {
-				t.Error(err)
-			}
-			if _, err := io.WriteString(w, `"world"}`); err != nil {
-				t.Error(err)
-			}
-		}))
-		r, w := io.Pipe()
-		contentType, err := l.lambdaHandlerStreaming(context.Background(), &request{
-			RequestContext: requestContext{
-				HTTP: &requestContextHTTP{
-					Path: "/",
-				},
-			},
-		}, w)
+	t.Run("v2", func(t *testing.T) {
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
 		if err != nil {
 			t.Fatal(err)
 		}
-		if got, want := contentType, "application/vnd.awslambda.http-integration-response"; got != want {
-			t.Errorf("unexpected content type: want %q, got %q", want, got)
-		}
-
-		// Reads and Writes on the pipe are matched one to one,
-		// so we get only the header on first read.
-		buf := make([]byte, 1024)
-		n, err := r.Read(buf)
+		req.Headers["connection"] = "keep-alive, x-custom"
+		req.Headers["x-custom"] = "value"
+		req.Headers["keep-alive"] = "timeout=5"
+		req.Headers["te"] = "trailers"
+		req.Headers["upgrade"] = "websocket"
+		req.Headers["proxy-authorization"] = "Basic dXNlcjpwYXNz"
+		req.Headers["proxy-authenticate"] = "Basic"
+		r, err := l.httpRequestV2(context.Background(), req)
 		if err != nil {
 			t.Fatal(err)
 		}
-		if got, want := string(buf[:n]), "{\"statusCode\":200,\"headers\":{\"Content-Type\":\"application/json\"}}\x00\x00\x00\x00\x00\x00\x00\x00"; got != want {
-			t.Errorf("unexpected body: want %q, got %q", want, got)
+		for _, name := range removed {
+			if _, ok := r.Header[name]; ok {
+				t.Errorf("unexpected %s header: %v", name, r.Header[name])
+			}
 		}
+		if r.Header.Get("User-Agent") == "" {
+			t.Error("want User-Agent header, got nothing")
+		}
+	})
 
-		// The second read gets the body.
-		n, err = r.Read(buf)
+	t.Run("websocket", func(t *testing.T) {
+		req, err := loadRequest("testdata/websocket-connect-request.json")
 		if err != nil {
 			t.Fatal(err)
 		}
-		if got, want := string(buf[:n]), "{\"hello\":\"world\"}"; got != want {
-			t.Errorf("unexpected body: want %q, got %q", want, got)
+		for key, value := range map[string]string{
+			"Connection":          "X-Custom",
+			"X-Custom":            "value",
+			"Keep-Alive":          "timeout=5",
+			"TE":                  "trailers",
+			"Upgrade":             "websocket",
+			"Proxy-Authorization": "Basic dXNlcjpwYXNz",
+			"Proxy-Authenticate":  "Basic",
+		} {
+			req.Headers[key] = value
+		}
+		r, err := l.httpRequestWebSocket(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
 		}
-
-		// The third read gets EOF.
-		n, err = r.Read(buf)
-		if err != io.EOF {
-			t.Errorf("unexpected error: want %v, got %v", io.EOF, err)
+		for _, name := range removed {
+			if _, ok := r.Header[name]; ok {
+				t.Errorf("unexpected %s header: %v", name, r.Header[name])
+			}
 		}
-		if n != 0 {
-			t.Errorf("unexpected read size: want %d, got %d", 0, n)
+		if r.Header.Get("Sec-Websocket-Key") == "" {
+			t.Error("want Sec-WebSocket-Key header, got nothing")
 		}
 	})
+}
 
-	t.Run("flush", func(t *testing.T) {
-		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			f, ok := w.(http.Flusher)
-			if !ok {
-				t.Error("http.ResponseWriter doesn't implement http.Flusher")
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-
-			if _, err := io.WriteString(w, `{"hello":`); err != nil {
-				t.Error(err)
-			}
-			f.Flush()
-			if _, err := io.WriteString(w, `"world"}`); err != nil {
-				t.Error(err)
-			}
-		}))
-		r, w := io.Pipe()
-		contentType, err := l.lambdaHandlerStreaming(context.Background(), &request{
-			RequestContext: requestContext{
-				HTTP: &requestContextHTTP{
-					Path: "/",
-				},
-			},
-		}, w)
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.Header().Set("Connection", "keep-alive, X-Internal")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-Internal", "secret")
+		w.Header().Set("X-Custom", "value")
+		w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+		_, _ = io.WriteString(w, "hello")
+	}))
+	removed := []string{"Transfer-Encoding", "Connection", "Keep-Alive", "X-Internal"}
+
+	t.Run("v1", func(t *testing.T) {
+		req, err := loadRequest("testdata/apigateway-get-request.json")
 		if err != nil {
 			t.Fatal(err)
 		}
-		if got, want := contentType, "application/vnd.awslambda.http-integration-response"; got != want {
-			t.Errorf("unexpected content type: want %q, got %q", want, got)
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range removed {
+			if _, ok := resp.Headers[name]; ok {
+				t.Errorf("unexpected %s header: %q", name, resp.Headers[name])
+			}
+			if _, ok := resp.MultiValueHeaders[name]; ok {
+				t.Errorf("unexpected %s header: %q", name, resp.MultiValueHeaders[name])
+			}
 		}
+		if resp.Headers["X-Custom"] != "value" {
+			t.Errorf("unexpected X-Custom header: want %q, got %q", "value", resp.Headers["X-Custom"])
+		}
+		// Proxy-Authenticate is kept in the responses.
+		if got := resp.Headers["Proxy-Authenticate"]; got != `Basic realm="proxy"` {
+			t.Errorf("unexpected Proxy-Authenticate header: want %q, got %q", `Basic realm="proxy"`, got)
+		}
+	})
 
-		// Reads and Writes on the pipe are matched one to one,
-		// so we get only the header on first read.
-		buf := make([]byte, 1024)
-		n, err := r.Read(buf)
+	t.Run("v2", func(t *testing.T) {
+		req, err := loadRequest("testdata/apigateway-v2-get-request.json")
 		if err != nil {
 			t.Fatal(err)
 		}
-		if got, want := string(buf[:n]), "{\"statusCode\":200,\"headers\":{\"Content-Type\":\"application/json\"}}\x00\x00\x00\x00\x00\x00\x00\x00"; got != want {
-			t.Errorf("unexpected body: want %q, got %q", want, got)
+		resp, err := l.lambdaHandler(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
 		}
+		for _, name := range removed {
+			if _, ok := resp.Headers[name]; ok {
+				t.Errorf("unexpected %s header: %q", name, resp.Headers[name])
+			}
+		}
+		if resp.Headers["X-Custom"] != "value" {
+			t.Errorf("unexpected X-Custom header: want %q, got %q", "value", resp.Headers["X-Custom"])
+		}
+	})
 
-		// The second read gets the half of the body.
-		n, err = r.Read(buf)
+	t.Run("streaming", func(t *testing.T) {
+		req, err := loadRequest("testdata/function-urls-get-request.json")
 		if err != nil {
 			t.Fatal(err)
 		}
-		if got, want := string(buf[:n]), "{\"hello\":"; got != want {
-			t.Errorf("unexpected body: want %q, got %q", want, got)
+		r, w := io.Pipe()
+		if _, err := l.lambdaHandlerStreaming(context.Background(), req, w); err != nil {
+			t.Fatal(err)
 		}
-
-		// The third read gets the rest of the body.
-		n, err = r.Read(buf)
+		data, err := io.ReadAll(r)
 		if err != nil {
 			t.Fatal(err)
 		}
-		if got, want := string(buf[:n]), "\"world\"}"; got != want {
-			t.Errorf("unexpected body: want %q, got %q", want, got)
+		prelude, _, ok := strings.Cut(string(data), "\x00\x00\x00\x00\x00\x00\x00\x00")
+		if !ok {
+			t.Fatalf("the prelude is not found: %q", string(data))
 		}
-
-		// The forth read gets EOF.
-		n, err = r.Read(buf)
-		if err != io.EOF {
-			t.Errorf("unexpected error: want %v, got %v", io.EOF, err)
+		var resp streamingResponse
+		if err := json.Unmarshal([]byte(prelude), &resp); err != nil {
+			t.Fatal(err)
 		}
-		if n != 0 {
-			t.Errorf("unexpected read size: want %d, got %d", 0, n)
+		for _, name := range removed {
+			if _, ok := resp.Headers[name]; ok {
+				t.Errorf("unexpected %s header: %q", name, resp.Headers[name])
+			}
+		}
+		if resp.Headers["X-Custom"] != "value" {
+			t.Errorf("unexpected X-Custom header: want %q, got %q", "value", resp.Headers["X-Custom"])
 		}
 	})
+}
 
-	t.Run("detect content-type", func(t *testing.T) {
-		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if _, err := io.WriteString(w, `<html></html>`); err != nil {
-				t.Error(err)
+func TestLambdaHandler_ServeContent(t *testing.T) {
+	content := []byte("0123456789")
+	modtime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.txt", modtime, bytes.NewReader(content))
+	}))
+
+	tests := []struct {
+		name         string
+		path         string
+		rangeHeader  string
+		status       int
+		contentRange string
+		body         string
+	}{
+		{"v1 range", "testdata/apigateway-get-request.json", "bytes=2-5", http.StatusPartialContent, "bytes 2-5/10", "2345"},
+		{"v2 range", "testdata/apigateway-v2-get-request.json", "bytes=2-5", http.StatusPartialContent, "bytes 2-5/10", "2345"},
+		{"v2 suffix range", "testdata/apigateway-v2-get-request.json", "bytes=-3", http.StatusPartialContent, "bytes 7-9/10", "789"},
+		{"v2 unsatisfiable", "testdata/apigateway-v2-get-request.json", "bytes=20-", http.StatusRequestedRangeNotSatisfiable, "bytes */10", ""},
+		{"v2 no range", "testdata/apigateway-v2-get-request.json", "", http.StatusOK, "", "0123456789"},
+	}
+	for _, tt := range tests {
+		req, err := loadRequest(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.rangeHeader != "" {
+			if req.Headers == nil {
+				req.Headers = map[string]string{}
 			}
-		}))
-		r, w := io.Pipe()
-		contentType, err := l.lambdaHandlerStreaming(context.Background(), &request{
-			RequestContext: requestContext{
-				HTTP: &requestContextHTTP{
-					Path: "/",
-				},
-			},
-		}, w)
+			req.Headers["range"] = tt.rangeHeader
+			if req.MultiValueHeaders != nil {
+				req.MultiValueHeaders["range"] = []string{tt.rangeHeader}
+			}
+		}
+		resp, err := l.lambdaHandler(context.Background(), req)
 		if err != nil {
 			t.Fatal(err)
 		}
-		if got, want := contentType, "application/vnd.awslambda.http-integration-response"; got != want {
-			t.Errorf("unexpected content type: want %q, got %q", want, got)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: unexpected status code: want %d, got %d", tt.name, tt.status, resp.StatusCode)
+		}
+		if got := resp.Headers["Content-Range"]; got != tt.contentRange {
+			t.Errorf("%s: unexpected Content-Range: want %q, got %q", tt.name, tt.contentRange, got)
+		}
+		if tt.status != http.StatusRequestedRangeNotSatisfiable {
+			if got := resp.Headers["Accept-Ranges"]; got != "bytes" {
+				t.Errorf("%s: unexpected Accept-Ranges: want %q, got %q", tt.name, "bytes", got)
+			}
+			if got, want := resp.Headers["Content-Length"], strconv.Itoa(len(tt.body)); got != want {
+				t.Errorf("%s: unexpected Content-Length: want %q, got %q", tt.name, want, got)
+			}
+			if resp.Body != tt.body {
+				t.Errorf("%s: unexpected body: want %q, got %q", tt.name, tt.body, resp.Body)
+			}
 		}
+	}
+}
 
-		data, err := io.ReadAll(r)
-		if err != nil {
+type bytesWriter interface {
+	BytesWritten() int64
+}
+
+func TestResponseWriter_BytesWritten(t *testing.T) {
+	rw := newResponseWriter()
+	for _, s := range []string{"hello", " ", "world"} {
+		if _, err := io.WriteString(rw, s); err != nil {
 			t.Fatal(err)
 		}
-		if got, want := string(data), "{\"statusCode\":200,\"headers\":{\"Content-Type\":\"text/html; charset=utf-8\"}}\x00\x00\x00\x00\x00\x00\x00\x00<html></html>"; got != want {
-			t.Errorf("unexpected body: want %q, got %q", want, got)
+	}
+	if got := http.ResponseWriter(rw).(bytesWriter).BytesWritten(); got != int64(len("hello world")) {
+		t.Errorf("unexpected bytes written: want %d, got %d", len("hello world"), got)
+	}
+}
+
+func TestStreamingResponseWriter_BytesWritten(t *testing.T) {
+	payload := strings.Repeat("a", 1000) // larger than the prelude buffer
+	done := make(chan int64, 1)
+	l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.WriteString(w, payload[:10]); err != nil {
+			t.Error(err)
 		}
-	})
+		if _, err := io.WriteString(w, payload[10:]); err != nil {
+			t.Error(err)
+		}
+		done <- w.(bytesWriter).BytesWritten()
+	}))
+	r, w := io.Pipe()
+	_, err := l.lambdaHandlerStreaming(context.Background(), &request{
+		RequestContext: ProxyRequestContext{
+			HTTP: &ProxyRequestContextHTTP{
+				Path: "/",
+			},
+		},
+	}, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-done; got != int64(len(payload)) {
+		t.Errorf("unexpected bytes written: want %d, got %d", len(payload), got)
+	}
+	if !strings.HasSuffix(string(data), payload) {
+		t.Errorf("unexpected body: %q", data)
+	}
+}
+
+func TestResponseWriter_WriteAfterResponse(t *testing.T) {
+	rw := newResponseWriter()
+	if _, err := io.WriteString(rw, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := rw.lambdaResponseV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the buffer is returned to the pool, and it must not affect the response.
+	if _, err := io.WriteString(rw, "world"); err != errResponseSent {
+		t.Errorf("want errResponseSent, got %v", err)
+	}
+	if resp.Body != "hello" {
+		t.Errorf("unexpected body: want %q, got %q", "hello", resp.Body)
+	}
 }
 
 func TestIsBinary(t *testing.T) {
@@ -9,10 +9,13 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"runtime"
+	"runtime/debug"
 	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -36,36 +39,123 @@ const (
 )
 
 type runtimeAPIClient struct {
-	baseURL    string
-	userAgent  string
-	httpClient *http.Client
-	buffer     *bytes.Buffer
+	baseURL      string
+	initErrorURL string
+	userAgent    string
+	httpClient   *http.Client
+	buffer       *bytes.Buffer
+	logger       Logger
+
+	// maxPayloadSize is the maximum size of the invoke payloads.
+	// Zero means unlimited.
+	maxPayloadSize int64
+
+	// timeoutResponse enables responding with 504 Gateway Timeout
+	// when the handler doesn't return before the deadline.
+	timeoutResponse bool
+
+	// deadlineMargin is subtracted from the deadline of the invokes.
+	deadlineMargin time.Duration
+
+	// nextTimeout is the timeout of waiting for the next invoke.
+	// Zero means unlimited.
+	nextTimeout time.Duration
+
+	// streamingAccepted reports whether the runtime API has accepted a streaming response.
+	streamingAccepted bool
+
+	// observer observes the invokes.
+	observer Observer
 }
 
+const (
+	// maxRetries is the maximum number of the retries of a request to the runtime API on connection errors.
+	maxRetries = 3
+
+	// retryBaseDelay is the delay before the first retry. The delay doubles on each retry.
+	retryBaseDelay = 20 * time.Millisecond
+)
+
+// errPayloadTooLarge is returned by next when the invoke payload exceeds maxPayloadSize.
+var errPayloadTooLarge = errors.New("ridgenative: the invoke payload is too large")
+
 func newRuntimeAPIClient(address string) *runtimeAPIClient {
 	client := &http.Client{
+		// the runtime API is always on the same local endpoint,
+		// so keep the connection alive and skip the proxy lookup and the compression.
+		Transport: &http.Transport{
+			Proxy:               nil,
+			MaxIdleConnsPerHost: 1,
+			DisableCompression:  true,
+		},
 		Timeout: 0, // connections to the runtime API are never expected to time out
 	}
 	endpoint := "http://" + address + "/" + apiVersion + "/runtime/invocation/"
-	userAgent := "aws-lambda-go/" + runtime.Version()
+	initErrorURL := "http://" + address + "/" + apiVersion + "/runtime/init/error"
+	userAgent := defaultUserAgent()
 	return &runtimeAPIClient{
-		baseURL:    endpoint,
-		userAgent:  userAgent,
-		httpClient: client,
-		buffer:     bytes.NewBuffer(nil),
+		baseURL:      endpoint,
+		initErrorURL: initErrorURL,
+		userAgent:    userAgent,
+		httpClient:   client,
+		buffer:       bytes.NewBuffer(nil),
+		logger:       log.Default(),
+		observer:     NopObserver{},
 	}
 }
 
+// defaultUserAgent returns the User-Agent for the runtime API, such as "ridgenative/v1.0.0 go1.19".
+// The version of ridgenative comes from the build information of the binary.
+func defaultUserAgent() string {
+	version := "devel"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Path == modulePath && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			version = info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath && dep.Version != "" {
+				version = dep.Version
+				break
+			}
+		}
+	}
+	return "ridgenative/" + version + " " + runtime.Version()
+}
+
+// modulePath is the module path of ridgenative.
+const modulePath = "github.com/shogo82148/ridgenative"
+
 // handlerFunc is the type of the function that handles an invoke.
 type handlerFunc func(ctx context.Context, req *request) (*response, error)
 
+// start waits for new invokes and handles them until ctx is canceled.
+// The invokes are handled strictly one at a time; the next invoke is not requested until handleInvoke returns.
+// The Runtime API never delivers concurrent invokes to an execution environment,
+// so the handler may rely on it, e.g. for reusing per-invoke resources without locking.
+// The exception is timeoutResponse; callHandler returns without waiting for the timed-out handler.
 func (c *runtimeAPIClient) start(ctx context.Context, h handlerFunc) error {
 	for {
 		invoke, err := c.next(ctx)
+		if err == errPayloadTooLarge {
+			// the invoke fails, but the function can handle the next invoke.
+			c.observer.InvokeStarted()
+			c.observer.InvokeError(err)
+			if err := c.reportFailure(ctx, invoke, lambdaErrorResponse(err)); err != nil {
+				return err
+			}
+			continue
+		}
 		if err != nil {
+			if ctx.Err() != nil {
+				// the context is canceled while waiting for the next invoke.
+				// it is not an error, the function is shutting down.
+				return nil
+			}
 			return err
 		}
-		if err := c.handleInvoke(ctx, invoke, h); err != nil {
+
+		// the in-flight invoke should complete even if ctx is canceled.
+		if err := c.handleInvoke(withoutCancel(ctx), invoke, h); err != nil {
 			return err
 		}
 	}
@@ -73,6 +163,13 @@ func (c *runtimeAPIClient) start(ctx context.Context, h handlerFunc) error {
 
 // next connects to the Runtime API and waits for a new invoke Request to be available.
 func (c *runtimeAPIClient) next(ctx context.Context) (*invoke, error) {
+	parent := ctx
+	if c.nextTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.nextTimeout)
+		defer cancel()
+	}
+
 	url := c.baseURL + "next"
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
@@ -80,8 +177,11 @@ func (c *runtimeAPIClient) next(ctx context.Context) (*invoke, error) {
 	}
 	req.Header.Set("User-Agent", c.userAgent)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
+		if parent.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("ridgenative: the runtime API doesn't respond to the next invoke request in %s: %w", c.nextTimeout, err)
+		}
 		return nil, fmt.Errorf("ridgenative: failed to get the next invoke: %w", err)
 	}
 	defer resp.Body.Close()
@@ -90,29 +190,51 @@ func (c *runtimeAPIClient) next(ctx context.Context) (*invoke, error) {
 		return nil, fmt.Errorf("ridgenative: failed to GET %s: got unexpected status code: %d", url, resp.StatusCode)
 	}
 
+	inv := &invoke{
+		id:      resp.Header.Get(headerAWSRequestID),
+		headers: resp.Header,
+	}
+
+	var body io.Reader = resp.Body
+	if c.maxPayloadSize > 0 {
+		if resp.ContentLength > c.maxPayloadSize {
+			return inv, errPayloadTooLarge
+		}
+		// read one more byte to detect the payload exceeding the limit.
+		body = io.LimitReader(resp.Body, c.maxPayloadSize+1)
+	}
+
 	c.buffer.Reset()
-	_, err = c.buffer.ReadFrom(resp.Body)
+	_, err = c.buffer.ReadFrom(body)
 	if err != nil {
 		return nil, fmt.Errorf("ridgenative: failed to read the invoke payload: %w", err)
 	}
+	if c.maxPayloadSize > 0 && int64(c.buffer.Len()) > c.maxPayloadSize {
+		return inv, errPayloadTooLarge
+	}
 
-	return &invoke{
-		id:      resp.Header.Get(headerAWSRequestID),
-		payload: c.buffer.Bytes(),
-		headers: resp.Header,
-	}, nil
+	inv.payload = c.buffer.Bytes()
+	return inv, nil
 }
 
 // handleInvoke handles an invoke.
 func (c *runtimeAPIClient) handleInvoke(ctx context.Context, invoke *invoke, h handlerFunc) error {
+	start := time.Now()
+	c.observer.InvokeStarted()
+
 	// set the deadline
 	deadline, err := parseDeadline(invoke)
 	if err != nil {
+		c.observer.InvokeError(err)
 		return c.reportFailure(ctx, invoke, lambdaErrorResponse(err))
 	}
-	child, cancel := context.WithDeadline(ctx, deadline)
+	child, cancel := context.WithDeadline(ctx, effectiveDeadline(deadline, c.deadlineMargin, time.Now()))
 	defer cancel()
 
+	// record the statistics for the observer
+	stats := &invokeStats{}
+	child = context.WithValue(child, invokeStatsContextKey, stats)
+
 	// set the trace id
 	traceID := invoke.headers.Get(headerTraceID)
 	os.Setenv("_X_AMZN_TRACE_ID", traceID)
@@ -120,9 +242,18 @@ func (c *runtimeAPIClient) handleInvoke(ctx context.Context, invoke *invoke, h h
 	// nolint:staticcheck
 	child = context.WithValue(child, "x-amzn-trace-id", traceID)
 
+	// set the lambda context
+	lc, err := parseLambdaContext(invoke)
+	if err != nil {
+		c.observer.InvokeError(err)
+		return c.reportFailure(ctx, invoke, lambdaErrorResponse(err))
+	}
+	child = context.WithValue(child, lambdaContextKey, lc)
+
 	// call the handler, marshal any returned error
-	response, err := callBytesHandlerFunc(child, invoke.payload, h)
+	response, err := c.callHandler(child, invoke.payload, h)
 	if err != nil {
+		c.observer.InvokeError(err)
 		invokeErr := lambdaErrorResponse(err)
 		if err := c.reportFailure(ctx, invoke, invokeErr); err != nil {
 			return err
@@ -134,12 +265,59 @@ func (c *runtimeAPIClient) handleInvoke(ctx context.Context, invoke *invoke, h h
 	}
 
 	if err := c.post(ctx, invoke.id+"/response", response, contentTypeJSON); err != nil {
+		c.observer.InvokeError(err)
 		return fmt.Errorf("unexpected error occurred when sending the function functionResponse to the API: %w", err)
 	}
 
+	statusCode, requestBytes, responseBytes, _ := stats.finish()
+	c.observer.InvokeFinished(time.Since(start), statusCode, requestBytes, responseBytes)
 	return nil
 }
 
+// gatewayTimeoutResponse is the response for the handlers that don't return before the deadline.
+var gatewayTimeoutResponse = &response{
+	StatusCode: http.StatusGatewayTimeout,
+	Headers: map[string]string{
+		"Content-Type": "text/plain; charset=utf-8",
+	},
+	Body: "504 Gateway Timeout\n",
+}
+
+// callHandler calls h with the payload.
+// If timeoutResponse is enabled, it stops waiting for h when ctx is done,
+// and returns 504 Gateway Timeout response.
+// In that case, h keeps running in the background until it returns, and its result is discarded.
+func (c *runtimeAPIClient) callHandler(ctx context.Context, payload []byte, h handlerFunc) ([]byte, error) {
+	if !c.timeoutResponse {
+		return callBytesHandlerFunc(ctx, payload, h)
+	}
+
+	// payload is backed by c.buffer, which next reuses for the next invoke,
+	// while h may still be reading it in the background.
+	payload = append([]byte(nil), payload...)
+
+	type result struct {
+		response []byte
+		err      error
+	}
+	ch := make(chan result, 1) // it is buffered, so the goroutine doesn't leak after the timeout.
+	go func() {
+		response, err := callBytesHandlerFunc(ctx, payload, h)
+		ch <- result{response: response, err: err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.response, r.err
+	case <-ctx.Done():
+		c.logger.Printf("ridgenative: the handler didn't return before the deadline: %v", ctx.Err())
+		stats := invokeStatsFromContext(ctx)
+		stats.setResponse(gatewayTimeoutResponse.StatusCode, responseBodyLen(gatewayTimeoutResponse))
+		stats.finish()
+		return json.Marshal(gatewayTimeoutResponse)
+	}
+}
+
 func parseDeadline(invoke *invoke) (time.Time, error) {
 	deadlineEpochMS, err := strconv.ParseInt(invoke.headers.Get(headerDeadlineMS), 10, 64)
 	if err != nil {
@@ -148,9 +326,44 @@ func parseDeadline(invoke *invoke) (time.Time, error) {
 	return time.UnixMilli(deadlineEpochMS), nil
 }
 
+// effectiveDeadline returns the deadline for the handler, which is earlier than deadline by margin.
+// If deadline minus margin has already passed, the margin is ignored,
+// so that the handler isn't canceled before it starts.
+func effectiveDeadline(deadline time.Time, margin time.Duration, now time.Time) time.Time {
+	if margin <= 0 {
+		return deadline
+	}
+	if d := deadline.Add(-margin); d.After(now) {
+		return d
+	}
+	return deadline
+}
+
+func parseLambdaContext(invoke *invoke) (*InvokeContext, error) {
+	lc := &InvokeContext{
+		AwsRequestID:       invoke.id,
+		InvokedFunctionArn: invoke.headers.Get(headerInvokedFunctionARN),
+	}
+	if cognitoIdentityJSON := invoke.headers.Get(headerCognitoIdentity); cognitoIdentityJSON != "" {
+		if err := json.Unmarshal([]byte(cognitoIdentityJSON), &lc.Identity); err != nil {
+			return nil, fmt.Errorf("ridgenative: failed to unmarshal cognito identity json: %w", err)
+		}
+	}
+	if clientContextJSON := invoke.headers.Get(headerClientContext); clientContextJSON != "" {
+		if err := json.Unmarshal([]byte(clientContextJSON), &lc.ClientContext); err != nil {
+			return nil, fmt.Errorf("ridgenative: failed to unmarshal client context json: %w", err)
+		}
+	}
+	return lc, nil
+}
+
 // post posts body to the Runtime API at the given path.
 func (c *runtimeAPIClient) post(ctx context.Context, path string, body []byte, contentType string) error {
-	url := c.baseURL + path
+	return c.postURL(ctx, c.baseURL+path, body, contentType)
+}
+
+// postURL posts body to the Runtime API at the given url.
+func (c *runtimeAPIClient) postURL(ctx context.Context, url string, body []byte, contentType string) error {
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
 		return fmt.Errorf("ridgenative: failed to construct POST request to %s: %w", url, err)
@@ -158,7 +371,7 @@ func (c *runtimeAPIClient) post(ctx context.Context, path string, body []byte, c
 	req.Header.Set("User-Agent", c.userAgent)
 	req.Header.Set("Content-Type", contentType)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return fmt.Errorf("ridgenative: failed to POST to %s: %v", url, err)
 	}
@@ -176,28 +389,112 @@ func (c *runtimeAPIClient) post(ctx context.Context, path string, body []byte, c
 	return nil
 }
 
+// do sends req to the Runtime API.
+// It retries with exponential backoff on the failures to connect to the Runtime API, such as the connection refused,
+// up to maxRetries times, and returns the last error.
+// It doesn't retry the other errors, such as the connection reset, because the Runtime API may have already accepted req;
+// net/http retries the requests that haven't been written by itself.
+// It doesn't retry if the context of req is done, or the body of req can't be rewound, either.
+func (c *runtimeAPIClient) do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	delay := retryBaseDelay
+	for i := 0; ; i++ {
+		resp, err := c.httpClient.Do(req)
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil || i >= maxRetries || !isDialError(err) {
+			return nil, err
+		}
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			// the body has been consumed, and it can't be sent again.
+			return nil, err
+		}
+		c.logger.Printf("ridgenative: failed to connect to the runtime API, retrying in %s: %v", delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+		delay *= 2
+
+		req = req.Clone(ctx)
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
+
+// isDialError reports whether err is a failure to connect to the Runtime API.
+// The request hasn't reached the Runtime API, so it is safe to send it again.
+func isDialError(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
 // reportFailure reports the error to the Runtime API.
 func (c *runtimeAPIClient) reportFailure(ctx context.Context, invoke *invoke, invokeErr *invokeResponseError) error {
 	body, err := json.Marshal(invokeErr)
 	if err != nil {
 		return fmt.Errorf("ridgenative: failed to marshal the function error: %w", err)
 	}
-	log.Printf("%s", body)
+	c.logger.Printf("%s", body)
 	if err := c.post(ctx, invoke.id+"/error", body, contentTypeJSON); err != nil {
 		return fmt.Errorf("ridgenative: unexpected error occurred when sending the function error to the API: %w", err)
 	}
 	return nil
 }
 
+// reportInitError reports the error in the init phase to the Runtime API.
+func (c *runtimeAPIClient) reportInitError(ctx context.Context, initErr *invokeResponseError) error {
+	body, err := json.Marshal(initErr)
+	if err != nil {
+		return fmt.Errorf("ridgenative: failed to marshal the init error: %w", err)
+	}
+	c.logger.Printf("%s", body)
+	if err := c.postURL(ctx, c.initErrorURL, body, contentTypeJSON); err != nil {
+		return fmt.Errorf("ridgenative: unexpected error occurred when sending the init error to the API: %w", err)
+	}
+	return nil
+}
+
 type handlerFuncSteaming func(ctx context.Context, req *request, w *io.PipeWriter) (contentType string, err error)
 
+// startStreaming waits for new invokes and handles them with streaming until ctx is canceled.
+// As with start, the next invoke is not requested until the response of the current one is sent.
 func (c *runtimeAPIClient) startStreaming(ctx context.Context, h handlerFuncSteaming) error {
 	for {
 		invoke, err := c.next(ctx)
+		if err == errPayloadTooLarge {
+			// the invoke fails, but the function can handle the next invoke.
+			c.observer.InvokeStarted()
+			c.observer.InvokeError(err)
+			if err := c.reportFailure(ctx, invoke, lambdaErrorResponse(err)); err != nil {
+				return err
+			}
+			continue
+		}
 		if err != nil {
+			if ctx.Err() != nil {
+				// the context is canceled while waiting for the next invoke.
+				// it is not an error, the function is shutting down.
+				return nil
+			}
 			return err
 		}
-		if err := c.handleInvokeStreaming(ctx, invoke, h); err != nil {
+
+		// the in-flight invoke should complete even if ctx is canceled.
+		if err := c.handleInvokeStreaming(withoutCancel(ctx), invoke, h); err != nil {
 			return err
 		}
 	}
@@ -205,14 +502,22 @@ func (c *runtimeAPIClient) startStreaming(ctx context.Context, h handlerFuncStea
 
 // handleInvoke handles an invoke.
 func (c *runtimeAPIClient) handleInvokeStreaming(ctx context.Context, invoke *invoke, h handlerFuncSteaming) error {
+	start := time.Now()
+	c.observer.InvokeStarted()
+
 	// set the deadline
 	deadline, err := parseDeadline(invoke)
 	if err != nil {
+		c.observer.InvokeError(err)
 		return c.reportFailure(ctx, invoke, lambdaErrorResponse(err))
 	}
-	child, cancel := context.WithDeadline(ctx, deadline)
+	child, cancel := context.WithDeadline(ctx, effectiveDeadline(deadline, c.deadlineMargin, time.Now()))
 	defer cancel()
 
+	// record the statistics for the observer
+	stats := &invokeStats{}
+	child = context.WithValue(child, invokeStatsContextKey, stats)
+
 	// set the trace id
 	traceID := invoke.headers.Get(headerTraceID)
 	os.Setenv("_X_AMZN_TRACE_ID", traceID)
@@ -220,9 +525,18 @@ func (c *runtimeAPIClient) handleInvokeStreaming(ctx context.Context, invoke *in
 	// nolint:staticcheck
 	child = context.WithValue(child, "x-amzn-trace-id", traceID)
 
+	// set the lambda context
+	lc, err := parseLambdaContext(invoke)
+	if err != nil {
+		c.observer.InvokeError(err)
+		return c.reportFailure(ctx, invoke, lambdaErrorResponse(err))
+	}
+	child = context.WithValue(child, lambdaContextKey, lc)
+
 	// call the handler, marshal any returned error
 	response, contentType, err := callHandlerFuncSteaming(child, invoke.payload, h)
 	if err != nil {
+		c.observer.InvokeError(err)
 		invokeErr := lambdaErrorResponse(err)
 		if err := c.reportFailure(ctx, invoke, invokeErr); err != nil {
 			return err
@@ -234,9 +548,17 @@ func (c *runtimeAPIClient) handleInvokeStreaming(ctx context.Context, invoke *in
 	}
 
 	if err := c.postStreaming(ctx, invoke.id+"/response", response, contentType); err != nil {
+		c.observer.InvokeError(err)
 		return fmt.Errorf("unexpected error occurred when sending the function functionResponse to the API: %w", err)
 	}
 
+	statusCode, requestBytes, responseBytes, err := stats.finish()
+	if err != nil {
+		// the handler fails after the response is started.
+		c.observer.InvokeError(err)
+		return nil
+	}
+	c.observer.InvokeFinished(time.Since(start), statusCode, requestBytes, responseBytes)
 	return nil
 }
 
@@ -260,8 +582,18 @@ func (c *runtimeAPIClient) postStreaming(ctx context.Context, path string, body
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusAccepted {
-		return fmt.Errorf("ridgenative: failed to POST to %s: got unexpected status code: %d", url, resp.StatusCode)
+		err := fmt.Errorf("ridgenative: failed to POST to %s: got unexpected status code: %d", url, resp.StatusCode)
+		if !c.streamingAccepted {
+			// the first streaming response is rejected.
+			// it is likely that the function is not configured for response streaming.
+			c.logger.Printf("ridgenative: the runtime API rejected the streaming response. " +
+				"check that the invoke mode of the function URL is RESPONSE_STREAM, " +
+				"or use InvokeModeBuffered instead.")
+			err = fmt.Errorf("%w (is response streaming enabled on the function?)", err)
+		}
+		return err
 	}
+	c.streamingAccepted = true
 
 	_, err = io.Copy(io.Discard, resp.Body)
 	if err != nil {
@@ -317,3 +649,29 @@ func (r *errorCapturingReader) Close() error {
 	}
 	return r.reader.Close()
 }
+
+// withoutCancel returns a copy of parent that is not canceled when parent is canceled.
+// It is same as context.WithoutCancel that is available from Go 1.21.
+func withoutCancel(parent context.Context) context.Context {
+	return withoutCancelCtx{parent}
+}
+
+type withoutCancelCtx struct {
+	c context.Context
+}
+
+func (withoutCancelCtx) Deadline() (deadline time.Time, ok bool) {
+	return
+}
+
+func (withoutCancelCtx) Done() <-chan struct{} {
+	return nil
+}
+
+func (withoutCancelCtx) Err() error {
+	return nil
+}
+
+func (c withoutCancelCtx) Value(key any) any {
+	return c.c.Value(key)
+}
@@ -5,10 +5,17 @@ import (
 	"encoding/base64"
 	"errors"
 	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -42,6 +49,70 @@ func TestRuntimeAPIClient_next(t *testing.T) {
 	}
 }
 
+func TestRuntimeAPIClient_UserAgent(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		check     func(ua string) bool
+	}{
+		{
+			name: "default",
+			check: func(ua string) bool {
+				return strings.HasPrefix(ua, "ridgenative/") && strings.HasSuffix(ua, " "+runtime.Version())
+			},
+		},
+		{
+			name:      "custom",
+			userAgent: "my-function/1.0",
+			check: func(ua string) bool {
+				return ua == "my-function/1.0"
+			},
+		},
+	}
+	for _, tt := range tests {
+		var mu sync.Mutex
+		var userAgents []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			userAgents = append(userAgents, r.Header.Get("User-Agent"))
+			mu.Unlock()
+			if r.URL.Path == "/2018-06-01/runtime/invocation/next" {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set(headerAWSRequestID, "request-id")
+				_, _ = io.WriteString(w, `{}`)
+				return
+			}
+			_, _ = io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusAccepted)
+		}))
+
+		address := strings.TrimPrefix(ts.URL, "http://")
+		var opts []Option
+		if tt.userAgent != "" {
+			opts = append(opts, WithUserAgent(tt.userAgent))
+		}
+		client := newOptions(opts).newRuntimeAPIClient(address)
+		if _, err := client.next(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.post(context.Background(), "request-id/response", []byte(`{}`), contentTypeJSON); err != nil {
+			t.Fatal(err)
+		}
+		ts.Close()
+
+		mu.Lock()
+		if len(userAgents) != 2 {
+			t.Errorf("%s: want 2 requests, got %d", tt.name, len(userAgents))
+		}
+		for _, ua := range userAgents {
+			if !tt.check(ua) {
+				t.Errorf("%s: unexpected User-Agent: %q", tt.name, ua)
+			}
+		}
+		mu.Unlock()
+	}
+}
+
 func TestRuntimeAPIClient_handleInvoke(t *testing.T) {
 	t.Run("succeeds", func(t *testing.T) {
 		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -74,7 +145,8 @@ func TestRuntimeAPIClient_handleInvoke(t *testing.T) {
 					// the deadline is 100ms
 					encodeDeadline(time.Now().Add(100 * time.Millisecond)),
 				},
-				"Lambda-Runtime-Trace-Id": {"trace-id"},
+				"Lambda-Runtime-Trace-Id":             {"trace-id"},
+				"Lambda-Runtime-Invoked-Function-Arn": {"arn:aws:lambda:us-east-1:123456789012:function:ridgenative"},
 			},
 			payload: []byte(`{"httpMethod":"GET","path":"/"}`),
 		}
@@ -84,6 +156,22 @@ func TestRuntimeAPIClient_handleInvoke(t *testing.T) {
 			if traceID != "trace-id" {
 				t.Errorf("want trace id is %s, got %s", "trace-id", traceID)
 			}
+			// test request id
+			requestID, ok := RequestID(ctx)
+			if !ok {
+				t.Error("request id not found")
+			}
+			if requestID != "request-id" {
+				t.Errorf("want request id is %s, got %s", "request-id", requestID)
+			}
+			// test invoked function arn
+			arn, ok := InvokedFunctionARN(ctx)
+			if !ok {
+				t.Error("invoked function arn not found")
+			}
+			if arn != "arn:aws:lambda:us-east-1:123456789012:function:ridgenative" {
+				t.Errorf("want invoked function arn is %s, got %s", "arn:aws:lambda:us-east-1:123456789012:function:ridgenative", arn)
+			}
 			if req.HTTPMethod != "GET" {
 				t.Errorf("want method is %s, got %s", "GET", req.HTTPMethod)
 			}
@@ -240,6 +328,84 @@ func TestRuntimeAPIClient_handleInvoke(t *testing.T) {
 			t.Fatal(err)
 		}
 	})
+
+	t.Run("timeout response", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/2018-06-01/runtime/invocation/request-id/response" {
+				t.Errorf("unexpected path: %s", r.URL.Path)
+			}
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if string(body) != `{"statusCode":504,"headers":{"Content-Type":"text/plain; charset=utf-8"},"body":"504 Gateway Timeout\n"}` {
+				t.Errorf("unexpected body: %s", string(body))
+			}
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer ts.Close()
+
+		address := strings.TrimPrefix(ts.URL, "http://")
+		client := newRuntimeAPIClient(address)
+		client.logger = log.New(io.Discard, "", 0)
+		client.timeoutResponse = true
+
+		invoke := &invoke{
+			id: "request-id",
+			headers: map[string][]string{
+				"Lambda-Runtime-Deadline-Ms": {
+					// the deadline is 100ms
+					encodeDeadline(time.Now().Add(100 * time.Millisecond)),
+				},
+			},
+			payload: []byte(`{}`),
+		}
+		done := make(chan struct{})
+		start := time.Now()
+		err := client.handleInvoke(context.Background(), invoke, func(ctx context.Context, req *request) (*response, error) {
+			// the handler ignores the context, and sleeps past the deadline.
+			defer close(done)
+			time.Sleep(time.Second)
+			return &response{StatusCode: http.StatusOK}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("handleInvoke waits for the handler: %s", elapsed)
+		}
+		<-done
+	})
+
+	t.Run("timeout response doesn't share the payload", func(t *testing.T) {
+		client := newRuntimeAPIClient("localhost:8080")
+		client.logger = log.New(io.Discard, "", 0)
+		client.timeoutResponse = true
+
+		// the deadline has already passed.
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		ctx = context.WithValue(ctx, invokeStatsContextKey, &invokeStats{})
+
+		payload := []byte(`{"path":"/foo"}`)
+		done := make(chan struct{})
+		_, err := client.callHandler(ctx, payload, func(ctx context.Context, req *request) (*response, error) {
+			defer close(done)
+			if req.Path != "/foo" {
+				t.Errorf("unexpected path: want %q, got %q", "/foo", req.Path)
+			}
+			return &response{StatusCode: http.StatusOK}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// emulate next reusing the buffer for the next invoke.
+		copy(payload, `{"path":"/bar"}`)
+		<-done
+	})
 }
 
 func TestRuntimeAPIClient_handleInvokeStreaming(t *testing.T) {
@@ -284,7 +450,8 @@ func TestRuntimeAPIClient_handleInvokeStreaming(t *testing.T) {
 					// the deadline is 100ms
 					encodeDeadline(time.Now().Add(100 * time.Millisecond)),
 				},
-				"Lambda-Runtime-Trace-Id": {"trace-id"},
+				"Lambda-Runtime-Trace-Id":             {"trace-id"},
+				"Lambda-Runtime-Invoked-Function-Arn": {"arn:aws:lambda:us-east-1:123456789012:function:ridgenative"},
 			},
 			payload: []byte(`{"httpMethod":"GET","path":"/"}`),
 		}
@@ -293,6 +460,22 @@ func TestRuntimeAPIClient_handleInvokeStreaming(t *testing.T) {
 			if traceID != "trace-id" {
 				t.Errorf("want trace id is %s, got %s", "trace-id", traceID)
 			}
+			// test request id
+			requestID, ok := RequestID(ctx)
+			if !ok {
+				t.Error("request id not found")
+			}
+			if requestID != "request-id" {
+				t.Errorf("want request id is %s, got %s", "request-id", requestID)
+			}
+			// test invoked function arn
+			arn, ok := InvokedFunctionARN(ctx)
+			if !ok {
+				t.Error("invoked function arn not found")
+			}
+			if arn != "arn:aws:lambda:us-east-1:123456789012:function:ridgenative" {
+				t.Errorf("want invoked function arn is %s, got %s", "arn:aws:lambda:us-east-1:123456789012:function:ridgenative", arn)
+			}
 			if req.HTTPMethod != "GET" {
 				t.Errorf("want method is %s, got %s", "GET", req.HTTPMethod)
 			}
@@ -514,6 +697,64 @@ func TestRuntimeAPIClient_handleInvokeStreaming(t *testing.T) {
 		}
 	})
 
+	t.Run("panic after flush", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/2018-06-01/runtime/invocation/request-id/response" {
+				t.Errorf("unexpected path: %s", r.URL.Path)
+			}
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			// the prelude and the partial body are already sent.
+			if !strings.HasSuffix(string(body), "hello") {
+				t.Errorf("unexpected body: %q", string(body))
+			}
+
+			if r.Trailer.Get("Lambda-Runtime-Function-Error-Type") != "string" {
+				t.Errorf("unexpected error type: %s", r.Trailer.Get("Lambda-Runtime-Function-Error-Type"))
+			}
+			errBody, err := base64.StdEncoding.DecodeString(r.Trailer.Get("Lambda-Runtime-Function-Error-Body"))
+			if err != nil {
+				t.Error(err)
+			}
+			if !strings.HasPrefix(string(errBody), `{"errorMessage":"some errors","errorType":"string","stackTrace":`) {
+				t.Errorf("unexpected error body: %s", string(errBody))
+			}
+
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer ts.Close()
+
+		address := strings.TrimPrefix(ts.URL, "http://")
+		client := newRuntimeAPIClient(address)
+
+		invoke := &invoke{
+			id: "request-id",
+			headers: map[string][]string{
+				"Lambda-Runtime-Deadline-Ms": {
+					encodeDeadline(time.Now().Add(time.Second)),
+				},
+				"Lambda-Runtime-Trace-Id": {"trace-id"},
+			},
+			payload: []byte(`{"version":"2.0","rawPath":"/","requestContext":{"http":{"method":"GET","path":"/"}}}`),
+		}
+		l := newLambdaFunction(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			if _, err := io.WriteString(w, "hello"); err != nil {
+				t.Error(err)
+			}
+			w.(http.Flusher).Flush()
+			panic("some errors")
+		}))
+		l.logger = log.New(io.Discard, "", 0)
+		err := client.handleInvokeStreaming(context.Background(), invoke, l.lambdaHandlerStreaming)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
 }
 
 type myError struct {
@@ -528,3 +769,710 @@ func encodeDeadline(t time.Time) string {
 	ms := t.UnixMilli()
 	return strconv.FormatInt(ms, 10)
 }
+
+func TestRuntimeAPIClient_startStreaming_Rejected(t *testing.T) {
+	var mu sync.Mutex
+	var nextCount int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/2018-06-01/runtime/invocation/next":
+			nextCount++
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set(headerAWSRequestID, "request-id")
+			w.Header().Set(headerDeadlineMS, encodeDeadline(time.Now().Add(time.Second)))
+			if _, err := io.WriteString(w, `{"httpMethod":"GET","path":"/"}`); err != nil {
+				t.Error(err)
+			}
+		case "/2018-06-01/runtime/invocation/request-id/response":
+			if _, err := io.Copy(io.Discard, r.Body); err != nil {
+				t.Error(err)
+			}
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			t.Errorf("unexpected path: %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	var logs strings.Builder
+	address := strings.TrimPrefix(ts.URL, "http://")
+	client := newRuntimeAPIClient(address)
+	client.logger = log.New(&logs, "", 0)
+
+	err := client.startStreaming(context.Background(), func(ctx context.Context, req *request, w *io.PipeWriter) (string, error) {
+		go func() {
+			_, _ = io.WriteString(w, `{"statusCode":200}`)
+			_ = w.Close()
+		}()
+		return contentTypeHTTPIntegrationResponse, nil
+	})
+	if err == nil {
+		t.Fatal("want error, got nil")
+	}
+	if !strings.Contains(err.Error(), "got unexpected status code: 400") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !strings.Contains(err.Error(), "response streaming") {
+		t.Errorf("want guidance about response streaming, got %v", err)
+	}
+	if !strings.Contains(logs.String(), "RESPONSE_STREAM") {
+		t.Errorf("unexpected log: %q", logs.String())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if nextCount != 1 {
+		t.Errorf("want 1 next call, got %d", nextCount)
+	}
+}
+
+// newSequentialTestRuntimeAPI returns a test Runtime API that delivers n invokes,
+// and reports an error if the next invoke is requested before the response of the previous one.
+func newSequentialTestRuntimeAPI(t *testing.T, n int) *httptest.Server {
+	t.Helper()
+	var mu sync.Mutex
+	var nextCount, responseCount int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/2018-06-01/runtime/invocation/next":
+			mu.Lock()
+			nextCount++
+			if responseCount != nextCount-1 {
+				t.Errorf("the next invoke #%d is requested before the response of the previous one", nextCount)
+			}
+			count := nextCount
+			mu.Unlock()
+			if count > n {
+				// stop the loop.
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set(headerAWSRequestID, "request-id")
+			w.Header().Set(headerDeadlineMS, encodeDeadline(time.Now().Add(time.Second)))
+			if _, err := io.WriteString(w, `{"httpMethod":"GET","path":"/"}`); err != nil {
+				t.Error(err)
+			}
+		case "/2018-06-01/runtime/invocation/request-id/response":
+			if _, err := io.Copy(io.Discard, r.Body); err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			responseCount++
+			mu.Unlock()
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			t.Errorf("unexpected path: %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestRuntimeAPIClient_start_Sequential(t *testing.T) {
+	ts := newSequentialTestRuntimeAPI(t, 3)
+	client := newRuntimeAPIClient(strings.TrimPrefix(ts.URL, "http://"))
+	client.logger = log.New(io.Discard, "", 0)
+
+	var running, calls int32
+	err := client.start(context.Background(), func(ctx context.Context, req *request) (*response, error) {
+		if !atomic.CompareAndSwapInt32(&running, 0, 1) {
+			t.Error("the handler is called concurrently")
+		}
+		defer atomic.StoreInt32(&running, 0)
+		atomic.AddInt32(&calls, 1)
+		// give a chance to detect the next invoke requested too early.
+		time.Sleep(10 * time.Millisecond)
+		return &response{StatusCode: http.StatusOK, Body: "hello"}, nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "got unexpected status code: 500") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Errorf("want 3 calls, got %d", got)
+	}
+}
+
+func TestRuntimeAPIClient_startStreaming_Sequential(t *testing.T) {
+	ts := newSequentialTestRuntimeAPI(t, 3)
+	client := newRuntimeAPIClient(strings.TrimPrefix(ts.URL, "http://"))
+	client.logger = log.New(io.Discard, "", 0)
+
+	var calls int32
+	err := client.startStreaming(context.Background(), func(ctx context.Context, req *request, w *io.PipeWriter) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		go func() {
+			// the response is streamed after the handler returns.
+			time.Sleep(10 * time.Millisecond)
+			_, _ = io.WriteString(w, "hello")
+			_ = w.Close()
+		}()
+		return "text/plain", nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "got unexpected status code: 500") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Errorf("want 3 calls, got %d", got)
+	}
+}
+
+func TestParseLambdaContext(t *testing.T) {
+	t.Run("full", func(t *testing.T) {
+		lc, err := parseLambdaContext(&invoke{
+			id: "request-id",
+			headers: http.Header{
+				"Lambda-Runtime-Invoked-Function-Arn": {"arn:aws:lambda:us-east-1:123456789012:function:ridgenative"},
+				"Lambda-Runtime-Cognito-Identity":     {`{"cognitoIdentityId":"identity-id","cognitoIdentityPoolId":"pool-id"}`},
+				"Lambda-Runtime-Client-Context": {
+					`{"client":{"installation_id":"installation-id","app_title":"app-title","app_version_code":"1.0.0","app_package_name":"com.example.app"},` +
+						`"env":{"platform":"Android"},"custom":{"foo":"bar"}}`,
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &InvokeContext{
+			AwsRequestID:       "request-id",
+			InvokedFunctionArn: "arn:aws:lambda:us-east-1:123456789012:function:ridgenative",
+			Identity: CognitoIdentity{
+				CognitoIdentityID:     "identity-id",
+				CognitoIdentityPoolID: "pool-id",
+			},
+			ClientContext: ClientContext{
+				Client: ClientApplication{
+					InstallationID: "installation-id",
+					AppTitle:       "app-title",
+					AppVersionCode: "1.0.0",
+					AppPackageName: "com.example.app",
+				},
+				Env:    map[string]string{"platform": "Android"},
+				Custom: map[string]string{"foo": "bar"},
+			},
+		}
+		if !reflect.DeepEqual(lc, want) {
+			t.Errorf("unexpected lambda context: want %#v, got %#v", want, lc)
+		}
+	})
+
+	t.Run("no optional headers", func(t *testing.T) {
+		lc, err := parseLambdaContext(&invoke{
+			id:      "request-id",
+			headers: http.Header{},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &InvokeContext{
+			AwsRequestID: "request-id",
+		}
+		if !reflect.DeepEqual(lc, want) {
+			t.Errorf("unexpected lambda context: want %#v, got %#v", want, lc)
+		}
+	})
+
+	t.Run("invalid client context", func(t *testing.T) {
+		_, err := parseLambdaContext(&invoke{
+			id: "request-id",
+			headers: http.Header{
+				"Lambda-Runtime-Client-Context": {`{`},
+			},
+		})
+		if err == nil {
+			t.Error("want error, got nil")
+		}
+	})
+
+	t.Run("invalid cognito identity", func(t *testing.T) {
+		_, err := parseLambdaContext(&invoke{
+			id: "request-id",
+			headers: http.Header{
+				"Lambda-Runtime-Cognito-Identity": {`{`},
+			},
+		})
+		if err == nil {
+			t.Error("want error, got nil")
+		}
+	})
+}
+
+func TestRuntimeAPIClient_next_PayloadTooLarge(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		chunked bool
+		wantErr error
+	}{
+		{"within the limit", `{"key":"value"}`, false, nil},
+		{"exceeding the limit", `{"key":"value!"}`, false, errPayloadTooLarge},
+		{"chunked within the limit", `{"key":"value"}`, true, nil},
+		{"chunked exceeding the limit", `{"key":"value!"}`, true, errPayloadTooLarge},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set(headerAWSRequestID, "request-id")
+				w.WriteHeader(http.StatusOK)
+				if tt.chunked {
+					// send the header without Content-Length.
+					w.(http.Flusher).Flush()
+				}
+				if _, err := io.WriteString(w, tt.payload); err != nil {
+					t.Error(err)
+				}
+			}))
+			defer ts.Close()
+
+			address := strings.TrimPrefix(ts.URL, "http://")
+			client := newRuntimeAPIClient(address)
+			client.maxPayloadSize = int64(len(`{"key":"value"}`))
+
+			invoke, err := client.next(context.Background())
+			if err != tt.wantErr {
+				t.Fatalf("unexpected error: want %v, got %v", tt.wantErr, err)
+			}
+			if invoke.id != "request-id" {
+				t.Errorf("want id is %s, got %s", "request-id", invoke.id)
+			}
+			if err == nil && string(invoke.payload) != tt.payload {
+				t.Errorf("want payload is %s, got %s", tt.payload, string(invoke.payload))
+			}
+		})
+	}
+}
+
+func TestRuntimeAPIClient_start_PayloadTooLarge(t *testing.T) {
+	var mu sync.Mutex
+	var nextCount int
+	var errorBody string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/2018-06-01/runtime/invocation/next":
+			nextCount++
+			if nextCount > 1 {
+				// stop the loop.
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set(headerAWSRequestID, "request-id")
+			w.Header().Set(headerDeadlineMS, encodeDeadline(time.Now().Add(time.Second)))
+			if _, err := io.WriteString(w, `{"httpMethod":"POST","path":"/","body":"too large"}`); err != nil {
+				t.Error(err)
+			}
+		case "/2018-06-01/runtime/invocation/request-id/error":
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			errorBody = string(body)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			t.Errorf("unexpected path: %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	address := strings.TrimPrefix(ts.URL, "http://")
+	client := newRuntimeAPIClient(address)
+	client.logger = log.New(io.Discard, "", 0)
+	client.maxPayloadSize = 16
+	o := &testObserver{}
+	client.observer = o
+
+	err := client.start(context.Background(), func(ctx context.Context, req *request) (*response, error) {
+		t.Error("the handler must not be called")
+		return nil, nil
+	})
+	if err == nil {
+		t.Error("want error, got nil")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if nextCount != 2 {
+		t.Errorf("want 2 next calls, got %d", nextCount)
+	}
+	if !strings.Contains(errorBody, "the invoke payload is too large") {
+		t.Errorf("unexpected error body: %s", errorBody)
+	}
+
+	want := []string{"started", "error: " + errPayloadTooLarge.Error()}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !reflect.DeepEqual(o.events, want) {
+		t.Errorf("unexpected events: want %v, got %v", want, o.events)
+	}
+}
+
+// newDialFailingHTTPClient returns an HTTP client that fails to connect if fail returns true.
+// n is the number of the connection attempts, starting from 1.
+// It doesn't keep connections alive, so every request connects to the server.
+func newDialFailingHTTPClient(fail func(n int) bool) *http.Client {
+	var mu sync.Mutex
+	var count int
+	var dialer net.Dialer
+	return &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				mu.Lock()
+				count++
+				n := count
+				mu.Unlock()
+				if fail(n) {
+					return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+				}
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+func TestRuntimeAPIClient_start_Retry(t *testing.T) {
+	var mu sync.Mutex
+	var nextCount, responseCount int
+	var responseBody string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.URL.Path {
+		case "/2018-06-01/runtime/invocation/next":
+			nextCount++
+			if nextCount > 1 {
+				// stop the loop.
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set(headerAWSRequestID, "request-id")
+			w.Header().Set(headerDeadlineMS, encodeDeadline(time.Now().Add(time.Second)))
+			if _, err := io.WriteString(w, `{"httpMethod":"GET","path":"/"}`); err != nil {
+				t.Error(err)
+			}
+		case "/2018-06-01/runtime/invocation/request-id/response":
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			responseCount++
+			responseBody = string(body)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			t.Errorf("unexpected path: %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	address := strings.TrimPrefix(ts.URL, "http://")
+	client := newRuntimeAPIClient(address)
+	client.logger = log.New(io.Discard, "", 0)
+	// fail the first attempts of the first next and the response.
+	client.httpClient = newDialFailingHTTPClient(func(n int) bool {
+		return n == 1 || n == 3
+	})
+
+	err := client.start(context.Background(), func(ctx context.Context, req *request) (*response, error) {
+		return &response{StatusCode: http.StatusOK, Body: "hello"}, nil
+	})
+	if err == nil {
+		t.Fatal("want error, got nil")
+	}
+	if !strings.Contains(err.Error(), "got unexpected status code: 500") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if nextCount != 2 {
+		t.Errorf("want 2 next calls, got %d", nextCount)
+	}
+	if responseCount != 1 {
+		t.Errorf("want 1 response call, got %d", responseCount)
+	}
+	if !strings.Contains(responseBody, `"body":"hello"`) {
+		t.Errorf("unexpected response body: %s", responseBody)
+	}
+}
+
+func TestRuntimeAPIClient_next_RetryLimit(t *testing.T) {
+	var mu sync.Mutex
+	var dialCount int
+	client := newRuntimeAPIClient("localhost:8080")
+	client.logger = log.New(io.Discard, "", 0)
+	client.httpClient = newDialFailingHTTPClient(func(n int) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		dialCount = n
+		return true
+	})
+
+	_, err := client.next(context.Background())
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("unexpected error: want %v, got %v", syscall.ECONNREFUSED, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if dialCount != maxRetries+1 {
+		t.Errorf("want %d connection attempts, got %d", maxRetries+1, dialCount)
+	}
+}
+
+func TestRuntimeAPIClient_post_NoRetryAfterSent(t *testing.T) {
+	var mu sync.Mutex
+	var responseCount int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		responseCount++
+		mu.Unlock()
+		if _, err := io.ReadAll(r.Body); err != nil {
+			t.Error(err)
+		}
+
+		// the runtime API may have accepted the response, but the connection is closed without responding.
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	defer ts.Close()
+
+	address := strings.TrimPrefix(ts.URL, "http://")
+	client := newRuntimeAPIClient(address)
+	var buf strings.Builder
+	client.logger = log.New(&buf, "", 0)
+
+	err := client.post(context.Background(), "request-id/response", []byte(`{}`), contentTypeJSON)
+	if err == nil {
+		t.Fatal("want error, got nil")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if responseCount != 1 {
+		t.Errorf("want 1 response call, got %d", responseCount)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("the sent request must not be retried: %s", buf.String())
+	}
+}
+
+func TestRuntimeAPIClient_next_NotDialError(t *testing.T) {
+	var mu sync.Mutex
+	var nextCount int
+	client := newRuntimeAPIClient("localhost:8080")
+	client.httpClient = &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			nextCount++
+			return nil, errors.New("permanent error")
+		}),
+	}
+	var buf strings.Builder
+	client.logger = log.New(&buf, "", 0)
+
+	_, err := client.next(context.Background())
+	if err == nil {
+		t.Fatal("want error, got nil")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if nextCount != 1 {
+		t.Errorf("want 1 next call, got %d", nextCount)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("the error other than connection failures must not be retried: %s", buf.String())
+	}
+}
+
+func TestRuntimeAPIClient_next_Canceled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	address := strings.TrimPrefix(ts.URL, "http://")
+	client := newRuntimeAPIClient(address)
+	var buf strings.Builder
+	client.logger = log.New(&buf, "", 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.next(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error: want %v, got %v", context.DeadlineExceeded, err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("the canceled request must not be retried: %s", buf.String())
+	}
+}
+
+func TestRuntimeAPIClient_start_NextTimeout(t *testing.T) {
+	var mu sync.Mutex
+	var nextCount int
+	var responded bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/2018-06-01/runtime/invocation/next":
+			mu.Lock()
+			nextCount++
+			count := nextCount
+			mu.Unlock()
+			if count > 1 {
+				// the runtime API is stuck.
+				<-r.Context().Done()
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set(headerAWSRequestID, "request-id")
+			w.Header().Set(headerDeadlineMS, encodeDeadline(time.Now().Add(time.Second)))
+			if _, err := io.WriteString(w, `{"httpMethod":"GET","path":"/"}`); err != nil {
+				t.Error(err)
+			}
+		case "/2018-06-01/runtime/invocation/request-id/response":
+			if _, err := io.Copy(io.Discard, r.Body); err != nil {
+				t.Error(err)
+			}
+			// the responses are not affected by the timeout.
+			time.Sleep(100 * time.Millisecond)
+			mu.Lock()
+			responded = true
+			mu.Unlock()
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			t.Errorf("unexpected path: %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	address := strings.TrimPrefix(ts.URL, "http://")
+	client := newOptions([]Option{
+		WithNextInvokeTimeout(50 * time.Millisecond),
+		WithLogger(log.New(io.Discard, "", 0)),
+	}).newRuntimeAPIClient(address)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- client.start(context.Background(), func(ctx context.Context, req *request) (*response, error) {
+			return &response{StatusCode: http.StatusOK, Body: "hello"}, nil
+		})
+	}()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("unexpected error: want %v, got %v", context.DeadlineExceeded, err)
+		}
+		if err == nil || !strings.Contains(err.Error(), "doesn't respond to the next invoke request in 50ms") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the timeout doesn't trigger")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !responded {
+		t.Error("the response is not sent")
+	}
+	if nextCount != 2 {
+		t.Errorf("want 2 next calls, got %d", nextCount)
+	}
+}
+
+func TestEffectiveDeadline(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	deadline := now.Add(3 * time.Second)
+	tests := []struct {
+		name   string
+		margin time.Duration
+		want   time.Time
+	}{
+		{"zero", 0, deadline},
+		{"negative", -time.Second, deadline},
+		{"margin", 500 * time.Millisecond, deadline.Add(-500 * time.Millisecond)},
+		{"same as remaining time", 3 * time.Second, deadline},
+		{"longer than remaining time", 5 * time.Second, deadline},
+	}
+	for _, tt := range tests {
+		if got := effectiveDeadline(deadline, tt.margin, now); !got.Equal(tt.want) {
+			t.Errorf("%s: unexpected deadline: want %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestRuntimeAPIClient_DeadlineMargin(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	address := strings.TrimPrefix(ts.URL, "http://")
+	deadline := time.Now().Add(time.Minute).Truncate(time.Millisecond)
+	newInvoke := func() *invoke {
+		return &invoke{
+			id: "request-id",
+			headers: map[string][]string{
+				"Lambda-Runtime-Deadline-Ms": {encodeDeadline(deadline)},
+			},
+			payload: []byte(`{"httpMethod":"GET","path":"/"}`),
+		}
+	}
+	want := deadline.Add(-10 * time.Second)
+
+	t.Run("buffered", func(t *testing.T) {
+		client := newRuntimeAPIClient(address)
+		client.deadlineMargin = 10 * time.Second
+		err := client.handleInvoke(context.Background(), newInvoke(), func(ctx context.Context, req *request) (*response, error) {
+			got, ok := ctx.Deadline()
+			if !ok {
+				t.Error("want deadline, got none")
+			}
+			if !got.Equal(want) {
+				t.Errorf("unexpected deadline: want %s, got %s", want, got)
+			}
+			return &response{StatusCode: http.StatusOK}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		client := newRuntimeAPIClient(address)
+		client.deadlineMargin = 10 * time.Second
+		err := client.handleInvokeStreaming(context.Background(), newInvoke(), func(ctx context.Context, req *request, w *io.PipeWriter) (string, error) {
+			got, ok := ctx.Deadline()
+			if !ok {
+				t.Error("want deadline, got none")
+			}
+			if !got.Equal(want) {
+				t.Errorf("unexpected deadline: want %s, got %s", want, got)
+			}
+			go w.Close()
+			return contentTypeHTTPIntegrationResponse, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
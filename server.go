@@ -0,0 +1,111 @@
+package ridgenative
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// ErrServerClosed is returned by the Serve method of Server after a call to Shutdown.
+var ErrServerClosed = errors.New("ridgenative: Server closed")
+
+// errServerRunning is returned by the Serve method of Server if it is already serving.
+var errServerRunning = errors.New("ridgenative: Server is already serving")
+
+// Server handles the invokes from the runtime API like Start, but it can be stopped programmatically.
+// It is useful for the integration tests against a fake runtime API.
+// The zero value is not usable, use NewServer instead.
+type Server struct {
+	mux  http.Handler
+	opts *options
+
+	mu     sync.Mutex
+	closed bool
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewServer returns a new Server that serves the invokes with mux.
+// The handler is typically nil, in which case the DefaultServeMux is used.
+// If RIDGENATIVE_INVOKE_MODE environment value is defined, it is used as the invoke mode.
+// Otherwise, if AWS_LAMBDA_FUNCTION_RESPONSE_STREAMING environment value is true, such as "true" or "1",
+// InvokeModeResponseStream is used.
+// The default is InvokeModeBuffered.
+// WithInvokeMode overrides the environment values.
+// WithBaseContext is ignored in favor of the context given to Serve.
+func NewServer(mux http.Handler, opts ...Option) *Server {
+	return &Server{
+		mux:  mux,
+		opts: newOptions(opts),
+	}
+}
+
+// Serve waits for new invokes from the runtime API given by AWS_LAMBDA_RUNTIME_API environment value,
+// and handles them until ctx is canceled or Shutdown is called.
+// The init hooks run before the first invoke, and the shutdown hooks run after the last one.
+// Serve returns nil if ctx is canceled, and ErrServerClosed after Shutdown.
+func (s *Server) Serve(ctx context.Context) error {
+	mode, err := s.opts.invokeMode()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	if s.cancel != nil {
+		s.mu.Unlock()
+		return errServerRunning
+	}
+	s.cancel = cancel
+	s.done = done
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.cancel = nil
+		s.done = nil
+		s.mu.Unlock()
+		close(done)
+	}()
+
+	o := *s.opts
+	o.mode = mode
+	err = serve(ctx, s.mux, &o)
+
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if err == nil && closed {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// Shutdown stops waiting for new invokes, and waits for the in-flight invoke and the shutdown hooks to complete.
+// If ctx is canceled before that, Shutdown returns the error of ctx.
+// Once Shutdown is called, Serve returns ErrServerClosed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	cancel, done := s.cancel, s.done
+	s.mu.Unlock()
+
+	if cancel == nil {
+		// the server is not serving.
+		return nil
+	}
+	cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
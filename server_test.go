@@ -0,0 +1,173 @@
+package ridgenative
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newBlockingTestRuntimeAPI starts a fake runtime API that serves the events in order.
+// After all events are served, the next request blocks until the client cancels it.
+// The responses of the invokes are sent to responses.
+func newBlockingTestRuntimeAPI(t *testing.T, responses chan<- string, events ...string) {
+	t.Helper()
+	var mu sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/2018-06-01/runtime/invocation/next" {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			w.WriteHeader(http.StatusAccepted)
+			responses <- string(body)
+			return
+		}
+
+		mu.Lock()
+		if len(events) == 0 {
+			mu.Unlock()
+			<-r.Context().Done()
+			return
+		}
+		event := events[0]
+		events = events[1:]
+		mu.Unlock()
+		w.Header().Set(headerAWSRequestID, "request-id")
+		w.Header().Set(headerDeadlineMS, encodeDeadline(time.Now().Add(time.Minute)))
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := io.WriteString(w, event); err != nil {
+			t.Error(err)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	t.Setenv("AWS_LAMBDA_RUNTIME_API", strings.TrimPrefix(ts.URL, "http://"))
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	t.Run("waiting for the next invoke", func(t *testing.T) {
+		newBlockingTestRuntimeAPI(t, make(chan string, 1))
+		var hookCalled bool
+		s := NewServer(http.NotFoundHandler(), WithLogger(log.New(io.Discard, "", 0)), WithShutdownHook(func(ctx context.Context) error {
+			hookCalled = true
+			return nil
+		}))
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- s.Serve(context.Background())
+		}()
+		time.Sleep(50 * time.Millisecond) // wait for starting the server.
+
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errCh; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("unexpected error: want %v, got %v", ErrServerClosed, err)
+		}
+		if !hookCalled {
+			t.Error("the shutdown hook is not called")
+		}
+	})
+
+	t.Run("in-flight invoke completes", func(t *testing.T) {
+		responses := make(chan string, 1)
+		newBlockingTestRuntimeAPI(t, responses, `{"httpMethod":"GET","path":"/"}`)
+		started := make(chan struct{})
+		release := make(chan struct{})
+		s := NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			if err := r.Context().Err(); err != nil {
+				t.Errorf("the request context is canceled: %v", err)
+			}
+			_, _ = io.WriteString(w, "hello")
+		}), WithLogger(log.New(io.Discard, "", 0)))
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- s.Serve(context.Background())
+		}()
+		<-started
+
+		shutdownCh := make(chan error, 1)
+		go func() {
+			shutdownCh <- s.Shutdown(context.Background())
+		}()
+		select {
+		case err := <-shutdownCh:
+			t.Fatalf("Shutdown returns before the in-flight invoke completes: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(release)
+		if err := <-shutdownCh; err != nil {
+			t.Fatal(err)
+		}
+		if resp := <-responses; !strings.Contains(resp, `"body":"hello"`) {
+			t.Errorf("unexpected response: %s", resp)
+		}
+		if err := <-errCh; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("unexpected error: want %v, got %v", ErrServerClosed, err)
+		}
+	})
+
+	t.Run("shutdown timeout", func(t *testing.T) {
+		newBlockingTestRuntimeAPI(t, make(chan string, 1), `{"httpMethod":"GET","path":"/"}`)
+		started := make(chan struct{})
+		release := make(chan struct{})
+		defer close(release)
+		s := NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		}), WithLogger(log.New(io.Discard, "", 0)))
+		go func() {
+			_ = s.Serve(context.Background())
+		}()
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("unexpected error: want %v, got %v", context.DeadlineExceeded, err)
+		}
+	})
+
+	t.Run("serve after shutdown", func(t *testing.T) {
+		s := NewServer(http.NotFoundHandler())
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Serve(context.Background()); !errors.Is(err, ErrServerClosed) {
+			t.Errorf("unexpected error: want %v, got %v", ErrServerClosed, err)
+		}
+	})
+}
+
+func TestServer_Serve_Canceled(t *testing.T) {
+	newBlockingTestRuntimeAPI(t, make(chan string, 1))
+	s := NewServer(http.NotFoundHandler(), WithLogger(log.New(io.Discard, "", 0)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Serve(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond) // wait for starting the server.
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the loop doesn't exit")
+	}
+}